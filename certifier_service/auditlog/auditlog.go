@@ -0,0 +1,416 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package auditlog writes certification decisions as JSON lines.  Each
+// record holds the hash of the record before it, so editing, removing or
+// reordering records breaks the chain and is found by Verify.  The head of
+// the chain can be signed, so that truncating the log or rewriting the
+// whole chain is found too.
+package auditlog
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The PrevHash of the first record in a log.
+const GenesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Record is one certification decision.
+type Record struct {
+	Sequence     uint64 `json:"seq"`
+	Time         string `json:"time"`
+	RemoteIP     string `json:"remote_ip,omitempty"`
+	EvidenceType string `json:"evidence_type,omitempty"`
+	Purpose      string `json:"purpose,omitempty"`
+	Measurement  string `json:"measurement,omitempty"`
+	PolicyDigest string `json:"policy_digest,omitempty"`
+	Outcome      string `json:"outcome"`
+	Reason       string `json:"reason,omitempty"`
+	CertSerial   string `json:"cert_serial,omitempty"`
+	PrevHash     string `json:"prev_hash"`
+	Hash         string `json:"hash"`
+}
+
+// computeHash returns the hex sha256 of r serialized with Hash empty.
+// PrevHash is part of the hashed record, which links the chain.
+func computeHash(r *Record) (string, error) {
+	c := *r
+	c.Hash = ""
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// Head is the last record of a log, signed so that rewriting the chain or
+// removing records up to it is found without trusting the log file.  It
+// is kept in HeadFileName(log) and replaced after every record.
+type Head struct {
+	Sequence  uint64 `json:"seq"`
+	Hash      string `json:"hash"`
+	Time      string `json:"time"`
+	Signature []byte `json:"signature"`
+}
+
+// HeadFileName returns the file the signed head of fileName is kept in.
+func HeadFileName(fileName string) string {
+	return fileName + ".head"
+}
+
+func (h *Head) signedBytes() []byte {
+	return []byte(fmt.Sprintf("certifier audit log head\n%d\n%s\n%s\n", h.Sequence, h.Hash, h.Time))
+}
+
+func (h *Head) sign(signer crypto.Signer) error {
+	var err error
+	msg := h.signedBytes()
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		h.Signature, err = signer.Sign(rand.Reader, msg, crypto.Hash(0))
+		return err
+	}
+	digest := sha256.Sum256(msg)
+	h.Signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	return err
+}
+
+func (h *Head) verify(pub crypto.PublicKey) error {
+	msg := h.signedBytes()
+	digest := sha256.Sum256(msg)
+	ok := false
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], h.Signature) == nil
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, digest[:], h.Signature)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, msg, h.Signature)
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	if !ok {
+		return errors.New("signature on the head doesn't verify")
+	}
+	return nil
+}
+
+func readHead(fileName string) (*Head, error) {
+	b, err := os.ReadFile(HeadFileName(fileName))
+	if err != nil {
+		return nil, err
+	}
+	h := &Head{}
+	if err = json.Unmarshal(b, h); err != nil {
+		return nil, fmt.Errorf("can't parse head: %v", err)
+	}
+	return h, nil
+}
+
+// writeHead replaces the head file, so it is never seen half written.
+func writeHead(fileName string, h *Head) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	tmp := HeadFileName(fileName) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, HeadFileName(fileName))
+}
+
+// ErrPartialRecord is returned for a last line without a newline, left by
+// a write that didn't finish.
+var ErrPartialRecord = errors.New("partial final record")
+
+// ErrUnsignedRecord is returned by VerifyWithKey for a last record the
+// signed head doesn't cover, left by a crash between writing the record
+// and signing the head, or appended by someone without the key.
+var ErrUnsignedRecord = errors.New("final record is not covered by the signed head")
+
+// Options for OpenWithOptions.
+type Options struct {
+	// Signs the head after every record, e.g. the policy key.  An existing
+	// head must verify with its public key.
+	Signer crypto.Signer
+}
+
+// Log appends records to an audit log file.  It is safe for concurrent use.
+type Log struct {
+	mu        sync.Mutex
+	fileName  string
+	f         *os.File
+	lastHash  string
+	nextSeq   uint64
+	signer    crypto.Signer
+	recovered bool
+	unsigned  uint64
+}
+
+// Open opens or creates the audit log in fileName.  An existing log is
+// verified first, so new records are never chained to a tampered log.
+func Open(fileName string) (*Log, error) {
+	return OpenWithOptions(fileName, nil)
+}
+
+// OpenWithOptions is Open with a signed head if opts has a Signer.  A
+// partial record at the end of the log, left by a crash, is removed.  A
+// final record the head doesn't cover is accepted and the head signed
+// again; UnsignedRecord reports it.
+func OpenWithOptions(fileName string, opts *Options) (*Log, error) {
+	var pub crypto.PublicKey
+	if opts != nil && opts.Signer != nil {
+		pub = opts.Signer.Public()
+	}
+	n, lastHash, end, err := verifyFile(fileName, pub)
+	recovered := false
+	if errors.Is(err, ErrPartialRecord) {
+		if err = os.Truncate(fileName, end); err != nil {
+			return nil, err
+		}
+		recovered = true
+		n, lastHash, _, err = verifyFile(fileName, pub)
+	}
+	unsigned := uint64(0)
+	if errors.Is(err, ErrUnsignedRecord) {
+		unsigned = uint64(n) + 1
+		n++
+		err = nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{fileName: fileName, f: f, lastHash: lastHash, nextSeq: uint64(n) + 1, recovered: recovered,
+		unsigned: unsigned}
+	if pub != nil {
+		l.signer = opts.Signer
+		if err = l.signHead(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Recovered reports whether Open removed a partial final record.
+func (l *Log) Recovered() bool {
+	return l.recovered
+}
+
+// UnsignedRecord returns the sequence number of the final record the head
+// didn't cover when the log was opened, or 0.  It should be checked, as it
+// may have been appended by someone without the key.
+func (l *Log) UnsignedRecord() uint64 {
+	return l.unsigned
+}
+
+func (l *Log) signHead() error {
+	h := &Head{
+		Sequence: l.nextSeq - 1,
+		Hash:     l.lastHash,
+		Time:     time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if err := h.sign(l.signer); err != nil {
+		return err
+	}
+	return writeHead(l.fileName, h)
+}
+
+// Append fills in the sequence number, time and hashes of r and writes it.
+func (l *Log) Append(r *Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.Sequence = l.nextSeq
+	if r.Time == "" {
+		r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	r.PrevHash = l.lastHash
+	hash, err := computeHash(r)
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = l.f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	err = l.f.Sync()
+	if err != nil {
+		return err
+	}
+	l.lastHash = hash
+	l.nextSeq++
+	if l.signer != nil {
+		return l.signHead()
+	}
+	return nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Verify checks every record in fileName and the links between them.  It
+// returns the number of records, or an error naming the first bad line.
+func Verify(fileName string) (int, error) {
+	n, _, _, err := verifyFile(fileName, nil)
+	return n, err
+}
+
+// VerifyWithKey is Verify, also checking that the head is signed by pub
+// and is a record of the log.  A log with records must have a head, and
+// every record must be covered by it.  One final record after the head
+// returns ErrUnsignedRecord and the number of records the head covers.
+func VerifyWithKey(fileName string, pub crypto.PublicKey) (int, error) {
+	n, _, _, err := verifyFile(fileName, pub)
+	return n, err
+}
+
+// verifyFile returns the number of good records, the hash of the last and
+// the offset of its end.  If pub isn't nil, the head must verify with it.
+func verifyFile(fileName string, pub crypto.PublicKey) (int, string, int64, error) {
+	lastHash := GenesisHash
+	var head *Head
+	if pub != nil {
+		var err error
+		head, err = readHead(fileName)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return 0, lastHash, 0, err
+		}
+		if head != nil {
+			if err = head.verify(pub); err != nil {
+				return 0, lastHash, 0, err
+			}
+		}
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, lastHash, 0, err
+	}
+	defer f.Close()
+
+	n, end, err := 0, int64(0), error(nil)
+	headHash := ""
+	if head != nil && head.Sequence == 0 {
+		headHash = GenesisHash
+	}
+	reader := bufio.NewReader(f)
+	for {
+		line := n + 1
+		b, rerr := reader.ReadBytes('\n')
+		if rerr == io.EOF && len(b) > 0 {
+			err = fmt.Errorf("line %d: %w", line, ErrPartialRecord)
+			break
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			err = fmt.Errorf("line %d: %v", line, rerr)
+			break
+		}
+		r := &Record{}
+		if err = json.Unmarshal(b, r); err != nil {
+			err = fmt.Errorf("line %d: can't parse record: %v", line, err)
+			break
+		}
+		if r.Sequence != uint64(line) {
+			err = fmt.Errorf("line %d: sequence number is %d", line, r.Sequence)
+			break
+		}
+		if r.PrevHash != lastHash {
+			err = fmt.Errorf("line %d: previous hash doesn't match record %d", line, n)
+			break
+		}
+		hash, herr := computeHash(r)
+		if herr != nil {
+			err = fmt.Errorf("line %d: %v", line, herr)
+			break
+		}
+		if hash != r.Hash {
+			err = fmt.Errorf("line %d: record hash doesn't match contents", line)
+			break
+		}
+		lastHash = hash
+		n++
+		end += int64(len(b))
+		if head != nil && r.Sequence == head.Sequence {
+			headHash = hash
+		}
+	}
+
+	// Otherwise the chain could be rewritten and the head deleted.
+	if pub != nil && head == nil && n > 0 {
+		return n, lastHash, end, fmt.Errorf("%s is missing", HeadFileName(fileName))
+	}
+	// Records the head covers must be there, unchanged.
+	if head != nil && (errors.Is(err, ErrPartialRecord) || err == nil) {
+		if head.Sequence > uint64(n) {
+			return n, lastHash, end, fmt.Errorf("log ends at record %d but its signed head is record %d",
+				n, head.Sequence)
+		}
+		if headHash != head.Hash {
+			return n, lastHash, end, fmt.Errorf("record %d doesn't match the signed head", head.Sequence)
+		}
+		// Only a crash between writing a record and signing the head
+		// leaves a record after it.
+		if uint64(n) > head.Sequence+1 {
+			return n, lastHash, end, fmt.Errorf("records %d to %d are after the signed head",
+				head.Sequence+1, n)
+		}
+		if err == nil && uint64(n) == head.Sequence+1 {
+			return n - 1, lastHash, end, fmt.Errorf("record %d: %w", n, ErrUnsignedRecord)
+		}
+	}
+	return n, lastHash, end, err
+}
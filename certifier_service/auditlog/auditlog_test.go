@@ -0,0 +1,207 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auditlog
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeRecords(t *testing.T, fileName string, outcomes ...string) {
+	writeSignedRecords(t, fileName, nil, outcomes...)
+}
+
+func writeSignedRecords(t *testing.T, fileName string, signer crypto.Signer, outcomes ...string) {
+	l, err := OpenWithOptions(fileName, &Options{Signer: signer})
+	if err != nil {
+		t.Fatalf("Can't open audit log: %v", err)
+	}
+	defer l.Close()
+	for _, o := range outcomes {
+		err = l.Append(&Record{RemoteIP: "127.0.0.1", EvidenceType: "vse-attestation-package",
+			Purpose: "authentication", Outcome: o})
+		if err != nil {
+			t.Fatalf("Can't append: %v", err)
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "audit.log")
+	writeRecords(t, fileName, "succeeded", "failed")
+	// Reopening continues the chain.
+	writeRecords(t, fileName, "succeeded")
+
+	n, err := Verify(fileName)
+	if err != nil || n != 3 {
+		t.Errorf("Verify: %d records, %v", n, err)
+	}
+}
+
+func TestTamper(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "audit.log")
+	writeRecords(t, fileName, "failed", "failed", "failed")
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+
+	edited := bytes.Replace(b, []byte(`"outcome":"failed"`), []byte(`"outcome":"succeeded"`), 1)
+	removed := bytes.Join([][]byte{lines[0], lines[2]}, nil)
+	for name, contents := range map[string][]byte{"edited": edited, "removed": removed} {
+		os.WriteFile(fileName, contents, 0600)
+		if _, err := Verify(fileName); err == nil {
+			t.Errorf("Verify accepted %s log", name)
+		}
+		if _, err := Open(fileName); err == nil {
+			t.Errorf("Open accepted %s log", name)
+		}
+	}
+}
+
+func TestPartialRecord(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "audit.log")
+	writeRecords(t, fileName, "succeeded", "failed")
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"seq":3,"time":"2022-`))
+	f.Close()
+
+	if _, err := Verify(fileName); !errors.Is(err, ErrPartialRecord) {
+		t.Errorf("Verify: %v, want a partial record", err)
+	}
+	l, err := Open(fileName)
+	if err != nil {
+		t.Fatalf("Open didn't recover: %v", err)
+	}
+	if !l.Recovered() {
+		t.Errorf("Recovered is false")
+	}
+	if err = l.Append(&Record{Outcome: "succeeded"}); err != nil {
+		t.Fatalf("Can't append: %v", err)
+	}
+	l.Close()
+	n, err := Verify(fileName)
+	if err != nil || n != 3 {
+		t.Errorf("Verify: %d records, %v", n, err)
+	}
+}
+
+func TestSignedHead(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "audit.log")
+	writeSignedRecords(t, fileName, key, "failed", "failed", "failed")
+	n, err := VerifyWithKey(fileName, key.Public())
+	if err != nil || n != 3 {
+		t.Errorf("VerifyWithKey: %d records, %v", n, err)
+	}
+	if _, err = VerifyWithKey(fileName, other.Public()); err == nil {
+		t.Errorf("VerifyWithKey accepted a head signed by another key")
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := os.ReadFile(HeadFileName(fileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+
+	// The same chain with the last record edited, written without the key.
+	rewritten := filepath.Join(dir, "rewritten.log")
+	os.WriteFile(rewritten, bytes.Join(lines[:2], nil), 0600)
+	writeRecords(t, rewritten, "succeeded")
+	rewrittenLog, err := os.ReadFile(rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, contents := range map[string][]byte{
+		"truncated": bytes.Join(lines[:2], nil),
+		"rewritten": rewrittenLog,
+	} {
+		os.WriteFile(fileName, contents, 0600)
+		if _, err := Verify(fileName); err != nil {
+			t.Errorf("Verify rejected %s log, the chain alone is good: %v", name, err)
+		}
+		if _, err := VerifyWithKey(fileName, key.Public()); err == nil {
+			t.Errorf("VerifyWithKey accepted %s log", name)
+		}
+		if _, err := OpenWithOptions(fileName, &Options{Signer: key}); err == nil {
+			t.Errorf("OpenWithOptions accepted %s log", name)
+		}
+	}
+
+	os.WriteFile(fileName, b, 0600)
+	os.Remove(HeadFileName(fileName))
+	if _, err := VerifyWithKey(fileName, key.Public()); err == nil {
+		t.Errorf("VerifyWithKey accepted a log without a head")
+	}
+	os.WriteFile(HeadFileName(fileName), head, 0600)
+	if _, err := VerifyWithKey(fileName, key.Public()); err != nil {
+		t.Errorf("VerifyWithKey: %v", err)
+	}
+
+	// A well chained record appended without the key isn't covered by
+	// the head.  One is what a crash before signing the head leaves, so
+	// OpenWithOptions accepts it and reports it.
+	writeRecords(t, fileName, "succeeded")
+	n, err = VerifyWithKey(fileName, key.Public())
+	if !errors.Is(err, ErrUnsignedRecord) || n != 3 {
+		t.Errorf("VerifyWithKey with a forged record: %d records, %v", n, err)
+	}
+	oneForged, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, fileName, "succeeded")
+	if _, err = VerifyWithKey(fileName, key.Public()); err == nil || errors.Is(err, ErrUnsignedRecord) {
+		t.Errorf("VerifyWithKey with two forged records: %v", err)
+	}
+	if _, err = OpenWithOptions(fileName, &Options{Signer: key}); err == nil {
+		t.Errorf("OpenWithOptions accepted two records after the head")
+	}
+	os.WriteFile(fileName, oneForged, 0600)
+	l, err := OpenWithOptions(fileName, &Options{Signer: key})
+	if err != nil {
+		t.Fatalf("OpenWithOptions with one record after the head: %v", err)
+	}
+	l.Close()
+	if l.UnsignedRecord() != 4 {
+		t.Errorf("Unsigned record %d, want 4", l.UnsignedRecord())
+	}
+	if n, err = VerifyWithKey(fileName, key.Public()); err != nil || n != 4 {
+		t.Errorf("VerifyWithKey after signing again: %d records, %v", n, err)
+	}
+}
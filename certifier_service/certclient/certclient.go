@@ -0,0 +1,388 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package certclient gets an enclave key certified by the certifier
+// service.  It builds the evidence package from the enclave's attestation,
+// sends the trust request over the sized socket protocol and checks the
+// admission cert it gets back, as certify_me in cc_helpers.cc does.
+package certclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	certlib "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certlib"
+	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+	"google.golang.org/protobuf/proto"
+)
+
+// evidenceTypes are the submitted evidence type of a trust request and the
+// evidence type of the attestation in its package.
+type evidenceTypes struct {
+	submitted   string
+	attestation string
+}
+
+var enclaveEvidence = map[string]evidenceTypes{
+	"simulated-enclave":   {"vse-attestation-package", "signed-vse-attestation-report"},
+	"application-enclave": {"vse-attestation-package", "signed-vse-attestation-report"},
+	"sev-enclave":         {"sev-platform-package", "sev-attestation"},
+	"gramine-enclave":     {"gramine-evidence", "gramine-attestation"},
+	"keystone-enclave":    {"keystone-evidence", "keystone-attestation"},
+	"islet-enclave":       {"islet-evidence", "islet-attestation"},
+	"oe-enclave":          {"oe-evidence", "oe-attestation-report"},
+}
+
+// SubmittedEvidenceType returns the submitted_evidence_type for requests
+// from enclaves of enclaveType, or "" if the type isn't supported.
+func SubmittedEvidenceType(enclaveType string) string {
+	return enclaveEvidence[enclaveType].submitted
+}
+
+// MakeEvidencePackage returns the evidence package for an enclave of
+// enclaveType: the platform evidence, such as the "signed-claim" that the
+// platform key is trusted or the "cert" chain of the platform, followed by
+// the enclave's attestation.
+func MakeEvidencePackage(enclaveType string, platformEvidence []*certprotos.Evidence,
+	attestation []byte) (*certprotos.EvidencePackage, error) {
+
+	t, ok := enclaveEvidence[enclaveType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported enclave type %q", enclaveType)
+	}
+	prover := "vse-verifier"
+	ep := &certprotos.EvidencePackage{ProverType: &prover}
+	for _, ev := range platformEvidence {
+		ep.FactAssertion = append(ep.FactAssertion, proto.Clone(ev).(*certprotos.Evidence))
+	}
+	at := t.attestation
+	ep.FactAssertion = append(ep.FactAssertion, &certprotos.Evidence{
+		EvidenceType:       &at,
+		SerializedEvidence: attestation,
+	})
+	return ep, nil
+}
+
+// MakeAttestationUserData returns the serialized attestation_user_data the
+// enclave attests to: its type, the time, the public enclave key and, if
+// it isn't nil, the nonce from the certifier.
+func MakeAttestationUserData(enclaveType string, enclaveKey *certprotos.KeyMessage, nonce []byte) ([]byte, error) {
+	tn := certlib.TimePointToString(certlib.TimePointNow())
+	ud := &certprotos.AttestationUserData{
+		EnclaveType: &enclaveType,
+		Time:        &tn,
+		EnclaveKey:  enclaveKey,
+		Nonce:       nonce,
+	}
+	return proto.Marshal(ud)
+}
+
+// Attester returns the enclave's attestation of userData, e.g. the
+// serialized sev_attestation_message or signed report for the platform.
+type Attester func(userData []byte) ([]byte, error)
+
+// Config says where the certifier is and what to ask it for.
+type Config struct {
+	// Address of the certifier's sized socket listener, host:port.
+	Address string
+	// TLS settings if the certifier runs with --useTls, nil for plain TCP.
+	TLSConfig *tls.Config
+	// The policy cert the admission cert must be issued by.
+	PolicyCert *x509.Certificate
+	// Policy domain and admission cert profile, the certifier's defaults
+	// if empty.
+	Domain  string
+	Profile string
+	// Ask for a nonce and put it in the attestation, and sign the request
+	// with the enclave key.  Needed if the certifier runs with
+	// --requireNonce or --requirePossession.
+	UseNonce bool
+	// Attempts after the first when the certifier can't be reached, the
+	// connection fails or it is rate limiting, and the wait before the
+	// first of them, which doubles each time up to MaxRetryDelay, a minute
+	// if 0.  Other failures are not retried.
+	Retries       int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// Limit on each exchange with the certifier, none if 0.
+	Timeout time.Duration
+	// Largest response accepted, in bytes, DefaultMaxResponseSize if 0.
+	MaxResponseSize int
+}
+
+// DefaultMaxResponseSize is the default Config.MaxResponseSize, plenty for
+// an admission cert.
+const DefaultMaxResponseSize = 1024 * 1024
+
+// Request is the enclave to be certified.
+type Request struct {
+	// Enclave type, e.g. "sev-enclave"; see MakeEvidencePackage.
+	EnclaveType string
+	// Platform evidence put before the attestation.
+	PlatformEvidence []*certprotos.Evidence
+	// The private enclave key.  Its public half is certified.
+	EnclaveKey *certprotos.KeyMessage
+	// Called for each attempt, with a new nonce if UseNonce is set.
+	Attest Attester
+}
+
+// ErrRejected is returned when the certifier turned the request down.
+var ErrRejected = errors.New("certifier rejected the request")
+
+// errRateLimited is returned for an attempt the certifier rate limited.
+var errRateLimited = errors.New("certifier is rate limiting")
+
+// transientError is a failure that another attempt may not have: the
+// certifier couldn't be reached, the connection failed or it was rate
+// limiting.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+func transient(err error) error {
+	return &transientError{err}
+}
+
+// Client gets enclave keys certified.
+type Client struct {
+	config Config
+	sleep  func(ctx context.Context, d time.Duration) error
+}
+
+// New returns a client for config.
+func New(config Config) (*Client, error) {
+	if config.Address == "" {
+		return nil, errors.New("no certifier address")
+	}
+	if config.PolicyCert == nil {
+		return nil, errors.New("no policy cert")
+	}
+	return &Client{config: config, sleep: sleep}, nil
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Certify is CertifyContext without a context.
+func (c *Client) Certify(r *Request) (*tls.Certificate, error) {
+	return c.CertifyContext(context.Background(), r)
+}
+
+// CertifyContext gets an admission cert for the enclave key in r and
+// returns it with the private key, ready to use in a tls.Config.  Cancelling
+// ctx stops the attempt in progress and any further ones.
+func (c *Client) CertifyContext(ctx context.Context, r *Request) (*tls.Certificate, error) {
+	if r.EnclaveKey == nil || r.Attest == nil {
+		return nil, errors.New("request needs an enclave key and an attester")
+	}
+	signer := certlib.GetSignerFromInternal(r.EnclaveKey)
+	if signer == nil {
+		return nil, errors.New("enclave key isn't a private key")
+	}
+	publicKey := certlib.InternalPublicFromPrivateKey(r.EnclaveKey)
+	if publicKey == nil {
+		return nil, fmt.Errorf("unsupported enclave key type %s", r.EnclaveKey.GetKeyType())
+	}
+
+	var artifact []byte
+	var err error
+	var te *transientError
+	delay := c.config.RetryDelay
+	maxDelay := c.config.MaxRetryDelay
+	if maxDelay <= 0 {
+		maxDelay = time.Minute
+	}
+	for attempt := 0; ; attempt++ {
+		artifact, err = c.attempt(ctx, r, publicKey)
+		if err == nil || !errors.As(err, &te) || attempt >= c.config.Retries {
+			break
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		if serr := c.sleep(ctx, delay); serr != nil {
+			return nil, serr
+		}
+		delay *= 2
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(artifact)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse admission cert: %w", err)
+	}
+	if !certlib.VerifyAdmissionCert(c.config.PolicyCert, cert) {
+		return nil, errors.New("admission cert isn't issued by the policy cert")
+	}
+	subjectKey := certlib.GetSubjectKey(cert)
+	if subjectKey == nil || !certlib.SameKey(subjectKey, publicKey) {
+		return nil, errors.New("admission cert is for another key")
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{artifact},
+		PrivateKey:  signer,
+		Leaf:        cert,
+	}, nil
+}
+
+// attempt runs one certification: nonce, attestation and trust request.
+func (c *Client) attempt(ctx context.Context, r *Request, publicKey *certprotos.KeyMessage) ([]byte, error) {
+	submitted := SubmittedEvidenceType(r.EnclaveType)
+	if submitted == "" {
+		return nil, fmt.Errorf("unsupported enclave type %q", r.EnclaveType)
+	}
+
+	var nonce []byte
+	if c.config.UseNonce {
+		yes := true
+		resp, err := c.exchange(ctx, &certprotos.TrustRequestMessage{RequestNonce: &yes})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Nonce) == 0 {
+			return nil, errors.New("certifier returned no nonce")
+		}
+		nonce = resp.Nonce
+	}
+
+	ud, err := MakeAttestationUserData(r.EnclaveType, publicKey, nonce)
+	if err != nil {
+		return nil, err
+	}
+	attestation, err := r.Attest(ud)
+	if err != nil {
+		return nil, fmt.Errorf("attestation failed: %w", err)
+	}
+	ep, err := MakeEvidencePackage(r.EnclaveType, r.PlatformEvidence, attestation)
+	if err != nil {
+		return nil, err
+	}
+
+	requesting := "requesting-enclave"
+	providing := "providing-enclave"
+	purpose := "authentication"
+	request := &certprotos.TrustRequestMessage{
+		RequestingEnclaveTag:  &requesting,
+		ProvidingEnclaveTag:   &providing,
+		SubmittedEvidenceType: &submitted,
+		Purpose:               &purpose,
+		Support:               ep,
+	}
+	if c.config.Domain != "" {
+		request.Domain = &c.config.Domain
+	}
+	if c.config.Profile != "" {
+		request.Profile = &c.config.Profile
+	}
+	if nonce != nil && !certlib.SignTrustRequest(request, r.EnclaveKey, nonce) {
+		return nil, errors.New("can't sign the request with the enclave key")
+	}
+
+	resp, err := c.exchange(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Artifact) == 0 {
+		return nil, errors.New("certifier returned no admission cert")
+	}
+	return resp.Artifact, nil
+}
+
+// exchange sends request and reads the response, which must have succeeded.
+func (c *Client) exchange(ctx context.Context,
+	request *certprotos.TrustRequestMessage) (*certprotos.TrustResponseMessage, error) {
+	b, err := proto.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.dial(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, transient(err)
+	}
+	defer conn.Close()
+	if c.config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	}
+	// Unblock the read or write if ctx is done first.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if !certlib.SizedSocketWrite(conn, b) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, transient(errors.New("can't send request"))
+	}
+	maxSize := c.config.MaxResponseSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxResponseSize
+	}
+	rb := certlib.SizedSocketReadMax(conn, maxSize)
+	if rb == nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, transient(errors.New("can't read response"))
+	}
+	resp := &certprotos.TrustResponseMessage{}
+	if err := proto.Unmarshal(rb, resp); err != nil {
+		return nil, fmt.Errorf("can't parse response: %w", err)
+	}
+	switch resp.GetStatus() {
+	case "succeeded":
+		return resp, nil
+	case "rate-limited":
+		return nil, transient(errRateLimited)
+	default:
+		return nil, ErrRejected
+	}
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	d := &net.Dialer{Timeout: c.config.Timeout}
+	if c.config.TLSConfig != nil {
+		td := &tls.Dialer{NetDialer: d, Config: c.config.TLSConfig}
+		return td.DialContext(ctx, "tcp", c.config.Address)
+	}
+	return d.DialContext(ctx, "tcp", c.config.Address)
+}
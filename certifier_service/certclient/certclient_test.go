@@ -0,0 +1,273 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	certlib "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certlib"
+	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMakeEvidencePackage(t *testing.T) {
+	certType := "cert"
+	platform := []*certprotos.Evidence{{EvidenceType: &certType, SerializedEvidence: []byte{1}}}
+	ep, err := MakeEvidencePackage("sev-enclave", platform, []byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep.GetProverType() != "vse-verifier" || len(ep.FactAssertion) != 2 ||
+		ep.FactAssertion[0].GetEvidenceType() != "cert" ||
+		ep.FactAssertion[1].GetEvidenceType() != "sev-attestation" ||
+		!bytes.Equal(ep.FactAssertion[1].SerializedEvidence, []byte{2}) {
+		t.Errorf("Wrong evidence package %v", ep)
+	}
+	if SubmittedEvidenceType("sev-enclave") != "sev-platform-package" {
+		t.Errorf("Wrong submitted evidence type")
+	}
+	if _, err := MakeEvidencePackage("asylo-enclave", nil, nil); err == nil {
+		t.Errorf("Unsupported enclave type accepted")
+	}
+}
+
+// fakeCertifier issues admission certs to the enclave key in vse
+// attestations, checking the nonce and proof of possession.
+type fakeCertifier struct {
+	t          *testing.T
+	listener   net.Listener
+	policyKey  *certprotos.KeyMessage
+	policyCert *x509.Certificate
+	nonce      []byte
+	requests   int
+	// Statuses to answer evidence requests with before issuing a cert.
+	statuses []string
+}
+
+func makePolicyCert(t *testing.T) (*certprotos.KeyMessage, *x509.Certificate) {
+	policyKey := certlib.MakeVseRsaKey(2048)
+	signer := certlib.GetSignerFromInternal(policyKey)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "policyKey"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return policyKey, cert
+}
+
+func newFakeCertifier(t *testing.T) *fakeCertifier {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeCertifier{t: t, listener: l}
+	f.policyKey, f.policyCert = makePolicyCert(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeCertifier) serve(conn net.Conn) {
+	defer conn.Close()
+	request := &certprotos.TrustRequestMessage{}
+	if proto.Unmarshal(certlib.SizedSocketRead(conn), request) != nil {
+		return
+	}
+	response := f.respond(request)
+	b, _ := proto.Marshal(response)
+	certlib.SizedSocketWrite(conn, b)
+}
+
+func (f *fakeCertifier) respond(request *certprotos.TrustRequestMessage) *certprotos.TrustResponseMessage {
+	status := "succeeded"
+	response := &certprotos.TrustResponseMessage{Status: &status}
+	if request.GetRequestNonce() {
+		f.nonce = []byte{byte(f.requests), 1, 2, 3}
+		response.Nonce = f.nonce
+		return response
+	}
+	f.requests++
+	if len(f.statuses) > 0 {
+		status = f.statuses[0]
+		f.statuses = f.statuses[1:]
+		return response
+	}
+	status = "failed"
+
+	if request.GetSubmittedEvidenceType() != "vse-attestation-package" || request.GetDomain() != "tenant-b" {
+		f.t.Errorf("Wrong request %v", request)
+		return response
+	}
+	var ud *certprotos.AttestationUserData
+	for _, ev := range request.Support.GetFactAssertion() {
+		if ev.GetEvidenceType() != "signed-vse-attestation-report" {
+			continue
+		}
+		sr := certprotos.SignedReport{}
+		info := certprotos.VseAttestationReportInfo{}
+		ud = &certprotos.AttestationUserData{}
+		if proto.Unmarshal(ev.SerializedEvidence, &sr) != nil || proto.Unmarshal(sr.Report, &info) != nil ||
+			proto.Unmarshal(info.UserData, ud) != nil {
+			f.t.Errorf("Can't parse attestation")
+			return response
+		}
+	}
+	if ud == nil || !bytes.Equal(ud.Nonce, f.nonce) {
+		f.t.Errorf("Attestation doesn't have the nonce")
+		return response
+	}
+	if !certlib.VerifyTrustRequestPossession(request, ud.EnclaveKey) ||
+		!bytes.Equal(request.Possession.Nonce, f.nonce) {
+		f.t.Errorf("Bad proof of possession")
+		return response
+	}
+	cert := certlib.ProduceAdmissionCert("", f.policyKey, f.policyCert, ud.EnclaveKey,
+		"CertifierUsers", "Measured-00", 2, 3600)
+	status = "succeeded"
+	response.Artifact = cert.Raw
+	return response
+}
+
+// attestVse wraps the user data in a vse attestation report, unsigned.
+func attestVse(ud []byte) ([]byte, error) {
+	info, _ := proto.Marshal(&certprotos.VseAttestationReportInfo{UserData: ud})
+	return proto.Marshal(&certprotos.SignedReport{Report: info})
+}
+
+func TestCertify(t *testing.T) {
+	f := newFakeCertifier(t)
+	defer f.listener.Close()
+	f.statuses = []string{"rate-limited"}
+
+	c, err := New(Config{
+		Address:    f.listener.Addr().String(),
+		PolicyCert: f.policyCert,
+		Domain:     "tenant-b",
+		UseNonce:   true,
+		Retries:    2,
+		RetryDelay: time.Second,
+		Timeout:    10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slept []time.Duration
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	enclaveKey := certlib.MakeVseEccKey(256)
+	r := &Request{EnclaveType: "simulated-enclave", EnclaveKey: enclaveKey, Attest: attestVse}
+	tlsCert, err := c.Certify(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.requests != 2 || len(slept) != 1 || slept[0] != time.Second {
+		t.Errorf("Rate limited request not retried once: %d requests, slept %v", f.requests, slept)
+	}
+	if tlsCert.Leaf == nil || !certlib.VerifyAdmissionCert(f.policyCert, tlsCert.Leaf) {
+		t.Errorf("Returned cert doesn't verify")
+	}
+	if !certlib.SameKey(certlib.GetSubjectKey(tlsCert.Leaf), certlib.InternalPublicFromPrivateKey(enclaveKey)) {
+		t.Errorf("Returned cert is for another key")
+	}
+	if tlsCert.PrivateKey == nil {
+		t.Errorf("No private key")
+	}
+
+	// Rejections aren't retried.
+	f.requests = 0
+	f.statuses = []string{"failed"}
+	if _, err := c.Certify(r); !errors.Is(err, ErrRejected) || f.requests != 1 {
+		t.Errorf("Rejected request: %v after %d requests", err, f.requests)
+	}
+
+	// Nor are attestation failures.
+	f.requests = 0
+	slept = nil
+	failing := &Request{EnclaveType: "simulated-enclave", EnclaveKey: enclaveKey,
+		Attest: func([]byte) ([]byte, error) { return nil, errors.New("no attestation") }}
+	if _, err := c.Certify(failing); err == nil || len(slept) != 0 {
+		t.Errorf("Attestation failure: %v after %d retries", err, len(slept))
+	}
+
+	// The cert must come from the configured policy cert.
+	_, otherCert := makePolicyCert(t)
+	c.config.PolicyCert = otherCert
+	if _, err := c.Certify(r); err == nil {
+		t.Errorf("Cert from another policy key accepted")
+	}
+}
+
+func TestCertifyUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	_, policyCert := makePolicyCert(t)
+	c, _ := New(Config{Address: addr, PolicyCert: policyCert, Retries: 3,
+		RetryDelay: 40 * time.Second, MaxRetryDelay: time.Minute})
+	var slept []time.Duration
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+	r := &Request{EnclaveType: "simulated-enclave", EnclaveKey: certlib.MakeVseEccKey(256), Attest: attestVse}
+	if _, err := c.Certify(r); err == nil {
+		t.Errorf("Certify succeeded without a certifier")
+	}
+	want := []time.Duration{40 * time.Second, time.Minute, time.Minute}
+	if len(slept) != len(want) || slept[0] != want[0] || slept[1] != want[1] || slept[2] != want[2] {
+		t.Errorf("Slept %v, want %v", slept, want)
+	}
+
+	// Cancelling the context stops the retries.
+	c.sleep = sleep
+	c.config.RetryDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.CertifyContext(ctx, r); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Cancelled Certify returned %v", err)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -25,17 +26,24 @@ import (
 	"crypto/sha512"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
-	//"net"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	//"syscall"
 	"testing"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+	"golang.org/x/crypto/ocsp"
 )
 
 func TestEntity(t *testing.T) {
@@ -466,8 +474,8 @@ func TestProofsAuth(t *testing.T) {
 
 	// Next statement is here because we removed InitAxiom from InitProvedStatements
 	InitAxiom(*policyKey, &ps)
-	if !InitProvedStatements(*policyKey, evidenceList, &ps) {
-		t.Errorf("Cannot init proved statements")
+	if err := InitProvedStatements(*policyKey, evidenceList, &ps); err != nil {
+		t.Errorf("Cannot init proved statements: %s", err)
 	}
 	fmt.Printf("Initial proved statements %d\n", len(ps.Proved))
 	for i := 0; i < len(ps.Proved); i++ {
@@ -519,7 +527,7 @@ func TestProofsAuth(t *testing.T) {
 	}
 	p.Steps = append(p.Steps, &ps5)
 
-	if VerifyProof(policyKey, enclaveKeyIsTrusted, &p, &ps) {
+	if err := VerifyProof(policyKey, enclaveKeyIsTrusted, &p, &ps); err == nil {
 		fmt.Printf("Proved: ")
 		PrintVseClause(enclaveKeyIsTrusted)
 		fmt.Println("")
@@ -680,8 +688,8 @@ func TestProofsAttest(t *testing.T) {
 
 	// Next statement is here because we removed InitAxiom from InitProvedStatements
 	InitAxiom(*policyKey, &ps)
-	if !InitProvedStatements(*policyKey, evidenceList, &ps) {
-		t.Errorf("Cannot init proved statements")
+	if err := InitProvedStatements(*policyKey, evidenceList, &ps); err != nil {
+		t.Errorf("Cannot init proved statements: %s", err)
 	}
 	fmt.Printf("Initial proved statements %d\n", len(ps.Proved))
 	for i := 0; i < len(ps.Proved); i++ {
@@ -733,7 +741,7 @@ func TestProofsAttest(t *testing.T) {
 	}
 	p.Steps = append(p.Steps, &ps5)
 
-	if VerifyProof(policyKey, enclaveKeyIsTrusted, &p, &ps) {
+	if err := VerifyProof(policyKey, enclaveKeyIsTrusted, &p, &ps); err == nil {
 		fmt.Printf("Proved: ")
 		PrintVseClause(enclaveKeyIsTrusted)
 		fmt.Println("")
@@ -1780,3 +1788,1064 @@ func TestGramineVerify(t *testing.T) {
 	fmt.Printf("\n")
 }
 */
+
+type testVerifier struct {
+	validated bool
+}
+
+func (v *testVerifier) FilterPolicy(policyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
+	original *certprotos.ProvedStatements) *certprotos.ProvedStatements {
+	return original
+}
+
+func (v *testVerifier) ConstructProof(policyKey *certprotos.KeyMessage, purpose string,
+	alreadyProved *certprotos.ProvedStatements) (*certprotos.VseClause, *certprotos.Proof) {
+	return nil, nil
+}
+
+func (v *testVerifier) Validate(policyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
+	originalPolicy *certprotos.ProvedStatements, purpose string) (*ValidationResult, error) {
+	v.validated = true
+	return &ValidationResult{Measurement: []byte{1, 2, 3}}, nil
+}
+
+// proofVerifier constructs a fixed proof, for ValidateEvidenceWithVerifier.
+type proofVerifier struct {
+	toProve *certprotos.VseClause
+	proof   *certprotos.Proof
+}
+
+func (v *proofVerifier) FilterPolicy(policyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
+	original *certprotos.ProvedStatements) *certprotos.ProvedStatements {
+	return proto.Clone(original).(*certprotos.ProvedStatements)
+}
+
+func (v *proofVerifier) ConstructProof(policyKey *certprotos.KeyMessage, purpose string,
+	alreadyProved *certprotos.ProvedStatements) (*certprotos.VseClause, *certprotos.Proof) {
+	return v.toProve, v.proof
+}
+
+func (v *proofVerifier) Validate(policyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
+	originalPolicy *certprotos.ProvedStatements, purpose string) (*ValidationResult, error) {
+	return ValidateEvidenceWithVerifier(v, policyKey, evp, originalPolicy, purpose)
+}
+
+func TestEvidenceRegistry(t *testing.T) {
+	builtin := []string{"gramine-evidence", "islet-evidence", "keystone-evidence",
+		"oe-evidence", "sev-platform-package", "vse-attestation-package"}
+	for _, ev := range builtin {
+		if FindEvidenceVerifier(ev) == nil {
+			t.Errorf("No verifier for %s\n", ev)
+		}
+	}
+	if FindEvidenceParser("signed-claim") == nil || FindEvidenceParser("cert") == nil {
+		t.Errorf("Built in parsers not registered\n")
+	}
+
+	v := &testVerifier{}
+	if err := RegisterEvidenceVerifier("test-evidence", v); err != nil {
+		t.Errorf("Can't register verifier: %s\n", err)
+	}
+	if RegisterEvidenceVerifier("test-evidence", v) == nil {
+		t.Errorf("Duplicate verifier registered\n")
+	}
+	if RegisterEvidenceVerifier("", v) == nil {
+		t.Errorf("Empty evidence type registered\n")
+	}
+	result, err := ValidateEvidence("test-evidence", nil, nil, nil, "authentication")
+	if err != nil || !v.validated || !bytes.Equal(result.Measurement, []byte{1, 2, 3}) {
+		t.Errorf("ValidateEvidence did not dispatch to registered verifier\n")
+	}
+	_, err = ValidateEvidence("no-such-evidence", nil, nil, nil, "authentication")
+	if err == nil {
+		t.Errorf("ValidateEvidence succeeded for unknown type\n")
+	}
+
+	// An out of tree parser is used by InitProvedStatements.
+	var parsed []int
+	err = RegisterEvidenceParser("test-assertion", func(st *EvidenceParseState,
+		ev *certprotos.Evidence, ps *certprotos.ProvedStatements) error {
+		parsed = append(parsed, st.Index)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Can't register parser: %s\n", err)
+	}
+	evType := "test-assertion"
+	evList := []*certprotos.Evidence{{EvidenceType: &evType}, {EvidenceType: &evType}}
+	ps := &certprotos.ProvedStatements{}
+	if InitProvedStatements(certprotos.KeyMessage{}, evList, ps) != nil || len(parsed) != 2 || parsed[1] != 1 {
+		t.Errorf("InitProvedStatements did not use registered parser\n")
+	}
+	unknown := "unknown-assertion"
+	evList = []*certprotos.Evidence{{EvidenceType: &evType}, {EvidenceType: &unknown}}
+	err = InitProvedStatements(certprotos.KeyMessage{}, evList, ps)
+	if ve, ok := err.(*ValidationError); !ok || ve.Stage != StageParse || ve.Evidence != 1 {
+		t.Errorf("Wrong error for unknown evidence: %v\n", err)
+	}
+
+	// Errors from other parsers are wrapped with the evidence position.
+	cause := errors.New("bad assertion")
+	err = RegisterEvidenceParser("test-bad-assertion", func(st *EvidenceParseState,
+		ev *certprotos.Evidence, ps *certprotos.ProvedStatements) error {
+		return cause
+	})
+	if err != nil {
+		t.Errorf("Can't register parser: %s\n", err)
+	}
+	badType := "test-bad-assertion"
+	evList = []*certprotos.Evidence{{EvidenceType: &badType}}
+	err = InitProvedStatements(certprotos.KeyMessage{}, evList, ps)
+	if ve, ok := err.(*ValidationError); !ok || ve.Stage != StageEvidence || ve.Evidence != 0 ||
+		!errors.Is(err, cause) || ReasonCode(err) != "evidence" {
+		t.Errorf("Wrong error for failed parser: %v\n", err)
+	}
+	scType := "signed-claim"
+	evList = []*certprotos.Evidence{{EvidenceType: &scType, SerializedEvidence: []byte{0xff}}}
+	err = InitProvedStatements(certprotos.KeyMessage{}, evList, ps)
+	if ReasonCode(err) != "parse" {
+		t.Errorf("Wrong error for unparsable claim: %v\n", err)
+	}
+}
+
+// makeTestCaCert returns a self-signed CA cert for privateKey that can sign
+// certs and CRLs.
+func makeTestCaCert(t *testing.T, privateKey *certprotos.KeyMessage, name string) *x509.Certificate {
+	signer := GetSignerFromInternal(privateKey)
+	if signer == nil {
+		t.Fatalf("Can't get signer for %s", name)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, signer.Public(), signer)
+	if err != nil {
+		t.Fatalf("Can't create %s cert: %v", name, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Can't parse %s cert: %v", name, err)
+	}
+	return cert
+}
+
+func TestCrl(t *testing.T) {
+	privateIssuerKey := MakeVseRsaKey(2048)
+	ipk := "issuerKey"
+	privateIssuerKey.KeyName = &ipk
+	privateSubjKey := MakeVseRsaKey(2048)
+	spk := "subjKey"
+	privateSubjKey.KeyName = &spk
+	subjKey := InternalPublicFromPrivateKey(privateSubjKey)
+
+	issuerCert := makeTestCaCert(t, privateIssuerKey, "testIssuer")
+
+	crlUrl := "http://localhost:8126/crl"
+	cert := ProduceAdmissionCertWithOptions("", privateIssuerKey, issuerCert, subjKey, "testSubject", "",
+		uint64(5), 365.0*86400, &AdmissionCertOptions{CrlDistributionPoints: []string{crlUrl}})
+	if cert == nil {
+		t.Fatal("Can't produce admission cert")
+	}
+	if len(cert.CRLDistributionPoints) != 1 || cert.CRLDistributionPoints[0] != crlUrl {
+		t.Errorf("CRL distribution point not in cert: %v", cert.CRLDistributionPoints)
+	}
+
+	emptyCrl := ProduceCrl(privateIssuerKey, issuerCert, nil, big.NewInt(1), 86400)
+	if !VerifyAdmissionCertWithOptions(issuerCert, cert, &AdmissionCertVerifyOptions{Crl: emptyCrl}) {
+		t.Errorf("Cert not on CRL does not verify")
+	}
+	revoked := []pkix.RevokedCertificate{{SerialNumber: big.NewInt(5), RevocationTime: time.Now()}}
+	crl := ProduceCrl(privateIssuerKey, issuerCert, revoked, big.NewInt(2), 86400)
+	if VerifyAdmissionCertWithOptions(issuerCert, cert, &AdmissionCertVerifyOptions{Crl: crl}) {
+		t.Errorf("Revoked cert verifies")
+	}
+	if !VerifyAdmissionCert(issuerCert, cert) {
+		t.Errorf("Cert does not verify without CRL")
+	}
+
+	// A CRL from another key with the issuer's name is rejected.
+	otherKey := MakeVseRsaKey(2048)
+	otherKey.KeyName = &ipk
+	forged := ProduceCrl(otherKey, makeTestCaCert(t, otherKey, "testIssuer"), nil, big.NewInt(3), 86400)
+	if forged == nil {
+		t.Fatal("Can't produce CRL with other key")
+	}
+	if VerifyAdmissionCertWithOptions(issuerCert, cert, &AdmissionCertVerifyOptions{Crl: forged}) {
+		t.Errorf("Cert verifies with CRL from wrong key")
+	}
+}
+
+func TestOcsp(t *testing.T) {
+	privateIssuerKey := MakeVseRsaKey(2048)
+	ipk := "issuerKey"
+	privateIssuerKey.KeyName = &ipk
+	privateSubjKey := MakeVseRsaKey(2048)
+	spk := "subjKey"
+	privateSubjKey.KeyName = &spk
+	subjKey := InternalPublicFromPrivateKey(privateSubjKey)
+
+	ipK := rsa.PrivateKey{}
+	iPK := rsa.PublicKey{}
+	if !GetRsaKeysFromInternal(privateIssuerKey, &ipK, &iPK) {
+		t.Fatal("Can't get issuer key")
+	}
+	issuerCert := makeTestCaCert(t, privateIssuerKey, "testIssuer")
+
+	ocspUrl := "http://localhost:8127/ocsp"
+	cert := ProduceAdmissionCertWithOptions("", privateIssuerKey, issuerCert, subjKey, "testSubject", "",
+		uint64(5), 365.0*86400, &AdmissionCertOptions{OcspServers: []string{ocspUrl}})
+	if cert == nil {
+		t.Fatal("Can't produce admission cert")
+	}
+	if len(cert.OCSPServer) != 1 || cert.OCSPServer[0] != ocspUrl {
+		t.Errorf("OCSP server not in cert: %v", cert.OCSPServer)
+	}
+
+	status := OcspStatus{Status: ocsp.Good}
+	lookup := func(serial *big.Int) OcspStatus {
+		if serial.Cmp(big.NewInt(5)) != 0 {
+			return OcspStatus{Status: ocsp.Unknown}
+		}
+		return status
+	}
+	req, err := ocsp.CreateRequest(cert, issuerCert, &ocsp.RequestOptions{Hash: crypto.SHA256})
+	if err != nil {
+		t.Fatal("Can't create OCSP request")
+	}
+
+	resp := ProduceOcspResponse(req, lookup, privateIssuerKey, issuerCert, issuerCert, 3600)
+	if !VerifyAdmissionCertWithOptions(issuerCert, cert, &AdmissionCertVerifyOptions{OcspResponse: resp}) {
+		t.Errorf("Good cert does not verify with OCSP response")
+	}
+
+	status = OcspStatus{Status: ocsp.Revoked, RevokedAt: time.Now()}
+	resp = ProduceOcspResponse(req, lookup, privateIssuerKey, issuerCert, issuerCert, 3600)
+	if VerifyAdmissionCertWithOptions(issuerCert, cert, &AdmissionCertVerifyOptions{OcspResponse: resp}) {
+		t.Errorf("Revoked cert verifies with OCSP response")
+	}
+	status = OcspStatus{Status: ocsp.Good}
+
+	if !OcspRequestIssuedBy(req, issuerCert) || OcspRequestIssuedBy(req, cert) {
+		t.Errorf("OcspRequestIssuedBy is wrong")
+	}
+
+	if !bytes.Equal(ProduceOcspResponse([]byte("junk"), lookup, privateIssuerKey, issuerCert, issuerCert, 3600),
+		ocsp.MalformedRequestErrorResponse) {
+		t.Errorf("Malformed request not rejected")
+	}
+
+	// A delegated responder needs the OCSP signing usage.
+	privateResponderKey := MakeVseRsaKey(2048)
+	rpk := "responderKey"
+	privateResponderKey.KeyName = &rpk
+	rK := rsa.PrivateKey{}
+	rPK := rsa.PublicKey{}
+	if !GetRsaKeysFromInternal(privateResponderKey, &rK, &rPK) {
+		t.Fatal("Can't get responder key")
+	}
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning, x509.ExtKeyUsageServerAuth} {
+		responderTemplate := x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "testResponder"},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(86400 * 1000000000),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &responderTemplate, issuerCert,
+			&rK.PublicKey, crypto.Signer(&ipK))
+		if err != nil {
+			t.Fatal("Can't create responder cert")
+		}
+		responderCert, _ := x509.ParseCertificate(der)
+		resp = ProduceOcspResponse(req, lookup, privateResponderKey, responderCert, issuerCert, 3600)
+		ok := CheckOcspResponse(issuerCert, cert, resp)
+		if ok != (usage == x509.ExtKeyUsageOCSPSigning) {
+			t.Errorf("Delegated response with usage %d: got %v", usage, ok)
+		}
+	}
+
+	// A response signed by another key is rejected.
+	otherKey := MakeVseRsaKey(2048)
+	otherKey.KeyName = &ipk
+	resp = ProduceOcspResponse(req, lookup, otherKey, issuerCert, issuerCert, 3600)
+	if CheckOcspResponse(issuerCert, cert, resp) {
+		t.Errorf("Response from wrong key verifies")
+	}
+}
+
+func TestAttestedUserData(t *testing.T) {
+	privateEnclaveKey := MakeVseRsaKey(2048)
+	ek := "enclaveKey"
+	privateEnclaveKey.KeyName = &ek
+	enclaveKey := InternalPublicFromPrivateKey(privateEnclaveKey)
+	otherKey := InternalPublicFromPrivateKey(MakeVseRsaKey(2048))
+	privateAttestKey := MakeVseRsaKey(2048)
+	ak := "attestKey"
+	privateAttestKey.KeyName = &ak
+	attestKey := InternalPublicFromPrivateKey(privateAttestKey)
+
+	nonce := []byte("0123456789abcdef0123456789abcdef")
+	ud := certprotos.AttestationUserData{EnclaveKey: enclaveKey, Nonce: nonce}
+	serializedUD, err := proto.Marshal(&ud)
+	if err != nil {
+		t.Fatal("Can't marshal user data")
+	}
+	tn := TimePointNow()
+	nb, na := TimePointToString(tn), TimePointToString(TimePointPlus(tn, 86400))
+	info, _ := proto.Marshal(&certprotos.VseAttestationReportInfo{UserData: serializedUD,
+		VerifiedMeasurement: []byte{1, 2, 3}, NotBefore: &nb, NotAfter: &na})
+	alg := SigningAlgorithmForKey(privateAttestKey)
+	sr := &certprotos.SignedReport{Report: info, SigningKey: attestKey, SigningAlgorithm: &alg,
+		Signature: SignWithKey(alg, privateAttestKey, info)}
+	serializedSr, _ := proto.Marshal(sr)
+	evType := "signed-vse-attestation-report"
+	evidence := []*certprotos.Evidence{{EvidenceType: &evType, SerializedEvidence: serializedSr}}
+
+	// The verified user data is kept for the result.
+	st, err := initProvedStatements(attestKey, evidence, &certprotos.ProvedStatements{})
+	if err != nil || len(st.UserData) != 1 {
+		t.Fatalf("User data not kept: %v", err)
+	}
+	verb := "is-trusted-for-authentication"
+	result := &ValidationResult{Statement: MakeUnaryVseClause(MakeKeyEntity(enclaveKey), &verb),
+		UserData: st.UserData}
+	got := result.AttestedUserData()
+	if got == nil || !bytes.Equal(got.Nonce, nonce) {
+		t.Errorf("Wrong user data for enclave key: %v", got)
+	}
+	result.Statement = MakeUnaryVseClause(MakeKeyEntity(otherKey), &verb)
+	if result.AttestedUserData() != nil {
+		t.Errorf("User data returned for another key")
+	}
+
+	// User data in a report that doesn't verify isn't.
+	sr.Signature[0] ^= 1
+	serializedSr, _ = proto.Marshal(sr)
+	evidence[0].SerializedEvidence = serializedSr
+	st, err = initProvedStatements(attestKey, evidence, &certprotos.ProvedStatements{})
+	if err == nil || st != nil {
+		t.Errorf("Report with bad signature accepted")
+	}
+}
+
+func TestProofOfPossession(t *testing.T) {
+	rsaKey := MakeVseRsaKey(2048)
+	rk := "rsaEnclaveKey"
+	rsaKey.KeyName = &rk
+
+	eccPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Can't generate ecc key")
+	}
+	eccKey := &certprotos.KeyMessage{}
+	if !GetInternalKeyFromEccPublicKey("eccEnclaveKey", &eccPriv.PublicKey, eccKey) {
+		t.Fatal("Can't convert ecc key")
+	}
+	eccPublic := proto.Clone(eccKey).(*certprotos.KeyMessage)
+	kt := "ecc-256-private"
+	eccKey.KeyType = &kt
+	eccKey.EccKey.PrivateMultiplier = eccPriv.D.Bytes()
+
+	nonce := []byte("0123456789abcdef0123456789abcdef")
+	evType := "vse-attestation-package"
+	purpose := "authentication"
+	for _, k := range []*certprotos.KeyMessage{rsaKey, eccKey} {
+		var public *certprotos.KeyMessage
+		if k == eccKey {
+			public = eccPublic
+		} else {
+			public = InternalPublicFromPrivateKey(k)
+		}
+		request := &certprotos.TrustRequestMessage{
+			SubmittedEvidenceType: &evType,
+			Purpose:               &purpose,
+			Support:               &certprotos.EvidencePackage{},
+		}
+		if !SignTrustRequest(request, k, nonce) {
+			t.Fatalf("Can't sign request with %s", k.GetKeyType())
+		}
+		if !VerifyTrustRequestPossession(request, public) {
+			t.Errorf("Proof of possession with %s does not verify", k.GetKeyType())
+		}
+
+		other := "attestation"
+		request.Purpose = &other
+		if VerifyTrustRequestPossession(request, public) {
+			t.Errorf("Proof of possession verifies for changed request")
+		}
+		request.Purpose = &purpose
+		request.Possession.Nonce = []byte("another nonce")
+		if VerifyTrustRequestPossession(request, public) {
+			t.Errorf("Proof of possession verifies for changed nonce")
+		}
+	}
+
+	// Signed with another key.
+	request := &certprotos.TrustRequestMessage{SubmittedEvidenceType: &evType}
+	SignTrustRequest(request, rsaKey, nonce)
+	if VerifyTrustRequestPossession(request, InternalPublicFromPrivateKey(MakeVseRsaKey(2048))) {
+		t.Errorf("Proof of possession verifies with wrong key")
+	}
+}
+
+func TestAdmissionCertProfile(t *testing.T) {
+	privateIssuerKey := MakeVseRsaKey(2048)
+	ipk := "issuerKey"
+	privateIssuerKey.KeyName = &ipk
+	privateSubjKey := MakeVseRsaKey(2048)
+	spk := "subjKey"
+	privateSubjKey.KeyName = &spk
+	subjKey := InternalPublicFromPrivateKey(privateSubjKey)
+
+	issuerCert := makeTestCaCert(t, privateIssuerKey, "testIssuer")
+
+	// Without options the cert has no attestation extension.
+	plain := ProduceAdmissionCert("10.0.0.2", privateIssuerKey, issuerCert, subjKey, "testSubject", "testOrg",
+		uint64(6), 86400)
+	// An OID under the example PEN 32473 (RFC 5612).
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 32473, 1}
+	if plain == nil || GetAttestationInfo(plain, oid) != nil {
+		t.Fatal("Plain admission cert wrong")
+	}
+
+	u, _ := url.Parse("spiffe://example/enclave")
+	measurement := []byte{1, 2, 3, 4}
+	options := &AdmissionCertOptions{
+		Profile: &AdmissionCertProfile{
+			CommonName:  "01020304.enclaves.example",
+			DNSNames:    []string{"01020304.enclaves.example"},
+			URIs:        []*url.URL{u},
+			IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			IsCA:        true,
+			MaxPathLen:  0,
+		},
+		Attestation: MakeAttestationInfo(measurement, "amd-sev-snp",
+			map[string]string{"debug": "no", "api-major": "1"}),
+	}
+	if ProduceAdmissionCertWithOptions("10.0.0.2", privateIssuerKey, issuerCert, subjKey,
+		"testSubject", "testOrg", uint64(7), 86400, options) != nil {
+		t.Errorf("Produced attestation extension without an OID")
+	}
+	options.AttestationOid = oid
+	cert := ProduceAdmissionCertWithOptions("10.0.0.2", privateIssuerKey, issuerCert, subjKey,
+		"testSubject", "testOrg", uint64(7), 86400, options)
+	if cert == nil {
+		t.Fatal("Can't produce admission cert with profile")
+	}
+	if cert.Subject.CommonName != "01020304.enclaves.example" || len(cert.Subject.Organization) != 0 {
+		t.Errorf("Profile subject not used: %v", cert.Subject)
+	}
+	if len(cert.DNSNames) != 1 || len(cert.URIs) != 1 || cert.URIs[0].String() != u.String() {
+		t.Errorf("Profile SANs not used: %v %v", cert.DNSNames, cert.URIs)
+	}
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Remote IP used with profile: %v", cert.IPAddresses)
+	}
+	if cert.KeyUsage != x509.KeyUsageDigitalSignature || len(cert.ExtKeyUsage) != 1 ||
+		cert.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("Profile usages not used")
+	}
+	if !cert.IsCA || cert.MaxPathLen != 0 || !cert.MaxPathLenZero {
+		t.Errorf("Profile path constraints not used")
+	}
+	if !VerifyAdmissionCert(issuerCert, cert) {
+		t.Errorf("Cert with profile does not verify")
+	}
+
+	if GetAttestationInfo(cert, asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 32473, 2}) != nil {
+		t.Errorf("Attestation extension found with another OID")
+	}
+	info := GetAttestationInfo(cert, oid)
+	if info == nil {
+		t.Fatal("No attestation extension")
+	}
+	if !bytes.Equal(info.Measurement, measurement) || info.PlatformType != "amd-sev-snp" {
+		t.Errorf("Wrong attestation extension: %v", info)
+	}
+	if len(info.Properties) != 2 || info.Properties[0].Name != "api-major" ||
+		info.Properties[1].Value != "no" {
+		t.Errorf("Wrong attestation properties: %v", info.Properties)
+	}
+}
+
+func TestEccCertification(t *testing.T) {
+	fmt.Print("\nTestEccCertification\n")
+
+	privatePolicyKey := MakeVseEccKey(384)
+	tpk := "policyKey"
+	privatePolicyKey.KeyName = &tpk
+	policyKey := InternalPublicFromPrivateKey(privatePolicyKey)
+	if policyKey == nil || policyKey.GetKeyType() != "ecc-384-public" || policyKey.EccKey.PrivateMultiplier != nil {
+		t.Fatal("Bad ecc public policy key")
+	}
+	policySubj := MakeKeyEntity(policyKey)
+
+	privateAttestKey := MakeVseEccKey(384)
+	aek := "attestKey"
+	privateAttestKey.KeyName = &aek
+	attestKey := InternalPublicFromPrivateKey(privateAttestKey)
+	attestSubj := MakeKeyEntity(attestKey)
+
+	privateEnclaveKey := MakeVseEccKey(256)
+	tek := "enclaveKey"
+	privateEnclaveKey.KeyName = &tek
+	enclaveKey := InternalPublicFromPrivateKey(privateEnclaveKey)
+	enclaveSubj := MakeKeyEntity(enclaveKey)
+
+	m := make([]byte, 32)
+	for i := 0; i < 32; i++ {
+		m[i] = byte(i)
+	}
+	entObj := MakeMeasurementEntity(m)
+
+	verbIs := "is-trusted"
+	verbSays := "says"
+	verbSpeaksFor := "speaks-for"
+	verbIsTrustedForAuth := "is-trusted-for-authentication"
+	verbIsTrustedForAtt := "is-trusted-for-attestation"
+
+	attestKeyIsTrusted := MakeUnaryVseClause(attestSubj, &verbIsTrustedForAtt)
+	measurementIsTrusted := MakeUnaryVseClause(entObj, &verbIs)
+	enclaveKeyIsTrusted := MakeUnaryVseClause(enclaveSubj, &verbIsTrustedForAuth)
+	policyKeySaysAttestKeyIsTrusted := MakeIndirectVseClause(policySubj, &verbSays, attestKeyIsTrusted)
+	policyKeySaysMeasurementIsTrusted := MakeIndirectVseClause(policySubj, &verbSays, measurementIsTrusted)
+	enclaveKeySpeaksForMeasurement := MakeSimpleVseClause(enclaveSubj, &verbSpeaksFor, entObj)
+	attestKeySaysEnclaveKeySpeaksForMeasurement := MakeIndirectVseClause(attestSubj, &verbSays,
+		enclaveKeySpeaksForMeasurement)
+
+	tn := TimePointNow()
+	nb := TimePointToString(tn)
+	na := TimePointToString(TimePointPlus(tn, 365*86400))
+	vfmt := "vse-clause"
+	sign := func(cl *certprotos.VseClause, k *certprotos.KeyMessage) *certprotos.SignedClaimMessage {
+		ser, _ := proto.Marshal(cl)
+		sc := MakeSignedClaim(MakeClaim(ser, vfmt, "test", nb, na), k)
+		if sc == nil {
+			t.Fatal("MakeSignedClaim fails with ecc key")
+		}
+		return sc
+	}
+	sc1 := sign(policyKeySaysAttestKeyIsTrusted, privatePolicyKey)
+	sc2 := sign(policyKeySaysMeasurementIsTrusted, privatePolicyKey)
+	sc3 := sign(attestKeySaysEnclaveKeySpeaksForMeasurement, privateAttestKey)
+	if sc1.GetSigningAlgorithm() != "ecc-384-sha384-pkcs-sign" {
+		t.Errorf("Wrong signing algorithm %s", sc1.GetSigningAlgorithm())
+	}
+	if !VerifySignedClaim(sc1, policyKey) {
+		t.Errorf("Can't verify ecc signed claim")
+	}
+	if VerifySignedClaim(sc1, attestKey) {
+		t.Errorf("Ecc signed claim verifies with wrong key")
+	}
+	tampered := proto.Clone(sc1).(*certprotos.SignedClaimMessage)
+	tampered.SerializedClaimMessage = append([]byte(nil), sc2.SerializedClaimMessage...)
+	if VerifySignedClaim(tampered, policyKey) {
+		t.Errorf("Tampered ecc signed claim verifies")
+	}
+
+	// The signed policy
+	signedPolicy := &certprotos.SignedClaimSequence{Claims: []*certprotos.SignedClaimMessage{sc1, sc2}}
+	ps := certprotos.ProvedStatements{}
+	if !InitAxiom(*policyKey, &ps) || !InitPolicy(policyKey, signedPolicy, &ps) {
+		t.Fatal("Can't init ecc policy")
+	}
+	policy := proto.Clone(&ps).(*certprotos.ProvedStatements)
+	scStr := "signed-claim"
+	ser3, _ := proto.Marshal(sc3)
+	evidenceList := []*certprotos.Evidence{{EvidenceType: &scStr, SerializedEvidence: ser3}}
+	if err := InitProvedStatements(*policyKey, evidenceList, &ps); err != nil {
+		t.Fatal("Cannot init proved statements: ", err)
+	}
+
+	r1 := int32(1)
+	r3 := int32(3)
+	r5 := int32(5)
+	r6 := int32(6)
+	p := certprotos.Proof{}
+	p.Steps = append(p.Steps, &certprotos.ProofStep{S1: ps.Proved[0], S2: policyKeySaysMeasurementIsTrusted,
+		Conclusion: measurementIsTrusted, RuleApplied: &r3})
+	p.Steps = append(p.Steps, &certprotos.ProofStep{S1: ps.Proved[0], S2: policyKeySaysAttestKeyIsTrusted,
+		Conclusion: attestKeyIsTrusted, RuleApplied: &r5})
+	p.Steps = append(p.Steps, &certprotos.ProofStep{S1: attestKeyIsTrusted,
+		S2: attestKeySaysEnclaveKeySpeaksForMeasurement, Conclusion: enclaveKeySpeaksForMeasurement,
+		RuleApplied: &r6})
+	p.Steps = append(p.Steps, &certprotos.ProofStep{S1: measurementIsTrusted, S2: enclaveKeySpeaksForMeasurement,
+		Conclusion: enclaveKeyIsTrusted, RuleApplied: &r1})
+	if err := VerifyProof(policyKey, enclaveKeyIsTrusted, &p, &ps); err != nil {
+		t.Errorf("Cannot prove statement with ecc keys: %s", err)
+	}
+
+	// A step applying the wrong rule is reported with its position.
+	badProof := proto.Clone(&p).(*certprotos.Proof)
+	badProof.Steps[2].RuleApplied = &r5
+	err := VerifyProof(policyKey, enclaveKeyIsTrusted, badProof, &ps)
+	ve, ok := err.(*ValidationError)
+	if !ok || ve.Stage != StageProofStep || ve.Step != 2 || ve.Rule != 5 ||
+		!SameVseClause(ve.Statement, enclaveKeySpeaksForMeasurement) {
+		t.Errorf("Wrong error for bad proof step: %v", err)
+	}
+	if ReasonCode(err) != "proof-step" {
+		t.Errorf("Wrong reason code %q", ReasonCode(err))
+	}
+
+	// The result has the measurement and the policy statements the proof used.
+	evp := &certprotos.EvidencePackage{FactAssertion: evidenceList}
+	result, err := ValidateEvidenceWithVerifier(&proofVerifier{enclaveKeyIsTrusted, &p}, policyKey, evp,
+		policy, "authentication")
+	if err != nil {
+		t.Fatal("Can't validate ecc evidence: ", err)
+	}
+	PrintValidationResult(result)
+	if !bytes.Equal(result.Measurement, m) || !SameKey(result.EnclaveKey(), enclaveKey) ||
+		!SameVseClause(result.Statement, enclaveKeyIsTrusted) || result.Platform != nil ||
+		len(result.Concluded) != 4 || result.Proof != &p {
+		t.Errorf("Wrong validation result")
+	}
+	if len(result.PolicyStatements) != 2 ||
+		!SameVseClause(result.PolicyStatements[0], policyKeySaysMeasurementIsTrusted) ||
+		!SameVseClause(result.PolicyStatements[1], policyKeySaysAttestKeyIsTrusted) {
+		t.Errorf("Wrong policy statements in result")
+	}
+
+	// A pem-cert-chain no oe-attestation-report verified with isn't in
+	// the result.
+	chainCert := makeTestCaCert(t, privatePolicyKey, "platformChain")
+	chainStr := "pem-cert-chain"
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chainCert.Raw})
+	chainEvp := &certprotos.EvidencePackage{FactAssertion: append([]*certprotos.Evidence{
+		{EvidenceType: &chainStr, SerializedEvidence: chain}}, evidenceList...)}
+	result, err = ValidateEvidenceWithVerifier(&proofVerifier{enclaveKeyIsTrusted, &p}, policyKey, chainEvp,
+		policy, "authentication")
+	if err != nil || len(result.CertChain) != 0 {
+		t.Errorf("Unverified cert chain in result: %v", err)
+	}
+
+	// Without the step concluding the measurement is trusted, there is no result.
+	noMeasurement := proto.Clone(&p).(*certprotos.Proof)
+	noMeasurement.Steps = noMeasurement.Steps[1:]
+	_, err = ValidateEvidenceWithVerifier(&proofVerifier{enclaveKeyIsTrusted, noMeasurement}, policyKey, evp,
+		policy, "authentication")
+	if err == nil {
+		t.Errorf("Validated a proof without a trusted measurement")
+	}
+
+	// Platform rule signed by the ecc policy key
+	rule := ProducePlatformRule(privatePolicyKey, nil, attestKey, 86400)
+	if rule == nil {
+		t.Fatal("Can't produce platform rule with ecc policy key")
+	}
+	signedRule := &certprotos.SignedClaimMessage{}
+	if proto.Unmarshal(rule, signedRule) != nil || !VerifySignedClaim(signedRule, policyKey) {
+		t.Errorf("Can't verify platform rule")
+	}
+
+	// Admission cert for an ecc enclave key, issued by an ecc policy cert
+	policyCert := makeTestCaCert(t, privatePolicyKey, "policyKey")
+	parentDerCert := policyCert.Raw
+
+	// Verified certs are kept for the result.
+	certStr := "cert"
+	st, err := initProvedStatements(policyKey,
+		[]*certprotos.Evidence{{EvidenceType: &certStr, SerializedEvidence: parentDerCert}},
+		&certprotos.ProvedStatements{})
+	if err != nil || len(st.Certs) != 1 || !bytes.Equal(st.Certs[0].Raw, parentDerCert) {
+		t.Errorf("Verified cert not returned: %v", err)
+	}
+
+	cert := ProduceAdmissionCert("10.0.0.1", privatePolicyKey, policyCert, enclaveKey,
+		"CertifierUsers", "Measured-00", uint64(9), 86400)
+	if cert == nil {
+		t.Fatal("Can't produce admission cert with ecc keys")
+	}
+	if cert.SignatureAlgorithm != x509.ECDSAWithSHA384 {
+		t.Errorf("Wrong cert signature algorithm %v", cert.SignatureAlgorithm)
+	}
+	if !VerifyAdmissionCert(policyCert, cert) {
+		t.Errorf("Can't verify ecc admission cert")
+	}
+	subjKey := GetSubjectKey(cert)
+	if subjKey == nil || !SameKey(subjKey, enclaveKey) {
+		t.Errorf("Admission cert has wrong subject key")
+	}
+
+	revoked := []pkix.RevokedCertificate{{SerialNumber: big.NewInt(9), RevocationTime: time.Now()}}
+	crl := ProduceCrl(privatePolicyKey, policyCert, revoked, big.NewInt(1), 86400)
+	if crl == nil {
+		t.Fatal("Can't produce CRL with ecc policy key")
+	}
+	if VerifyAdmissionCertWithOptions(policyCert, cert, &AdmissionCertVerifyOptions{Crl: crl}) {
+		t.Errorf("Revoked ecc cert verifies")
+	}
+}
+
+func TestSigningAlgorithms(t *testing.T) {
+	rsa3072 := MakeVseRsaKey(3072)
+	if rsa3072 == nil || rsa3072.GetKeyType() != "rsa-3072-private" {
+		t.Fatal("Can't make rsa-3072 key")
+	}
+	if InternalPublicFromPrivateKey(rsa3072).GetKeyType() != "rsa-3072-public" {
+		t.Errorf("Wrong rsa-3072 public key type")
+	}
+	keys := map[string]*certprotos.KeyMessage{
+		"rsa-2048": MakeVseRsaKey(2048),
+		"rsa-3072": rsa3072,
+		"rsa-4096": MakeVseRsaKey(4096),
+		"ecc-256":  MakeVseEccKey(256),
+		"ecc-384":  MakeVseEccKey(384),
+	}
+	tests := []struct {
+		key string
+		alg string
+	}{
+		{"rsa-2048", "rsa-2048-sha256-pkcs-sign"},
+		{"rsa-2048", "rsa-2048-sha256-pss-sign"},
+		{"rsa-3072", "rsa-3072-sha384-pkcs-sign"},
+		{"rsa-3072", "rsa-3072-sha384-pss-sign"},
+		{"rsa-4096", "rsa-4096-sha384-pkcs-sign"},
+		{"rsa-4096", "rsa-4096-sha384-pss-sign"},
+		{"ecc-256", "ecc-256-sha256-pkcs-sign"},
+		{"ecc-384", "ecc-384-sha384-pkcs-sign"},
+	}
+
+	m := MakeMeasurementEntity([]byte{1, 2, 3})
+	verbIs := "is-trusted"
+	ser, _ := proto.Marshal(MakeUnaryVseClause(m, &verbIs))
+	tn := TimePointNow()
+	cl := MakeClaim(ser, "vse-clause", "test", TimePointToString(tn), TimePointToString(TimePointPlus(tn, 86400)))
+	for _, tc := range tests {
+		k := keys[tc.key]
+		pk := InternalPublicFromPrivateKey(k)
+		sc := MakeSignedClaimWithAlgorithm(cl, k, tc.alg)
+		if sc == nil {
+			t.Errorf("%s: can't sign", tc.alg)
+			continue
+		}
+		if !VerifySignedClaim(sc, pk) {
+			t.Errorf("%s: signed claim doesn't verify", tc.alg)
+		}
+		// The algorithm named in the claim is the one checked.
+		other := tc.alg[:len(tc.alg)-len("pkcs-sign")] + "pss-sign"
+		if strings.HasSuffix(tc.alg, "pss-sign") {
+			other = tc.alg[:len(tc.alg)-len("pss-sign")] + "pkcs-sign"
+		}
+		relabeled := proto.Clone(sc).(*certprotos.SignedClaimMessage)
+		relabeled.SigningAlgorithm = &other
+		if VerifySignedClaim(relabeled, pk) {
+			t.Errorf("%s: claim verifies as %s", tc.alg, other)
+		}
+		relabeled.SigningAlgorithm = nil
+		if VerifySignedClaim(relabeled, pk) {
+			t.Errorf("%s: claim without algorithm verifies", tc.alg)
+		}
+	}
+	if MakeSignedClaimWithAlgorithm(cl, keys["rsa-2048"], "rsa-4096-sha384-pkcs-sign") != nil {
+		t.Errorf("Signed with algorithm for another key size")
+	}
+	if MakeSignedClaimWithAlgorithm(cl, keys["ecc-256"], "ecc-384-sha384-pkcs-sign") != nil {
+		t.Errorf("Signed with algorithm for another curve")
+	}
+
+	if KeyStrength(keys["rsa-2048"]) != 112 || KeyStrength(InternalPublicFromPrivateKey(rsa3072)) != 128 ||
+		KeyStrength(keys["ecc-384"]) != 192 || KeyStrength(&certprotos.KeyMessage{}) != 0 {
+		t.Errorf("Wrong key strength")
+	}
+
+	// A weak key labelled as a strong one is neither.
+	weak := MakeVseRsaKey(1024)
+	weakType := "rsa-4096-private"
+	weak.KeyType = &weakType
+	weakPublic := InternalPublicFromPrivateKey(weak)
+	if KeyStrength(weak) != 0 || KeyStrength(weakPublic) != 0 {
+		t.Errorf("Relabelled rsa key has strength %d", KeyStrength(weakPublic))
+	}
+	if MakeSignedClaimWithAlgorithm(cl, weak, "rsa-4096-sha384-pkcs-sign") != nil {
+		t.Errorf("Relabelled rsa key signs as rsa-4096")
+	}
+	sc := MakeSignedClaimWithAlgorithm(cl, keys["rsa-2048"], "rsa-2048-sha256-pkcs-sign")
+	relabelledPublic := InternalPublicFromPrivateKey(keys["rsa-2048"])
+	relabelledType := "rsa-4096-public"
+	relabelledPublic.KeyType = &relabelledType
+	if VerifyWithKey("rsa-4096-sha384-pkcs-sign", relabelledPublic, sc.SerializedClaimMessage, sc.Signature) ||
+		VerifyWithKey("rsa-2048-sha256-pkcs-sign", relabelledPublic, sc.SerializedClaimMessage, sc.Signature) {
+		t.Errorf("Relabelled rsa key verifies")
+	}
+	weakEcc := InternalPublicFromPrivateKey(keys["ecc-256"])
+	eccType := "ecc-384-public"
+	weakEcc.KeyType = &eccType
+	if KeyStrength(weakEcc) != 0 || SigningAlgorithmSuitsKey("ecc-384-sha384-pkcs-sign", weakEcc) {
+		t.Errorf("Relabelled ecc key accepted as ecc-384")
+	}
+}
+
+func TestEd25519Keys(t *testing.T) {
+	privateKey := MakeVseEd25519Key()
+	if privateKey == nil || privateKey.GetKeyType() != "ed25519-private" {
+		t.Fatal("Can't make ed25519 key")
+	}
+	publicKey := InternalPublicFromPrivateKey(privateKey)
+	if publicKey == nil || publicKey.GetKeyType() != "ed25519-public" ||
+		publicKey.Ed25519Key.PrivateKey != nil {
+		t.Fatal("Bad ed25519 public key")
+	}
+	if !SameKey(publicKey, InternalPublicFromPrivateKey(privateKey)) ||
+		SameKey(publicKey, InternalPublicFromPrivateKey(MakeVseEd25519Key())) {
+		t.Errorf("SameKey is wrong for ed25519 keys")
+	}
+	pK, PK, err := GetEd25519KeysFromInternal(privateKey)
+	if err != nil || pK == nil || !bytes.Equal(PK, publicKey.Ed25519Key.PublicKey) {
+		t.Fatal("GetEd25519KeysFromInternal failed")
+	}
+	if _, _, err := GetEd25519KeysFromInternal(publicKey); err != nil {
+		t.Errorf("GetEd25519KeysFromInternal fails for public key")
+	}
+	mismatched := proto.Clone(privateKey).(*certprotos.KeyMessage)
+	mismatched.Ed25519Key.PublicKey = MakeVseEd25519Key().Ed25519Key.PublicKey
+	if _, _, err := GetEd25519KeysFromInternal(mismatched); err == nil {
+		t.Errorf("Accepted ed25519 private key that doesn't match its public key")
+	}
+	if KeyStrength(publicKey) != 128 {
+		t.Errorf("Wrong ed25519 key strength")
+	}
+
+	// Signed claims
+	m := MakeMeasurementEntity([]byte{1, 2, 3})
+	verbIs := "is-trusted"
+	ser, _ := proto.Marshal(MakeUnaryVseClause(m, &verbIs))
+	tn := TimePointNow()
+	cl := MakeClaim(ser, "vse-clause", "test", TimePointToString(tn), TimePointToString(TimePointPlus(tn, 86400)))
+	sc := MakeSignedClaim(cl, privateKey)
+	if sc == nil || sc.GetSigningAlgorithm() != "ed25519-sign" {
+		t.Fatal("Can't sign claim with ed25519 key")
+	}
+	if !ed25519.Verify(PK, sc.SerializedClaimMessage, sc.Signature) {
+		t.Errorf("Claim signature isn't plain ed25519")
+	}
+	if !VerifySignedClaim(sc, publicKey) {
+		t.Errorf("Can't verify ed25519 signed claim")
+	}
+	if VerifySignedClaim(sc, InternalPublicFromPrivateKey(MakeVseEd25519Key())) {
+		t.Errorf("Ed25519 signed claim verifies with wrong key")
+	}
+	relabeled := proto.Clone(sc).(*certprotos.SignedClaimMessage)
+	alg := "ecc-256-sha256-pkcs-sign"
+	relabeled.SigningAlgorithm = &alg
+	if VerifySignedClaim(relabeled, publicKey) {
+		t.Errorf("Ed25519 claim verifies as %s", alg)
+	}
+	if MakeSignedClaimWithAlgorithm(cl, MakeVseEccKey(256), "ed25519-sign") != nil {
+		t.Errorf("Signed with ed25519-sign using an ecc key")
+	}
+
+	// Admission certs for an ed25519 enclave key, issued by an rsa policy
+	// key and by an ed25519 policy key.
+	for _, policyType := range []string{"rsa-2048", "ed25519"} {
+		privatePolicyKey := MakeVseRsaKey(2048)
+		if policyType == "ed25519" {
+			privatePolicyKey = MakeVseEd25519Key()
+		}
+		policyCert := makeTestCaCert(t, privatePolicyKey, "policyKey")
+
+		cert := ProduceAdmissionCert("10.0.0.1", privatePolicyKey, policyCert, publicKey,
+			"CertifierUsers", "Measured-00", uint64(9), 86400)
+		if cert == nil {
+			t.Fatalf("Can't produce admission cert for ed25519 key with %s policy key", policyType)
+		}
+		if cert.PublicKeyAlgorithm != x509.Ed25519 {
+			t.Errorf("Wrong cert public key algorithm %v", cert.PublicKeyAlgorithm)
+		}
+		if !VerifyAdmissionCert(policyCert, cert) {
+			t.Errorf("Can't verify admission cert with %s policy key", policyType)
+		}
+		subjKey := GetSubjectKey(cert)
+		if subjKey == nil || !SameKey(subjKey, publicKey) {
+			t.Errorf("Admission cert has wrong subject key")
+		}
+	}
+}
+
+func TestEnclaves(t *testing.T) {
+	if !InitSimulatedEnclave() {
+		t.Fatal("Can't init simulated enclave")
+	}
+	sealed := Seal("simulated-enclave", "enclave-1", []byte("secret"))
+	if sealed == nil || string(Unseal("simulated-enclave", "enclave-1", sealed)) != "secret" {
+		t.Errorf("Simulated enclave doesn't unseal what it sealed")
+	}
+	sim, err := GetEnclave("simulated-enclave")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := sim.Unseal("enclave-1", sealed); err == nil {
+		t.Errorf("Damaged sealed data unseals")
+	}
+	if _, err := sim.Unseal("enclave-1", []byte{1}); err == nil {
+		t.Errorf("Short sealed data unseals")
+	}
+	if Attest("simulated-enclave", []byte("said")) == nil {
+		t.Errorf("Simulated enclave doesn't attest")
+	}
+	if _, err := GetEnclave("no-such-enclave"); err == nil || Attest("no-such-enclave", nil) != nil {
+		t.Errorf("Unregistered enclave type found")
+	}
+	if RegisterEnclave("simulated-enclave", &FakeEnclave{}) == nil {
+		t.Errorf("Enclave type registered twice")
+	}
+
+	// The test double, through the same functions.
+	fake := &FakeEnclave{Measurement: []byte{1, 2, 3}}
+	if err := RegisterEnclave("fake-test-enclave", fake); err != nil {
+		fake = FindEnclave("fake-test-enclave").(*FakeEnclave)
+	}
+	if !bytes.Equal(GetMeasurement("fake-test-enclave", ""), []byte{1, 2, 3}) {
+		t.Errorf("Wrong fake measurement")
+	}
+	if !bytes.Equal(Attest("fake-test-enclave", []byte("said")), []byte("said")) ||
+		len(fake.Said()) == 0 {
+		t.Errorf("Fake enclave doesn't attest")
+	}
+	other := &FakeEnclave{Measurement: []byte{4, 5, 6}}
+	fakeSealed, _ := fake.Seal("", []byte("secret"))
+	if _, err := other.Unseal("", fakeSealed); err == nil {
+		t.Errorf("Fake enclave unseals data sealed with another measurement")
+	}
+	fake.Err = errors.New("device gone")
+	if _, err := fake.Attest(nil); err != fake.Err {
+		t.Errorf("Fake enclave error not returned")
+	}
+	fake.Err = nil
+}
+
+func TestSimulatedSevEnclave(t *testing.T) {
+	dir := t.TempDir()
+	vcek, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(vcek)
+	keyFile := filepath.Join(dir, "ec-secp384r1-priv-key.pem")
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	measurement := make([]byte, 48)
+	for i := range measurement {
+		measurement[i] = byte(i)
+	}
+	measurementFile := filepath.Join(dir, "measurement")
+	os.WriteFile(measurementFile, measurement, 0600)
+
+	e, err := NewSimulatedSevEnclave(keyFile, measurementFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSimulatedSevEnclave(keyFile, keyFile); err == nil {
+		t.Errorf("Accepted a measurement of the wrong size")
+	}
+	if _, err := NewSimulatedSevEnclave(filepath.Join(dir, "missing"), measurementFile); err == nil {
+		t.Errorf("Accepted a missing key file")
+	}
+
+	att, err := e.Attest([]byte("said"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := VerifySevAttestation(att, e.VcekKey()); !bytes.Equal(m, measurement) {
+		t.Errorf("Simulated sev attestation doesn't verify")
+	}
+	otherKey := MakeVseEccKey(384)
+	if VerifySevAttestation(att, InternalPublicFromPrivateKey(otherKey)) != nil {
+		t.Errorf("Simulated sev attestation verifies with another key")
+	}
+
+	sealed, err := e.Seal("", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsealed, err := e.Unseal("", sealed)
+	if err != nil || string(unsealed) != "secret" {
+		t.Errorf("Simulated sev enclave doesn't unseal what it sealed")
+	}
+	measurement[0] ^= 1
+	other, err := MakeSimulatedSevEnclave(vcek, measurement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Unseal("", sealed); err == nil {
+		t.Errorf("Unsealed with another measurement")
+	}
+}
+
+func TestSimulatedSealing(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "simulated_enclave_state.bin")
+	if err := InitSimulatedEnclaveFromFile(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	attestKey := publicAttestKey
+
+	SetSimulatedMeasurement("app-a", []byte("measurement a"))
+	SetSimulatedMeasurement("app-a-copy", []byte("measurement a"))
+	SetSimulatedMeasurement("app-b", []byte("measurement b"))
+	if !bytes.Equal(GetMeasurement("simulated-enclave", "app-b"), []byte("measurement b")) ||
+		!bytes.Equal(GetMeasurement("simulated-enclave", "unset"), DefaultSimulatedMeasurement) {
+		t.Errorf("Wrong simulated measurements")
+	}
+
+	sealed := Seal("simulated-enclave", "app-a", []byte("secret"))
+	if sealed == nil {
+		t.Fatal("Can't seal")
+	}
+	if bytes.Equal(sealed, Seal("simulated-enclave", "app-a", []byte("secret"))) {
+		t.Errorf("Sealing twice gives the same output")
+	}
+	if string(Unseal("simulated-enclave", "app-a-copy", sealed)) != "secret" {
+		t.Errorf("Enclave with the same measurement can't unseal")
+	}
+	if Unseal("simulated-enclave", "app-b", sealed) != nil {
+		t.Errorf("Enclave with another measurement unseals")
+	}
+
+	// A restart with the same state file keeps the secret and attest key.
+	if !InitSimulatedEnclave() || Unseal("simulated-enclave", "app-a", sealed) != nil {
+		t.Errorf("Unsealed with a new root secret")
+	}
+	if err := InitSimulatedEnclaveFromFile(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if string(Unseal("simulated-enclave", "app-a", sealed)) != "secret" {
+		t.Errorf("Can't unseal after restart")
+	}
+	if !SameKey(attestKey, publicAttestKey) {
+		t.Errorf("Attest key changed after restart")
+	}
+
+	os.WriteFile(stateFile, []byte("bad state"), 0600)
+	if InitSimulatedEnclaveFromFile(stateFile) == nil {
+		t.Errorf("Accepted a bad state file")
+	}
+}
+
+func TestSizedSocket(t *testing.T) {
+	// Messages of 16MB or more keep all four bytes of their size.
+	msg := make([]byte, MaxSizedSocketMessage+1)
+	msg[len(msg)-1] = 1
+	c1, c2 := net.Pipe()
+	go SizedSocketWrite(c1, msg)
+	if got := SizedSocketReadMax(c2, 2*MaxSizedSocketMessage); !bytes.Equal(got, msg) {
+		t.Errorf("Message of %d bytes read as %d bytes", len(msg), len(got))
+	}
+	c1.Close()
+	c2.Close()
+
+	// SizedSocketRead refuses it.
+	c1, c2 = net.Pipe()
+	go SizedSocketWrite(c1, msg)
+	if SizedSocketRead(c2) != nil {
+		t.Errorf("Read message over the limit")
+	}
+	c1.Close()
+	c2.Close()
+}
@@ -0,0 +1,610 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certlib
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+	"google.golang.org/protobuf/proto"
+)
+
+// An Enclave is the platform a Go application runs on.  GetMeasurement,
+// Seal, Unseal and Attest use the Enclave registered for the enclave type
+// they are given, e.g. "simulated-enclave", so an application runs the same
+// code whatever the platform.  The simulated enclave registers itself
+// below; others are registered with RegisterEnclave.
+type Enclave interface {
+	// GetMeasurement returns the measurement of the enclave with id.
+	GetMeasurement(id string) ([]byte, error)
+
+	// Seal encrypts and integrity protects toSeal so that only this
+	// enclave can unseal it.
+	Seal(id string, toSeal []byte) ([]byte, error)
+
+	// Unseal returns what Seal sealed.
+	Unseal(id string, toUnseal []byte) ([]byte, error)
+
+	// Attest returns the platform's attestation that the enclave said
+	// toSay, normally a serialized attestation_user_data.
+	Attest(toSay []byte) ([]byte, error)
+}
+
+var enclaveLock sync.RWMutex
+var enclaves = map[string]Enclave{}
+
+// RegisterEnclave adds the Enclave for an enclave type.
+func RegisterEnclave(enclaveType string, e Enclave) error {
+	if enclaveType == "" || e == nil {
+		return errors.New("RegisterEnclave: empty enclave type or enclave")
+	}
+	enclaveLock.Lock()
+	defer enclaveLock.Unlock()
+	if _, ok := enclaves[enclaveType]; ok {
+		return fmt.Errorf("RegisterEnclave: %s already registered", enclaveType)
+	}
+	enclaves[enclaveType] = e
+	return nil
+}
+
+// FindEnclave returns nil if enclaveType is not registered.
+func FindEnclave(enclaveType string) Enclave {
+	enclaveLock.RLock()
+	defer enclaveLock.RUnlock()
+	return enclaves[enclaveType]
+}
+
+// RegisteredEnclaves returns the registered enclave types, sorted.
+func RegisteredEnclaves() []string {
+	enclaveLock.RLock()
+	defer enclaveLock.RUnlock()
+	var types []string
+	for t := range enclaves {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// GetEnclave returns the Enclave for enclaveType, or an error saying it
+// isn't registered.
+func GetEnclave(enclaveType string) (Enclave, error) {
+	e := FindEnclave(enclaveType)
+	if e == nil {
+		return nil, fmt.Errorf("no enclave registered for %q", enclaveType)
+	}
+	return e, nil
+}
+
+func init() {
+	RegisterEnclave("simulated-enclave", simulatedEnclave{})
+}
+
+// GetMeasurement, Seal, Unseal and Attest print why they failed and return
+// nil.  Call the Enclave from GetEnclave to get the error instead.
+
+func GetMeasurement(eType string, id string) []byte {
+	e, err := GetEnclave(eType)
+	if err == nil {
+		var m []byte
+		if m, err = e.GetMeasurement(id); err == nil {
+			return m
+		}
+	}
+	fmt.Printf("GetMeasurement: %s\n", err.Error())
+	return nil
+}
+
+func Seal(eType string, eId string, toSeal []byte) []byte {
+	e, err := GetEnclave(eType)
+	if err == nil {
+		var sealed []byte
+		if sealed, err = e.Seal(eId, toSeal); err == nil {
+			return sealed
+		}
+	}
+	fmt.Printf("Seal: %s\n", err.Error())
+	return nil
+}
+
+func Unseal(eType string, eId string, toUnseal []byte) []byte {
+	e, err := GetEnclave(eType)
+	if err == nil {
+		var unsealed []byte
+		if unsealed, err = e.Unseal(eId, toUnseal); err == nil {
+			return unsealed
+		}
+	}
+	fmt.Printf("Unseal: %s\n", err.Error())
+	return nil
+}
+
+func Attest(eType string, toSay []byte) []byte {
+	e, err := GetEnclave(eType)
+	if err == nil {
+		var attestation []byte
+		if attestation, err = e.Attest(toSay); err == nil {
+			return attestation
+		}
+	}
+	fmt.Printf("Attest: %s\n", err.Error())
+	return nil
+}
+
+// sealedSize is the smallest output of AuthenticatedEncrypt: an iv, one
+// block and the mac.
+const sealedSize = 16 + 16 + 32
+
+// errDamagedSeal is returned by Unseal when the mac doesn't check.
+var errDamagedSeal = errors.New("sealed data is damaged or was sealed by another enclave")
+
+// deriveSealingKey returns the 64 byte aes and hmac key for sealing by
+// enclaves with measurement, from secret.  It is HMAC-SHA256 in counter
+// mode (NIST SP 800-108) with label and the measurement as the context:
+// each block is the mac of a 1 byte counter, label, a 0 byte, measurement
+// and the output length in bits as 4 big-endian bytes.
+func deriveSealingKey(secret []byte, label string, measurement []byte) []byte {
+	const keySize = 64
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], keySize*8)
+	var key []byte
+	for i := byte(1); len(key) < keySize; i++ {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte{i})
+		mac.Write([]byte(label))
+		mac.Write([]byte{0})
+		mac.Write(measurement)
+		mac.Write(l[:])
+		key = mac.Sum(key)
+	}
+	return key[:keySize]
+}
+
+// sealWithKey seals toSeal under key with a random iv.
+func sealWithKey(key []byte, toSeal []byte) ([]byte, error) {
+	iv := make([]byte, 16)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, fmt.Errorf("can't make iv: %w", err)
+	}
+	return AuthenticatedEncrypt(toSeal, key, iv), nil
+}
+
+func unsealWithKey(key []byte, toUnseal []byte) ([]byte, error) {
+	if len(toUnseal) < sealedSize {
+		return nil, fmt.Errorf("sealed data is too short (%d bytes)", len(toUnseal))
+	}
+	out := AuthenticatedDecrypt(toUnseal, key)
+	if out == nil {
+		return nil, errDamagedSeal
+	}
+	return out, nil
+}
+
+//  --------------------------------------------------------------------
+
+//  Simulated enclave
+//  --------------------------------------------------------------------
+
+// The simulated enclave seals with keys derived from a root secret and the
+// measurement of the enclave identity doing the sealing, so, as in a real
+// TEE, only enclaves with the same measurement can unseal.  The root
+// secret and the attest key are kept in a state file if
+// InitSimulatedEnclaveFromFile is used, and last only as long as the
+// process otherwise.
+
+// simulatedLock guards the simulated enclave state below.
+var simulatedLock sync.Mutex
+var privateAttestKey *certprotos.KeyMessage = nil
+var publicAttestKey *certprotos.KeyMessage = nil
+var simulatedRootSecret []byte
+var simulatedInitialized bool = false
+var simulatedMeasurements = map[string][]byte{}
+
+// SimulatedRootSecretSize is the size of the simulated enclave's root secret.
+const SimulatedRootSecretSize = 32
+
+// DefaultSimulatedMeasurement is the measurement of enclave identities
+// without one set by SetSimulatedMeasurement.
+var DefaultSimulatedMeasurement = []byte{
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+	16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+}
+
+func InitSimulatedEnclave() bool {
+	return InitSimulatedEnclaveWithKeySize(2048)
+}
+
+// InitSimulatedEnclaveWithKeySize makes an RSA attest key of n bits, 2048,
+// 3072 or 4096, and a random root secret for the simulated enclave.
+func InitSimulatedEnclaveWithKeySize(n int) bool {
+	attestKey := MakeVseRsaKey(n)
+	if attestKey == nil {
+		return false
+	}
+	rootSecret := make([]byte, SimulatedRootSecretSize)
+	if _, err := rand.Read(rootSecret); err != nil {
+		return false
+	}
+	return setSimulatedState(rootSecret, attestKey) == nil
+}
+
+// InitSimulatedEnclaveFromFile loads the simulated enclave's root secret
+// and attest key from stateFile, a serialized simulated_enclave_state, so
+// data sealed and keys certified before a restart stay usable.  If the
+// file doesn't exist, it is made with a new secret and a 2048 bit attest
+// key.
+func InitSimulatedEnclaveFromFile(stateFile string) error {
+	b, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		if !InitSimulatedEnclave() {
+			return errors.New("can't make simulated enclave keys")
+		}
+		rootSecret, attestKey, _, _ := simulatedState()
+		state := &certprotos.SimulatedEnclaveState{
+			RootSecret: rootSecret,
+			AttestKey:  attestKey,
+		}
+		if b, err = proto.Marshal(state); err != nil {
+			return fmt.Errorf("can't serialize simulated enclave state: %w", err)
+		}
+		if err = os.WriteFile(stateFile, b, 0600); err != nil {
+			return fmt.Errorf("can't save simulated enclave state: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read simulated enclave state: %w", err)
+	}
+	state := &certprotos.SimulatedEnclaveState{}
+	if err := proto.Unmarshal(b, state); err != nil {
+		return fmt.Errorf("%s: can't parse simulated enclave state: %w", stateFile, err)
+	}
+	return setSimulatedState(state.RootSecret, state.AttestKey)
+}
+
+func setSimulatedState(rootSecret []byte, attestKey *certprotos.KeyMessage) error {
+	if len(rootSecret) != SimulatedRootSecretSize {
+		return fmt.Errorf("root secret is %d bytes, not %d", len(rootSecret), SimulatedRootSecretSize)
+	}
+	publicKey := InternalPublicFromPrivateKey(attestKey)
+	if publicKey == nil || GetSignerFromInternal(attestKey) == nil {
+		return errors.New("bad attest key")
+	}
+	var tk string = "simulatedAttestKey"
+	attestKey.KeyName = &tk
+	publicKey.KeyName = &tk
+	simulatedLock.Lock()
+	defer simulatedLock.Unlock()
+	privateAttestKey = attestKey
+	publicAttestKey = publicKey
+	simulatedRootSecret = rootSecret
+	simulatedInitialized = true
+	return nil
+}
+
+// SetSimulatedMeasurement sets the measurement of the simulated enclave
+// identity id.  Enclaves can unseal only what was sealed by identities
+// with the same measurement.
+func SetSimulatedMeasurement(id string, measurement []byte) {
+	simulatedLock.Lock()
+	defer simulatedLock.Unlock()
+	simulatedMeasurements[id] = append([]byte(nil), measurement...)
+}
+
+func simulatedMeasurement(id string) []byte {
+	simulatedLock.Lock()
+	defer simulatedLock.Unlock()
+	if m, ok := simulatedMeasurements[id]; ok {
+		return m
+	}
+	return DefaultSimulatedMeasurement
+}
+
+// simulatedState returns the root secret and the private and public attest
+// keys, and false if the simulated enclave isn't initialized.
+func simulatedState() ([]byte, *certprotos.KeyMessage, *certprotos.KeyMessage, bool) {
+	simulatedLock.Lock()
+	defer simulatedLock.Unlock()
+	return simulatedRootSecret, privateAttestKey, publicAttestKey, simulatedInitialized
+}
+
+// simulatedSealingKey returns the sealing key for id, or nil if the
+// simulated enclave isn't initialized.
+func simulatedSealingKey(id string) []byte {
+	rootSecret, _, _, ok := simulatedState()
+	if !ok {
+		return nil
+	}
+	return deriveSealingKey(rootSecret, "simulated-enclave-sealing-key", simulatedMeasurement(id))
+}
+
+// simulatedEnclave is the "simulated-enclave" Enclave.  It needs
+// InitSimulatedEnclave or InitSimulatedEnclaveFromFile.
+type simulatedEnclave struct{}
+
+var errSimulatedNotInitialized = errors.New("simulated enclave not initialized, call InitSimulatedEnclave")
+
+func (simulatedEnclave) GetMeasurement(id string) ([]byte, error) {
+	return append([]byte(nil), simulatedMeasurement(id)...), nil
+}
+
+func (simulatedEnclave) Seal(id string, toSeal []byte) ([]byte, error) {
+	key := simulatedSealingKey(id)
+	if key == nil {
+		return nil, errSimulatedNotInitialized
+	}
+	return sealWithKey(key, toSeal)
+}
+
+func (simulatedEnclave) Unseal(id string, toUnseal []byte) ([]byte, error) {
+	key := simulatedSealingKey(id)
+	if key == nil {
+		return nil, errSimulatedNotInitialized
+	}
+	return unsealWithKey(key, toUnseal)
+}
+
+func (simulatedEnclave) Attest(toSay []byte) ([]byte, error) {
+	_, privateKey, publicKey, ok := simulatedState()
+	if !ok {
+		return nil, errSimulatedNotInitialized
+	}
+	// toSay is a serilized attestation, turn it into a signed claim
+	tn := TimePointNow()
+	tf := TimePointPlus(tn, 365*86400)
+	nb := TimePointToString(tn)
+	na := TimePointToString(tf)
+	cl1 := MakeClaim(toSay, "vse-attestation", "attestation", nb, na)
+	serCl, err := proto.Marshal(cl1)
+	if err != nil {
+		return nil, fmt.Errorf("can't serialize claim: %w", err)
+	}
+	sc := certprotos.SignedClaimMessage{}
+	sc.SerializedClaimMessage = serCl
+	sc.SigningKey = publicKey
+	ss := SigningAlgorithmForKey(privateKey)
+	sc.SigningAlgorithm = &ss
+	sig := SignWithKey(ss, privateKey, toSay)
+	if sig == nil {
+		return nil, errors.New("can't sign with the attest key")
+	}
+	sc.Signature = sig
+	serSignedClaim, err := proto.Marshal(&sc)
+	if err != nil {
+		return nil, fmt.Errorf("can't serialize signed claim: %w", err)
+	}
+	return serSignedClaim, nil
+}
+
+//  --------------------------------------------------------------------
+
+//  Simulated SEV-SNP enclave
+//  --------------------------------------------------------------------
+
+// Offsets in an SEV-SNP attestation report.
+const (
+	sevReportPolicy      = 0x08
+	sevReportSigAlgo     = 0x34
+	sevReportData        = 0x50
+	sevReportMeasurement = 0x90
+	sevReportSignature   = 0x2a0
+	sevReportSize        = 0x4a0
+)
+
+// SevMeasurementSize is the size of an SEV-SNP measurement.
+const SevMeasurementSize = 48
+
+// SimulatedSevEnclave attests like an SEV-SNP guest, with the simulated
+// VCEK made by the SEV-SNP simulator's "make keys" standing in for the
+// platform key.  Its reports are checked by VerifySevAttestation with that
+// key's public half.  Sealing keys are derived from the VCEK and the
+// measurement.
+type SimulatedSevEnclave struct {
+	// Guest policy put in the reports.
+	Policy uint64
+
+	vcek        *ecdsa.PrivateKey
+	measurement []byte
+	sealingKey  []byte
+}
+
+// NewSimulatedSevEnclave reads the simulated VCEK, a PEM P-384 private
+// key such as /etc/certifier-snp-sim/ec-secp384r1-priv-key.pem, and the 48
+// byte measurement of the guest.  Register it with RegisterEnclave, usually
+// as "sev-enclave".
+func NewSimulatedSevEnclave(vcekKeyFile string, measurementFile string) (*SimulatedSevEnclave, error) {
+	pemKey, err := os.ReadFile(vcekKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read VCEK key: %w", err)
+	}
+	vcek, err := parseSevVcekKey(pemKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", vcekKeyFile, err)
+	}
+	measurement, err := os.ReadFile(measurementFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't read measurement: %w", err)
+	}
+	return MakeSimulatedSevEnclave(vcek, measurement)
+}
+
+// MakeSimulatedSevEnclave returns a simulated SEV-SNP enclave with the
+// given VCEK and measurement.
+func MakeSimulatedSevEnclave(vcek *ecdsa.PrivateKey, measurement []byte) (*SimulatedSevEnclave, error) {
+	if vcek == nil || vcek.Curve != elliptic.P384() {
+		return nil, errors.New("VCEK must be a P-384 key")
+	}
+	if len(measurement) != SevMeasurementSize {
+		return nil, fmt.Errorf("measurement is %d bytes, not %d", len(measurement), SevMeasurementSize)
+	}
+	d := vcek.D.FillBytes(make([]byte, 48))
+	return &SimulatedSevEnclave{
+		// SMT allowed, the reserved bit set
+		Policy:      0x30000,
+		vcek:        vcek,
+		measurement: append([]byte(nil), measurement...),
+		sealingKey:  deriveSealingKey(d, "simulated-sev-sealing-key", measurement),
+	}, nil
+}
+
+func parseSevVcekKey(pemKey []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("no PEM key")
+	}
+	if k, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse key: %w", err)
+	}
+	ecKey, ok := k.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("VCEK isn't an ECC key")
+	}
+	return ecKey, nil
+}
+
+// VcekKey returns the public VCEK as a key message, for policy saying the
+// platform key is trusted.
+func (e *SimulatedSevEnclave) VcekKey() *certprotos.KeyMessage {
+	k := &certprotos.KeyMessage{}
+	if !GetInternalKeyFromEccPublicKey("simulatedVcek", &e.vcek.PublicKey, k) {
+		return nil
+	}
+	return k
+}
+
+func (e *SimulatedSevEnclave) GetMeasurement(id string) ([]byte, error) {
+	return append([]byte(nil), e.measurement...), nil
+}
+
+func (e *SimulatedSevEnclave) Seal(id string, toSeal []byte) ([]byte, error) {
+	return sealWithKey(e.sealingKey, toSeal)
+}
+
+func (e *SimulatedSevEnclave) Unseal(id string, toUnseal []byte) ([]byte, error) {
+	return unsealWithKey(e.sealingKey, toUnseal)
+}
+
+// Attest returns a serialized sev_attestation_message whose report has the
+// SHA-384 hash of toSay as its report data.
+func (e *SimulatedSevEnclave) Attest(toSay []byte) ([]byte, error) {
+	report := make([]byte, sevReportSize)
+	binary.LittleEndian.PutUint32(report[0:], 2)
+	binary.LittleEndian.PutUint64(report[sevReportPolicy:], e.Policy)
+	// ECDSA P-384 with SHA-384
+	binary.LittleEndian.PutUint32(report[sevReportSigAlgo:], 1)
+	hashed := sha512.Sum384(toSay)
+	copy(report[sevReportData:], hashed[:])
+	copy(report[sevReportMeasurement:], e.measurement)
+
+	// The signature is r and s, each little endian in 72 bytes.
+	digest := sha512.Sum384(report[:sevReportSignature])
+	r, s, err := ecdsa.Sign(rand.Reader, e.vcek, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("can't sign report: %w", err)
+	}
+	sig := report[sevReportSignature:]
+	copy(sig[0:48], LittleToBigEndian(r.FillBytes(make([]byte, 48))))
+	copy(sig[72:120], LittleToBigEndian(s.FillBytes(make([]byte, 48))))
+
+	am := &certprotos.SevAttestationMessage{
+		WhatWasSaid:         toSay,
+		ReportedAttestation: report,
+	}
+	serialized, err := proto.Marshal(am)
+	if err != nil {
+		return nil, fmt.Errorf("can't serialize attestation: %w", err)
+	}
+	return serialized, nil
+}
+
+//  --------------------------------------------------------------------
+
+//  Test double
+//  --------------------------------------------------------------------
+
+// FakeEnclave is an Enclave for tests.  Sealed data is the measurement
+// followed by the data, in the clear, so it only unseals with the same
+// measurement.  Attest returns AttestResult, or toSay if it is nil, and
+// records what was said.  If Err is set, every operation returns it.
+type FakeEnclave struct {
+	Measurement  []byte
+	AttestResult []byte
+	Err          error
+
+	mu   sync.Mutex
+	said [][]byte
+}
+
+func (f *FakeEnclave) GetMeasurement(id string) ([]byte, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.Measurement, nil
+}
+
+func (f *FakeEnclave) Seal(id string, toSeal []byte) ([]byte, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return append(append([]byte(nil), f.Measurement...), toSeal...), nil
+}
+
+func (f *FakeEnclave) Unseal(id string, toUnseal []byte) ([]byte, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if !bytes.HasPrefix(toUnseal, f.Measurement) {
+		return nil, errDamagedSeal
+	}
+	return toUnseal[len(f.Measurement):], nil
+}
+
+func (f *FakeEnclave) Attest(toSay []byte) ([]byte, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	f.mu.Lock()
+	f.said = append(f.said, toSay)
+	f.mu.Unlock()
+	if f.AttestResult != nil {
+		return f.AttestResult, nil
+	}
+	return toSay, nil
+}
+
+// Said returns what Attest was asked to attest to, in order.
+func (f *FakeEnclave) Said() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte(nil), f.said...)
+}
@@ -0,0 +1,114 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certlib
+
+import (
+	"errors"
+	"fmt"
+
+	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+)
+
+// ValidationStage is the step of evidence validation that failed.
+type ValidationStage string
+
+const (
+	// Evidence, or a claim or report in it, can't be decoded or is of an
+	// unknown type.
+	StageParse ValidationStage = "parse"
+	// A signature, attestation or cert in the evidence doesn't verify.
+	StageSignature ValidationStage = "signature"
+	// The evidence is missing something or is out of order.
+	StageEvidence ValidationStage = "evidence"
+	// The policy can't be filtered for the evidence.
+	StagePolicyFilter ValidationStage = "policy-filter"
+	// No proof can be made from the policy and evidence, usually because
+	// the policy doesn't trust the measurement or platform, or the proof
+	// doesn't conclude the statement to prove.
+	StageProof ValidationStage = "proof"
+	// A step of the proof doesn't follow by its rule.
+	StageProofStep ValidationStage = "proof-step"
+	// The proof doesn't establish a trusted measurement.
+	StageMeasurement ValidationStage = "measurement"
+)
+
+// ValidationError says where validation failed.  Err is the cause, which
+// may be a ValidationError for a more specific stage, so the errors form a
+// chain from the validation down to the check that failed.
+type ValidationError struct {
+	Stage ValidationStage
+	// Position of the evidence in the package, -1 if the error isn't
+	// about one piece of evidence.
+	Evidence int
+	// The proof step and the rule it applies, -1 and 0 if the error isn't
+	// about a step.
+	Step int
+	Rule int
+	// The statement that couldn't be verified or proved, if any.
+	Statement *certprotos.VseClause
+	Msg       string
+	Err       error
+}
+
+func newValidationError(stage ValidationStage, format string, a ...interface{}) *ValidationError {
+	return &ValidationError{Stage: stage, Evidence: -1, Step: -1, Msg: fmt.Sprintf(format, a...)}
+}
+
+func (e *ValidationError) Error() string {
+	s := string(e.Stage)
+	if e.Evidence >= 0 {
+		s += fmt.Sprintf(", evidence %d", e.Evidence)
+	}
+	if e.Step >= 0 {
+		s += fmt.Sprintf(", step %d", e.Step)
+	}
+	if e.Rule > 0 {
+		s += fmt.Sprintf(", rule %d", e.Rule)
+	}
+	s += ": " + e.Msg
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ReasonCode returns the stage of the innermost ValidationError in err's
+// chain, e.g. "signature", or "" if there is none.  It says nothing about
+// the evidence or policy, so it can be returned to the client.
+func ReasonCode(err error) string {
+	code := ""
+	for ; err != nil; err = errors.Unwrap(err) {
+		if ve, ok := err.(*ValidationError); ok {
+			code = string(ve.Stage)
+		}
+	}
+	return code
+}
+
+// PrintValidationError prints err and the statements in its chain.
+func PrintValidationError(err error) {
+	fmt.Printf("%s\n", err.Error())
+	for ; err != nil; err = errors.Unwrap(err) {
+		if ve, ok := err.(*ValidationError); ok && ve.Statement != nil {
+			fmt.Printf("    %s: ", ve.Stage)
+			PrintVseClause(ve.Statement)
+			fmt.Printf("\n")
+		}
+	}
+}
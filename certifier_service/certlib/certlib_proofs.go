@@ -18,10 +18,10 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/sha512"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
@@ -240,392 +240,452 @@ func InitPolicy(publicPolicyKey *certprotos.KeyMessage, signedPolicy *certprotos
 	return true
 }
 
-func InitProvedStatements(pk certprotos.KeyMessage, evidenceList []*certprotos.Evidence,
-	ps *certprotos.ProvedStatements) bool {
+// parseSignedClaimEvidence handles "signed-claim" evidence for InitProvedStatements.
+func parseSignedClaimEvidence(st *EvidenceParseState, ev *certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error {
 
-	seenList := new(CertSeenList)
-	seenList.maxSize = 30
-	seenList.size = 0
+	signedClaim := certprotos.SignedClaimMessage{}
+	err := proto.Unmarshal(ev.SerializedEvidence, &signedClaim)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal serialized claim")
+	}
+	k := signedClaim.SigningKey
+	tcl := certprotos.VseClause{}
+	if VerifySignedAssertion(signedClaim, k, &tcl) {
+		// make sure the saying key in tcl is the same key that signed it
+		if tcl.GetVerb() == "says" && tcl.GetSubject().GetEntityType() == "key" {
+			if SameKey(k, tcl.GetSubject().GetKey()) {
+				ps.Proved = append(ps.Proved, &tcl)
+			}
+		}
+	}
+	return nil
+}
 
-	// Debug
-	fmt.Printf("\nInitProvedStatements %d assertions\n", len(evidenceList))
+// parsePemCertChainEvidence handles "pem-cert-chain" evidence for InitProvedStatements.
+func parsePemCertChainEvidence(st *EvidenceParseState, ev *certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error {
 
-	for i := 0; i < len(evidenceList); i++ {
-		ev := evidenceList[i]
-		if ev.GetEvidenceType() == "signed-claim" {
-			signedClaim := certprotos.SignedClaimMessage{}
-			err := proto.Unmarshal(ev.SerializedEvidence, &signedClaim)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal serialized claim\n")
-				return false
-			}
-			k := signedClaim.SigningKey
-			tcl := certprotos.VseClause{}
-			if VerifySignedAssertion(signedClaim, k, &tcl) {
-				// make sure the saying key in tcl is the same key that signed it
-				if tcl.GetVerb() == "says" && tcl.GetSubject().GetEntityType() == "key" {
-					if SameKey(k, tcl.GetSubject().GetKey()) {
-						ps.Proved = append(ps.Proved, &tcl)
-					}
-				}
-			}
-		} else if ev.GetEvidenceType() == "pem-cert-chain" {
-			// nothing to do
-		} else if ev.GetEvidenceType() == "gramine-attestation" {
-			succeeded, serializedUD, m, err := VerifyGramineAttestation(ev.SerializedEvidence)
-			if !succeeded || err != nil {
-				fmt.Printf("InitProvedStatements: Can't verify gramine evidence\n")
-				return false
-			}
-			// get enclave key from ud
-			ud := certprotos.AttestationUserData{}
-			err = proto.Unmarshal(serializedUD, &ud)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal user data\n")
-				return false
-			}
-			cl := ConstructGramineClaim(ud.EnclaveKey, m)
-			if cl == nil {
-				fmt.Printf("InitProvedStatements: ConstructGramineClaim failed\n")
-				return false
-			}
-			ps.Proved = append(ps.Proved, cl)
-		} else if ev.GetEvidenceType() == "oe-attestation-report" {
-			// call oeVerify here and construct the statement:
-			//      enclave-key speaks-for measurement
-			// from the return values.  Then add it to proved statements
-			// Ignore SGX TCB level check for now
-			var serializedUD, m []byte
-			var err error
-			if i < 1 || evidenceList[i-1].GetEvidenceType() != "pem-cert-chain" {
-				// No endorsement presented
-				serializedUD, m, err = oeverify.OEHostVerifyEvidence(evidenceList[i].SerializedEvidence,
-					nil, false)
-			} else {
-				serializedUD, m, err = oeverify.OEHostVerifyEvidence(evidenceList[i].SerializedEvidence,
-					evidenceList[i-1].SerializedEvidence, false)
-			}
-			if err != nil || serializedUD == nil || m == nil {
-				return false
-			}
-			ud := certprotos.AttestationUserData{}
-			err = proto.Unmarshal(serializedUD, &ud)
-			if err != nil {
-				return false
-			}
-			// Get platform key from pem file
-			var cl *certprotos.VseClause
-			if i >= 1 {
-				stripped := StripPemHeaderAndTrailer(string(evidenceList[i-1].SerializedEvidence))
-				if stripped == nil {
-					fmt.Printf("InitProvedStatements: Bad PEM\n")
-					return false
-				}
-				k := KeyFromPemFormat(*stripped)
-				cl = ConstructOESpeaksForStatement(k, ud.EnclaveKey, m)
-			} else {
-				cl = ConstructOESpeaksForStatement(nil, ud.EnclaveKey, m)
-			}
-			if cl == nil {
-				fmt.Printf("InitProvedStatements: ConstructEnclaveKeySpeaksForMeasurement failed\n")
-				return false
-			}
-			ps.Proved = append(ps.Proved, cl)
-		} else if ev.GetEvidenceType() == "islet-attestation" {
-			n := 1
-			if ps.Proved[n] == nil || ps.Proved[n].Clause == nil ||
-				ps.Proved[n].Clause.Subject == nil {
-				fmt.Printf("InitProvedStatements: Can't get attestKey key (1)\n")
-				return false
-			}
-			attestKeyVerifyKeyEnt := ps.Proved[n].Clause.Subject
-			if attestKeyVerifyKeyEnt == nil {
-				fmt.Printf("InitProvedStatements: Can't get attestKey key (2)\n")
-				return false
-			}
-			if attestKeyVerifyKeyEnt.GetEntityType() != "key" {
-				fmt.Printf("InitProvedStatements: Can't get attestKey key (3)\n")
-				return false
-			}
-			attestKey := attestKeyVerifyKeyEnt.Key
-			if attestKey == nil {
-				fmt.Printf("InitProvedStatements: Can't get attestKey key (4)\n")
-				return false
-			}
-			m := VerifyIsletAttestation(ev.SerializedEvidence, attestKey)
-			if m == nil {
-				fmt.Printf("InitProvedStatements: VerifyIsletAttestation failed\n")
-				return false
-			}
-			var am certprotos.IsletAttestationMessage
-			err := proto.Unmarshal(ev.SerializedEvidence, &am)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal IsletAttestationMessage\n")
-				return false
-			}
-			var ud certprotos.AttestationUserData
-			err = proto.Unmarshal(am.WhatWasSaid, &ud)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal AttestationUserData\n")
-				return false
-			}
-			if ud.EnclaveKey == nil {
-				fmt.Printf("InitProvedStatements: No enclaveKey\n")
-				return false
-			}
+	// The chain is used, and its certs collected, by the
+	// oe-attestation-report that follows it.
+	return nil
+}
 
-			if am.ReportedAttestation == nil {
-				fmt.Printf("InitProvedStatements: No reported attestation\n")
-				return false
-			}
+// pemCerts parses the certs in a PEM cert chain.
+func pemCerts(chain []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := chain
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
 
-			mEnt := MakeMeasurementEntity(m)
-			c2 := ConstructIsletSpeaksForMeasurementStatement(attestKey, ud.EnclaveKey, mEnt)
-			if c2 == nil {
-				fmt.Printf("InitProvedStatements: ConstructIsletSpeaksForMeasurementStatement failed\n")
-				return false
-			}
-			ps.Proved = append(ps.Proved, c2)
-		} else if ev.GetEvidenceType() == "keystone-attestation" {
-			n := 1
-			if ps.Proved[n] == nil || ps.Proved[n].Clause == nil ||
-				ps.Proved[n].Clause.Subject == nil {
-				fmt.Printf("InitProvedStatements: Can't get attestKey key (1)\n")
-				return false
-			}
-			attestKeyVerifyKeyEnt := ps.Proved[n].Clause.Subject
-			if attestKeyVerifyKeyEnt == nil {
-				fmt.Printf("InitProvedStatements: Can't get attestKey key (2)\n")
-				return false
-			}
-			if attestKeyVerifyKeyEnt.GetEntityType() != "key" {
-				fmt.Printf("InitProvedStatements: Can't get attestKey key (3)\n")
-				return false
-			}
-			attestKey := attestKeyVerifyKeyEnt.Key
-			if attestKey == nil {
-				fmt.Printf("InitProvedStatements: Can't get attestKey key (4)\n")
-				return false
-			}
-			m := VerifyKeystoneAttestation(ev.SerializedEvidence, attestKey)
-			if m == nil {
-				fmt.Printf("InitProvedStatements: VerifyKeystoneAttestation failed\n")
-				return false
-			}
-			var am certprotos.KeystoneAttestationMessage
-			err := proto.Unmarshal(ev.SerializedEvidence, &am)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal KeystoneAttestationMessage\n")
-				return false
-			}
-			var ud certprotos.AttestationUserData
-			err = proto.Unmarshal(am.WhatWasSaid, &ud)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal UserData\n")
-				return false
-			}
-			if ud.EnclaveKey == nil {
-				fmt.Printf("InitProvedStatements: No enclaveKey\n")
-				return false
-			}
+// parseGramineAttestationEvidence handles "gramine-attestation" evidence for InitProvedStatements.
+func parseGramineAttestationEvidence(st *EvidenceParseState, ev *certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error {
 
-			if am.ReportedAttestation == nil {
-				fmt.Printf("InitProvedStatements: No reported attestation\n")
-				return false
-			}
+	succeeded, serializedUD, m, err := VerifyGramineAttestation(ev.SerializedEvidence)
+	if !succeeded || err != nil {
+		e := newValidationError(StageSignature, "can't verify gramine evidence")
+		e.Err = err
+		return e
+	}
+	// get enclave key from ud
+	ud := certprotos.AttestationUserData{}
+	err = proto.Unmarshal(serializedUD, &ud)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal user data")
+	}
+	cl := ConstructGramineClaim(ud.EnclaveKey, m)
+	if cl == nil {
+		return newValidationError(StageEvidence, "ConstructGramineClaim failed")
+	}
+	st.UserData = append(st.UserData, &ud)
+	ps.Proved = append(ps.Proved, cl)
+	return nil
+}
 
-			mEnt := MakeMeasurementEntity(m)
-			c2 := ConstructKeystoneSpeaksForMeasurementStatement(attestKey, ud.EnclaveKey, mEnt)
-			if c2 == nil {
-				fmt.Printf("InitProvedStatements: ConstructKeystoneSpeaksForMeasurementStatement failed\n")
-				return false
-			}
-			ps.Proved = append(ps.Proved, c2)
-		} else if ev.GetEvidenceType() == "sev-attestation" {
-			// get the key from ps
-			n := len(ps.Proved) - 1
-			if n < 0 {
-				fmt.Printf("InitProvedStatements: sev evidence is at wrong position\n")
-				return false
-			}
-			if ps.Proved[n] == nil || ps.Proved[n].Clause == nil ||
-				ps.Proved[n].Clause.Subject == nil {
-				fmt.Printf("InitProvedStatements: Can't get vcek key (1)\n")
-				return false
-			}
-			vcekVerifyKeyEnt := ps.Proved[n].Clause.Subject
-			if vcekVerifyKeyEnt == nil {
-				fmt.Printf("InitProvedStatements: Can't get vcek key (2)\n")
-				return false
-			}
-			if vcekVerifyKeyEnt.GetEntityType() != "key" {
-				fmt.Printf("InitProvedStatements: Can't get vcek key (3)\n")
-				return false
-			}
-			vcekKey := vcekVerifyKeyEnt.Key
-			if vcekKey == nil {
-				fmt.Printf("InitProvedStatements: Can't get vcek key (4)\n")
-				return false
-			}
-			m := VerifySevAttestation(ev.SerializedEvidence, vcekKey)
-			if m == nil {
-				fmt.Printf("InitProvedStatements: VerifySevAttestation failed\n")
-				return false
-			}
-			var am certprotos.SevAttestationMessage
-			err := proto.Unmarshal(ev.SerializedEvidence, &am)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal SevAttestationMessage\n")
-				return false
-			}
-			var ud certprotos.AttestationUserData
-			err = proto.Unmarshal(am.WhatWasSaid, &ud)
-			if err != nil {
-				fmt.Printf("InitProvedStatements: Can't unmarshal UserData\n")
-				return false
-			}
-			if ud.EnclaveKey == nil {
-				fmt.Printf("InitProvedStatements: No enclaveKey\n")
-				return false
-			}
+// parseOeAttestationReportEvidence handles "oe-attestation-report" evidence for InitProvedStatements.
+func parseOeAttestationReportEvidence(st *EvidenceParseState, ev *certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error {
+
+	evidenceList := st.EvidenceList
+	i := st.Index
+
+	// call oeVerify here and construct the statement:
+	//      enclave-key speaks-for measurement
+	// from the return values.  Then add it to proved statements
+	// Ignore SGX TCB level check for now
+	var serializedUD, m []byte
+	var err error
+	if i < 1 || evidenceList[i-1].GetEvidenceType() != "pem-cert-chain" {
+		// No endorsement presented
+		serializedUD, m, err = oeverify.OEHostVerifyEvidence(evidenceList[i].SerializedEvidence,
+			nil, false)
+	} else {
+		serializedUD, m, err = oeverify.OEHostVerifyEvidence(evidenceList[i].SerializedEvidence,
+			evidenceList[i-1].SerializedEvidence, false)
+	}
+	if err != nil || serializedUD == nil || m == nil {
+		e := newValidationError(StageSignature, "can't verify oe evidence")
+		e.Err = err
+		return e
+	}
+	ud := certprotos.AttestationUserData{}
+	err = proto.Unmarshal(serializedUD, &ud)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal user data")
+	}
+	// Get platform key from pem file
+	var cl *certprotos.VseClause
+	if i >= 1 {
+		stripped := StripPemHeaderAndTrailer(string(evidenceList[i-1].SerializedEvidence))
+		if stripped == nil {
+			return newValidationError(StageParse, "bad PEM")
+		}
+		k := KeyFromPemFormat(*stripped)
+		cl = ConstructOESpeaksForStatement(k, ud.EnclaveKey, m)
+	} else {
+		cl = ConstructOESpeaksForStatement(nil, ud.EnclaveKey, m)
+	}
+	if cl == nil {
+		return newValidationError(StageEvidence, "ConstructOESpeaksForStatement failed")
+	}
+	if i >= 1 && evidenceList[i-1].GetEvidenceType() == "pem-cert-chain" {
+		// The endorsement chain the report verified with.
+		certs, err := pemCerts(evidenceList[i-1].SerializedEvidence)
+		if err != nil {
+			e := newValidationError(StageParse, "can't parse endorsement certs")
+			e.Err = err
+			return e
+		}
+		st.Certs = append(st.Certs, certs...)
+	}
+	st.UserData = append(st.UserData, &ud)
+	ps.Proved = append(ps.Proved, cl)
+	return nil
+}
 
-			if am.ReportedAttestation == nil {
-				fmt.Printf("InitProvedStatements: No reported attestation\n")
-				return false
-			}
+// attestKeyFromProved returns the key in the statement at n in ps, the
+// attestation key certified by the platform evidence before it.
+func attestKeyFromProved(ps *certprotos.ProvedStatements, n int) (*certprotos.KeyMessage, error) {
+	if n < 0 || n >= len(ps.Proved) || ps.Proved[n] == nil || ps.Proved[n].Clause == nil ||
+		ps.Proved[n].Clause.Subject == nil {
+		return nil, newValidationError(StageEvidence, "no attestation key before the attestation")
+	}
+	ent := ps.Proved[n].Clause.Subject
+	if ent.GetEntityType() != "key" || ent.Key == nil {
+		e := newValidationError(StageEvidence, "statement before the attestation isn't about a key")
+		e.Statement = ps.Proved[n]
+		return nil, e
+	}
+	return ent.Key, nil
+}
 
-			c1 := ConstructSevIsEnvironmentStatement(vcekKey, am.ReportedAttestation)
-			if c1 == nil {
-				fmt.Printf("InitProvedStatements: ConstructSevIsEnvironmentStatement failed\n")
-				return false
-			}
-			ps.Proved = append(ps.Proved, c1)
+// parseIsletAttestationEvidence handles "islet-attestation" evidence for InitProvedStatements.
+func parseIsletAttestationEvidence(st *EvidenceParseState, ev *certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error {
 
-			if c1.Clause == nil || c1.Clause.Subject == nil {
-				fmt.Printf("InitProvedStatements: can't get environment\n")
-				return false
-			}
-			env := c1.Clause.Subject
+	attestKey, err := attestKeyFromProved(ps, 1)
+	if err != nil {
+		return err
+	}
+	m := VerifyIsletAttestation(ev.SerializedEvidence, attestKey)
+	if m == nil {
+		return newValidationError(StageSignature, "VerifyIsletAttestation failed")
+	}
+	var am certprotos.IsletAttestationMessage
+	err = proto.Unmarshal(ev.SerializedEvidence, &am)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal IsletAttestationMessage")
+	}
+	var ud certprotos.AttestationUserData
+	err = proto.Unmarshal(am.WhatWasSaid, &ud)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal AttestationUserData")
+	}
+	if ud.EnclaveKey == nil {
+		return newValidationError(StageEvidence, "no enclaveKey")
+	}
 
-			c2 := ConstructSevSpeaksForEnvironmentStatement(vcekKey, ud.EnclaveKey, env)
-			if c2 == nil {
-				fmt.Printf("InitProvedStatements: ConstructSevSpeaksForEnvironmentStatement failed\n")
-				return false
-			}
-			ps.Proved = append(ps.Proved, c2)
-		} else if ev.GetEvidenceType() == "cert" {
-			// A cert always means "the signing-key says the subject-key is-trusted-for-attestation"
-			// construct vse statement.
-
-			// This whole thing is more complicated because we have to keep track of
-			// previously seen subject keys which, as issuer keys, will sign other
-			// keys.  The only time we can get the issuer_key directly is when the cert
-			// is self signed.
-
-			// turn into X509
-			cert := Asn1ToX509(ev.SerializedEvidence)
-			if cert == nil {
-				fmt.Printf("InitProvedStatements: Can't convert cert\n")
-				return false
-			}
+	if am.ReportedAttestation == nil {
+		return newValidationError(StageEvidence, "no reported attestation")
+	}
 
-			subjKey := GetSubjectKey(cert)
-			if subjKey == nil {
-				fmt.Printf("InitProvedStatements: Can't get subject key\n")
-				return false
-			}
-			if FindKeySeen(seenList, subjKey.GetKeyName()) == nil {
-				if !AddKeySeen(seenList, subjKey) {
-					fmt.Printf("InitProvedStatements: Can't add subject key\n")
-					return false
-				}
-			}
-			issuerName := GetIssuerNameFromCert(cert)
-			signerKey := FindKeySeen(seenList, issuerName)
-			if signerKey == nil {
-				fmt.Printf("InitProvedStatements: signerKey (%s, %s) is nil\n", issuerName, subjKey.GetKeyName())
-				return false
-			}
+	mEnt := MakeMeasurementEntity(m)
+	c2 := ConstructIsletSpeaksForMeasurementStatement(attestKey, ud.EnclaveKey, mEnt)
+	if c2 == nil {
+		return newValidationError(StageEvidence, "ConstructIsletSpeaksForMeasurementStatement failed")
+	}
+	st.UserData = append(st.UserData, &ud)
+	ps.Proved = append(ps.Proved, c2)
+	return nil
+}
 
-			// verify x509 signature
-			certPool := x509.NewCertPool()
-			certPool.AddCert(cert)
-			opts := x509.VerifyOptions{
-				Roots: certPool,
-			}
-			if _, err := cert.Verify(opts); err != nil {
-				fmt.Printf("InitProvedStatements: Cert.Vertify fails\n")
-				return false
-			}
+// parseKeystoneAttestationEvidence handles "keystone-attestation" evidence for InitProvedStatements.
+func parseKeystoneAttestationEvidence(st *EvidenceParseState, ev *certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error {
+
+	attestKey, err := attestKeyFromProved(ps, 1)
+	if err != nil {
+		return err
+	}
+	m := VerifyKeystoneAttestation(ev.SerializedEvidence, attestKey)
+	if m == nil {
+		return newValidationError(StageSignature, "VerifyKeystoneAttestation failed")
+	}
+	var am certprotos.KeystoneAttestationMessage
+	err = proto.Unmarshal(ev.SerializedEvidence, &am)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal KeystoneAttestationMessage")
+	}
+	var ud certprotos.AttestationUserData
+	err = proto.Unmarshal(am.WhatWasSaid, &ud)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal UserData")
+	}
+	if ud.EnclaveKey == nil {
+		return newValidationError(StageEvidence, "no enclaveKey")
+	}
+
+	if am.ReportedAttestation == nil {
+		return newValidationError(StageEvidence, "no reported attestation")
+	}
+
+	mEnt := MakeMeasurementEntity(m)
+	c2 := ConstructKeystoneSpeaksForMeasurementStatement(attestKey, ud.EnclaveKey, mEnt)
+	if c2 == nil {
+		return newValidationError(StageEvidence, "ConstructKeystoneSpeaksForMeasurementStatement failed")
+	}
+	st.UserData = append(st.UserData, &ud)
+	ps.Proved = append(ps.Proved, c2)
+	return nil
+}
+
+// parseSevAttestationEvidence handles "sev-attestation" evidence for InitProvedStatements.
+func parseSevAttestationEvidence(st *EvidenceParseState, ev *certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error {
+
+	// get the key from ps, the vcek certified by the cert before
+	vcekKey, err := attestKeyFromProved(ps, len(ps.Proved)-1)
+	if err != nil {
+		return err
+	}
+	m := VerifySevAttestation(ev.SerializedEvidence, vcekKey)
+	if m == nil {
+		return newValidationError(StageSignature, "VerifySevAttestation failed")
+	}
+	var am certprotos.SevAttestationMessage
+	err = proto.Unmarshal(ev.SerializedEvidence, &am)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal SevAttestationMessage")
+	}
+	var ud certprotos.AttestationUserData
+	err = proto.Unmarshal(am.WhatWasSaid, &ud)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal UserData")
+	}
+	if ud.EnclaveKey == nil {
+		return newValidationError(StageEvidence, "no enclaveKey")
+	}
+
+	if am.ReportedAttestation == nil {
+		return newValidationError(StageEvidence, "no reported attestation")
+	}
+
+	c1 := ConstructSevIsEnvironmentStatement(vcekKey, am.ReportedAttestation)
+	if c1 == nil {
+		return newValidationError(StageEvidence, "ConstructSevIsEnvironmentStatement failed")
+	}
+	ps.Proved = append(ps.Proved, c1)
+
+	if c1.Clause == nil || c1.Clause.Subject == nil {
+		return newValidationError(StageEvidence, "can't get environment")
+	}
+	env := c1.Clause.Subject
+
+	c2 := ConstructSevSpeaksForEnvironmentStatement(vcekKey, ud.EnclaveKey, env)
+	if c2 == nil {
+		return newValidationError(StageEvidence, "ConstructSevSpeaksForEnvironmentStatement failed")
+	}
+	st.UserData = append(st.UserData, &ud)
+	ps.Proved = append(ps.Proved, c2)
+	return nil
+}
+
+// parseCertEvidence handles "cert" evidence for InitProvedStatements.
+func parseCertEvidence(st *EvidenceParseState, ev *certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error {
+
+	seenList := st.SeenList
+
+	// A cert always means "the signing-key says the subject-key is-trusted-for-attestation"
+	// construct vse statement.
+
+	// This whole thing is more complicated because we have to keep track of
+	// previously seen subject keys which, as issuer keys, will sign other
+	// keys.  The only time we can get the issuer_key directly is when the cert
+	// is self signed.
+
+	// turn into X509
+	cert := Asn1ToX509(ev.SerializedEvidence)
+	if cert == nil {
+		return newValidationError(StageParse, "can't convert cert")
+	}
 
-			/*
-				// This code will replace the above eventually
-				if signerKey.GetName() == subjKey.GetKeyName {
-					err := cert.CheckSignatureFrom(cert)
-					if err != nil {
-						fmt.Printf("InitProvedStatements: parent signature check fails\n")
-						return false
-					}
-				} else {
-					if i <= 0 {
-						fmt.Printf("InitProvedStatements: No parent cert\n")
-						return false
-					}
-					parentCert := Asn1ToX509(evidenceList[i - 1].SerializedEvidence)
-					if parentCert == nil {
-						fmt.Printf("InitProvedStatements: Can't convert parent cert\n")
-						return false
-					}
-					err := cert.CheckSignatureFrom(parentCert)
-					if err != nil {
-						fmt.Printf("InitProvedStatements: parent signature check fails\n")
-						return false
-					}
-				}
-			*/
-
-			cl := ConstructVseAttestationFromCert(subjKey, signerKey)
-			if cl == nil {
-				fmt.Printf("InitProvedStatements: Can't construct Attestation from cert\n")
+	subjKey := GetSubjectKey(cert)
+	if subjKey == nil {
+		return newValidationError(StageParse, "can't get subject key")
+	}
+	if FindKeySeen(seenList, subjKey.GetKeyName()) == nil {
+		if !AddKeySeen(seenList, subjKey) {
+			return newValidationError(StageEvidence, "can't add subject key, too many certs")
+		}
+	}
+	issuerName := GetIssuerNameFromCert(cert)
+	signerKey := FindKeySeen(seenList, issuerName)
+	if signerKey == nil {
+		return newValidationError(StageEvidence, "no cert for issuer %s of %s", issuerName, subjKey.GetKeyName())
+	}
+
+	// verify x509 signature
+	certPool := x509.NewCertPool()
+	certPool.AddCert(cert)
+	opts := x509.VerifyOptions{
+		Roots: certPool,
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		e := newValidationError(StageSignature, "cert for %s doesn't verify", subjKey.GetKeyName())
+		e.Err = err
+		return e
+	}
+
+	/*
+		// This code will replace the above eventually
+		if signerKey.GetName() == subjKey.GetKeyName {
+			err := cert.CheckSignatureFrom(cert)
+			if err != nil {
+				fmt.Printf("InitProvedStatements: parent signature check fails\n")
 				return false
 			}
-			ps.Proved = append(ps.Proved, cl)
-		} else if ev.GetEvidenceType() == "signed-vse-attestation-report" {
-			sr := certprotos.SignedReport{}
-			err := proto.Unmarshal(ev.SerializedEvidence, &sr)
-			if err != nil {
-				fmt.Printf("Can't unmarshal signed report\n")
+		} else {
+			if st.Index <= 0 {
+				fmt.Printf("InitProvedStatements: No parent cert\n")
 				return false
 			}
-			k := sr.SigningKey
-			info := certprotos.VseAttestationReportInfo{}
-			err = proto.Unmarshal(sr.GetReport(), &info)
-			if err != nil {
-				fmt.Printf("Can't unmarshal info\n")
+			parentCert := Asn1ToX509(st.EvidenceList[st.Index - 1].SerializedEvidence)
+			if parentCert == nil {
+				fmt.Printf("InitProvedStatements: Can't convert parent cert\n")
 				return false
 			}
-			ud := certprotos.AttestationUserData{}
-			err = proto.Unmarshal(info.GetUserData(), &ud)
+			err := cert.CheckSignatureFrom(parentCert)
 			if err != nil {
-				fmt.Printf("Can't unmarshal user data\n")
+				fmt.Printf("InitProvedStatements: parent signature check fails\n")
 				return false
 			}
+		}
+	*/
 
-			if VerifyReport("vse-attestation-report", k, ev.GetSerializedEvidence()) {
-				if CheckTimeRange(info.NotBefore, info.NotAfter) {
-					cl := ConstructVseAttestClaim(k, ud.EnclaveKey, info.VerifiedMeasurement)
-					ps.Proved = append(ps.Proved, cl)
-				}
-			} else {
-				fmt.Printf("InitProvedStatements: vse-attestation-report fails to verify\n")
-				return false
+	cl := ConstructVseAttestationFromCert(subjKey, signerKey)
+	if cl == nil {
+		return newValidationError(StageEvidence, "can't construct attestation from cert")
+	}
+	ps.Proved = append(ps.Proved, cl)
+	st.Certs = append(st.Certs, cert)
+	return nil
+}
+
+// parseSignedVseAttestationReportEvidence handles "signed-vse-attestation-report" evidence for InitProvedStatements.
+func parseSignedVseAttestationReportEvidence(st *EvidenceParseState, ev *certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error {
+
+	sr := certprotos.SignedReport{}
+	err := proto.Unmarshal(ev.SerializedEvidence, &sr)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal signed report")
+	}
+	k := sr.SigningKey
+	info := certprotos.VseAttestationReportInfo{}
+	err = proto.Unmarshal(sr.GetReport(), &info)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal info")
+	}
+	ud := certprotos.AttestationUserData{}
+	err = proto.Unmarshal(info.GetUserData(), &ud)
+	if err != nil {
+		return newValidationError(StageParse, "can't unmarshal user data")
+	}
+
+	if !VerifyReport("vse-attestation-report", k, ev.GetSerializedEvidence()) {
+		return newValidationError(StageSignature, "vse-attestation-report fails to verify")
+	}
+	if CheckTimeRange(info.NotBefore, info.NotAfter) {
+		cl := ConstructVseAttestClaim(k, ud.EnclaveKey, info.VerifiedMeasurement)
+		st.UserData = append(st.UserData, &ud)
+		ps.Proved = append(ps.Proved, cl)
+	}
+	return nil
+}
+
+// InitProvedStatements adds the statements established by each piece of
+// evidence to ps.  A *ValidationError returned has the position of the
+// evidence that failed.
+func InitProvedStatements(pk certprotos.KeyMessage, evidenceList []*certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error {
+	_, err := initProvedStatements(&pk, evidenceList, ps)
+	return err
+}
+
+// initProvedStatements is InitProvedStatements, also returning the parse
+// state with the certs and user data verified.
+func initProvedStatements(pk *certprotos.KeyMessage, evidenceList []*certprotos.Evidence,
+	ps *certprotos.ProvedStatements) (*EvidenceParseState, error) {
+
+	seenList := new(CertSeenList)
+	seenList.maxSize = 30
+	seenList.size = 0
+
+	// Debug
+	fmt.Printf("\nInitProvedStatements %d assertions\n", len(evidenceList))
+
+	st := &EvidenceParseState{
+		PolicyKey:    pk,
+		EvidenceList: evidenceList,
+		SeenList:     seenList,
+	}
+	for i := 0; i < len(evidenceList); i++ {
+		ev := evidenceList[i]
+		parse := FindEvidenceParser(ev.GetEvidenceType())
+		if parse == nil {
+			e := newValidationError(StageParse, "unknown evidence type %s", ev.GetEvidenceType())
+			e.Evidence = i
+			return nil, e
+		}
+		st.Index = i
+		if err := parse(st, ev, ps); err != nil {
+			// Parsers from other packages may return other errors.
+			e, ok := err.(*ValidationError)
+			if !ok || e.Evidence >= 0 {
+				e = newValidationError(StageEvidence, "%s", ev.GetEvidenceType())
+				e.Err = err
 			}
-		} else {
-			fmt.Printf("Unknown evidence type\n")
-			return false
+			e.Evidence = i
+			return nil, e
 		}
 	}
-	return true
+	return st, nil
 }
 
 func InitCerifierRules(cr *certprotos.CertifierRules) bool {
@@ -1100,17 +1160,7 @@ func VerifyReport(etype string, pk *certprotos.KeyMessage, serialized []byte) bo
 		return false
 	}
 
-	rPK := rsa.PublicKey{}
-	rpK := rsa.PrivateKey{}
-	if GetRsaKeysFromInternal(k, &rpK, &rPK) == false {
-		fmt.Printf("VerifyReport: Can't convert rsa key from internal\n")
-		return false
-	}
-
-	if RsaSha256Verify(&rPK, sr.Report, sr.Signature) {
-		return true
-	}
-	return false
+	return VerifyWithKey(sr.GetSigningAlgorithm(), k, sr.Report, sr.Signature)
 }
 
 //	Returns measurement
@@ -1718,8 +1768,11 @@ func VerifyExternalProofStep(tree *PredicateDominance, step *certprotos.ProofSte
 	return VerifyInternalProofStep(tree, s1, s2, c, int(*rule))
 }
 
+// VerifyProof checks each step of p whose premises are proved, adding its
+// conclusion to ps, until toProve is concluded.  A *ValidationError
+// returned has the failing step, its rule and its conclusion.
 func VerifyProof(policyKey *certprotos.KeyMessage, toProve *certprotos.VseClause,
-	p *certprotos.Proof, ps *certprotos.ProvedStatements) bool {
+	p *certprotos.Proof, ps *certprotos.ProvedStatements) error {
 
 	tree := PredicateDominance{
 		Predicate:  "is-trusted",
@@ -1728,8 +1781,7 @@ func VerifyProof(policyKey *certprotos.KeyMessage, toProve *certprotos.VseClause
 	}
 
 	if !InitDominance(&tree) {
-		fmt.Printf("Can't init Dominance tree\n")
-		return false
+		return newValidationError(StageProof, "can't init dominance tree")
 	}
 
 	for i := 0; i < len(p.Steps); i++ {
@@ -1737,8 +1789,9 @@ func VerifyProof(policyKey *certprotos.KeyMessage, toProve *certprotos.VseClause
 		s2 := p.Steps[i].S2
 		c := p.Steps[i].Conclusion
 		if s1 == nil || s2 == nil || c == nil {
-			fmt.Printf("Bad proof step\n")
-			return false
+			e := newValidationError(StageProofStep, "bad proof step")
+			e.Step = i
+			return e
 		}
 		if !StatementAlreadyProved(s1, ps) {
 			continue
@@ -1749,16 +1802,20 @@ func VerifyProof(policyKey *certprotos.KeyMessage, toProve *certprotos.VseClause
 		if VerifyExternalProofStep(&tree, p.Steps[i]) {
 			ps.Proved = append(ps.Proved, c)
 			if SameVseClause(toProve, c) {
-				return true
+				return nil
 			}
 		} else {
-			fmt.Printf("VerifyProof error: Step %d, does not pass\n", i)
-			PrintProofStep("    ", p.Steps[i])
-			return false
+			e := newValidationError(StageProofStep, "conclusion doesn't follow")
+			e.Step = i
+			e.Rule = int(p.Steps[i].GetRuleApplied())
+			e.Statement = c
+			return e
 		}
 
 	}
-	return false
+	e := newValidationError(StageProof, "proof doesn't conclude the statement to prove")
+	e.Statement = toProve
+	return e
 }
 
 func ConstructProofFromOeEvidenceWithoutEndorsement(publicPolicyKey *certprotos.KeyMessage, purpose string, alreadyProved *certprotos.ProvedStatements) (*certprotos.VseClause, *certprotos.Proof) {
@@ -2302,235 +2359,28 @@ func ConstructProofFromSevPlatformEvidence(publicPolicyKey *certprotos.KeyMessag
 	return nil, nil
 }
 
-// returns success, toProve, measurement
+// ValidateInternalEvidence validates vse-attestation-package evidence with
+// ValidateEvidenceWithVerifier.
 func ValidateInternalEvidence(pubPolicyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
-	originalPolicy *certprotos.ProvedStatements, purpose string) (bool,
-	*certprotos.VseClause, []byte) {
-
-	// Debug
-	fmt.Printf("\nValidateInternalEvidence: original policy:\n")
-	PrintProvedStatements(originalPolicy)
-
-	alreadyProved := FilterInternalPolicy(pubPolicyKey, evp, originalPolicy)
-	if alreadyProved == nil {
-		fmt.Printf("ValidateInternalEvidence: Can't filterpolicy\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\nValidateInternalEvidence: filtered policy:\n")
-	PrintProvedStatements(alreadyProved)
-	fmt.Printf("\n")
-
-	if !InitProvedStatements(*pubPolicyKey, evp.FactAssertion, alreadyProved) {
-		fmt.Printf("ValidateInternalEvidence: Can't InitProvedStatements\n")
-		return false, nil, nil
-	}
-
-	// After InitProvedStatements already proved will be:
-	//    00 Key[rsa, policyKey, a5fc2b7e629fbbfb04b056a993a473af3540bbfe] is-trusted
-	//    01 Key[rsa, policyKey, a5fc2b7e629fbbfb04b056a993a473af3540bbfe] says Key[rsa, platformKey, c1c06db41296c2dc3ecb2e4a1290f39925699d4d] is-trusted-for-attestation
-	//    02 Key[rsa, policyKey, a5fc2b7e629fbbfb04b056a993a473af3540bbfe] says Measurement[617ac0a68393b4c0b359a76d0fab9015af0801273e13bd366fca57a7af4fe6cc] is-trusted
-	//    03 Key[rsa, platformKey, c1c06db41296c2dc3ecb2e4a1290f39925699d4d] says Key[rsa, attestKey, f19938982e3f7e16f524de5f7b47d3e39e32df07] is-trusted-for-attestation
-	//    04 Key[rsa, attestKey, f19938982e3f7e16f524de5f7b47d3e39e32df07] says Key[rsa, auth-key, ce3c7cc9b6e7bc733a95434bda226ef4d74e620f] speaks-for Measurement[617ac0a68393b4c0b359a76d0fab9015af0801273e13bd366fca57a7af4fe6cc]
-
-	// Debug
-	fmt.Printf("\nValidateInternalEvidence: after InitProved:\n")
-	PrintProvedStatements(alreadyProved)
-
-	// ConstructProofFromInternalPlatformEvidence()
-	toProve, proof := ConstructProofFromInternalPlatformEvidence(pubPolicyKey, purpose, alreadyProved)
-	if toProve == nil || proof == nil {
-		fmt.Printf("ValidateInternalEvidence: Can't construct proof\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\n")
-	fmt.Printf("ValidateInternalEvidence, toProve: ")
-	PrintVseClause(toProve)
-	fmt.Printf("\n")
-	PrintProof(proof)
-	fmt.Printf("\n")
-
-	if !VerifyProof(pubPolicyKey, toProve, proof, alreadyProved) {
-		fmt.Printf("ValidateInternalEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("ValidateInternalEvidence: Proof verifies\n")
-
-	me := alreadyProved.Proved[2]
-	if me.Clause == nil || me.Clause.Subject == nil ||
-		me.Clause.Subject.GetEntityType() != "measurement" {
-		fmt.Printf("ValidateInternalEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	return true, toProve, me.Clause.Subject.Measurement
+	originalPolicy *certprotos.ProvedStatements, purpose string) (*ValidationResult, error) {
+	v := &builtinVerifier{FilterInternalPolicy, ConstructProofFromInternalPlatformEvidence}
+	return ValidateEvidenceWithVerifier(v, pubPolicyKey, evp, originalPolicy, purpose)
 }
 
-// returns success, toProve, measurement
+// ValidateOeEvidence validates oe-evidence evidence with
+// ValidateEvidenceWithVerifier.
 func ValidateOeEvidence(pubPolicyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
-	originalPolicy *certprotos.ProvedStatements, purpose string) (bool,
-	*certprotos.VseClause, []byte) {
-
-	// Debug
-	fmt.Printf("\nValidateOeEvidence, Original policy:\n")
-	PrintProvedStatements(originalPolicy)
-
-	alreadyProved := FilterOePolicy(pubPolicyKey, evp, originalPolicy)
-	if alreadyProved == nil {
-		fmt.Printf("ValidateOeEvidence: Can't filterpolicy\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\nfiltered policy:\n")
-	PrintProvedStatements(alreadyProved)
-	fmt.Printf("\n")
-
-	if !InitProvedStatements(*pubPolicyKey, evp.FactAssertion, alreadyProved) {
-		fmt.Printf("ValidateOeEvidence: Can't InitProvedStatements\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\nValidateOeEvidence, after InitProved:\n")
-	PrintProvedStatements(alreadyProved)
-
-	// ConstructProofFromSevPlatformEvidence()
-	toProve, proof := ConstructProofFromOeEvidence(pubPolicyKey, purpose, alreadyProved)
-	if toProve == nil || proof == nil {
-		fmt.Printf("ValidateOeEvidence: Can't construct proof\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\n")
-	fmt.Printf("ValidateOeEvidence, toProve: ")
-	PrintVseClause(toProve)
-	fmt.Printf("\n")
-	PrintProof(proof)
-	fmt.Printf("\n")
-
-	if !VerifyProof(pubPolicyKey, toProve, proof, alreadyProved) {
-		fmt.Printf("ValidateOeEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("ValidateOeEvidence: Proof verifies\n")
-	fmt.Printf("\nProved statements\n")
-	PrintProvedStatements(alreadyProved)
-
-	var me *certprotos.VseClause
-	for i := 1; i <= len(alreadyProved.Proved); i++ {
-		me = alreadyProved.Proved[i]
-		if me.Clause != nil && me.Clause.Subject != nil &&
-			me.Clause.Subject.GetEntityType() == "measurement" {
-			return true, toProve, me.Clause.Subject.Measurement
-		}
-	}
-
-	fmt.Printf("ValidateOeEvidence: Proof does not verify\n")
-	return false, nil, nil
+	originalPolicy *certprotos.ProvedStatements, purpose string) (*ValidationResult, error) {
+	v := &builtinVerifier{FilterOePolicy, ConstructProofFromOeEvidence}
+	return ValidateEvidenceWithVerifier(v, pubPolicyKey, evp, originalPolicy, purpose)
 }
 
-// returns success, toProve, measurement
+// ValidateSevEvidence validates sev-platform-package evidence with
+// ValidateEvidenceWithVerifier.
 func ValidateSevEvidence(pubPolicyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
-	originalPolicy *certprotos.ProvedStatements, purpose string) (bool,
-	*certprotos.VseClause, []byte) {
-
-	// Debug
-	fmt.Printf("\nValidateSevEvidence, Original policy:\n")
-	PrintProvedStatements(originalPolicy)
-
-	alreadyProved := FilterSevPolicy(pubPolicyKey, evp, originalPolicy)
-	if alreadyProved == nil {
-		fmt.Printf("Can't filterpolicy\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\nfiltered policy:\n")
-	PrintProvedStatements(alreadyProved)
-	fmt.Printf("\n")
-
-	if !InitProvedStatements(*pubPolicyKey, evp.FactAssertion, alreadyProved) {
-		fmt.Printf("ValidateSevEvidence: Can't InitProvedStatements\n")
-		return false, nil, nil
-	}
-
-	// After InitProved alreadyProved should be:
-	//
-	//  00 Key[rsa, policyKey, f91d6331b1fd99b3fa8641fd16dcd4c272a92b8a] is-trusted
-	//  01 Key[rsa, policyKey, f91d6331b1fd99b3fa8641fd16dcd4c272a92b8a] says
-	//	Key[rsa, ARKKey, c36d3343d69d9d8000d32d0979adff876e98ec79] is-trusted-for-attestation
-	//  02 Key[rsa, policyKey, f91d6331b1fd99b3fa8641fd16dcd4c272a92b8a] says
-	//      Measurement[010203040506070801020304050607080102030405060708010203040506070801020304050607080102030405060708] is-trusted
-	//  03 Key[rsa, policyKey, f91d6331b1fd99b3fa8641fd16dcd4c272a92b8a] says
-	//	platform[amd-sev-snp, debug: no, migrate: no, api-major: >=0, api-minor: >=0, key-share: no,
-	//		tcb-version: >=0] has-trusted-platform-property
-	//  04 Key[rsa, ARKKey, c36d3343d69d9d8000d32d0979adff876e98ec79] says
-	//	Key[rsa, ARKKey, c36d3343d69d9d8000d32d0979adff876e98ec79] is-trusted-for-attestation
-	//  05 Key[rsa, ARKKey, c36d3343d69d9d8000d32d0979adff876e98ec79] says
-	//	Key[rsa, ASKKey, c87c716e16df326f58c5fe026eb55133d57239ff] is-trusted-for-attestation
-	//  06 Key[rsa, ASKKey, c87c716e16df326f58c5fe026eb55133d57239ff] says
-	//	Key[ecc-P-384, VCEKKey,
-	//	d8a35da4a4780fe58fe5a02e5aec7d40fa7452ca89ca4c6620181228b3e4e9c41ab9a200875a2b6e044ae73936408d27]
-	//	is-trusted-for-attestation
-	//  07 Key[ecc-P-384, VCEKKey,
-	//	d8a35da4a4780fe58fe5a02e5aec7d40fa7452ca89ca4c6620181228b3e4e9c41ab9a200875a2b6e044ae73936408d27]
-	//	says environment[platform[amd-sev-snp, debug: no, smt: no, migrate: no, api-major: =0,
-	//	api-minor: =0, tcb-version: =0],
-	//	measurement: 010203040506070801020304050607080102030405060708010203040506070801020304050607080102030405060708]
-	//	is-environment
-	//  08 Key[ecc-P-384, VCEKKey,
-	//	d8a35da4a4780fe58fe5a02e5aec7d40fa7452ca89ca4c6620181228b3e4e9c41ab9a200875a2b6e044ae73936408d27] says
-	//	Key[rsa, policyKey, f91d6331b1fd99b3fa8641fd16dcd4c272a92b8a] speaks-for
-	//	environment[platform[amd-sev-snp, debug: no, key-share: no, migrate: no, api-major: =0,
-	//	api-minor: =0, tcb-version: =0], measurement:
-	//	010203040506070801020304050607080102030405060708010203040506070801020304050607080102030405060708]
-
-	// Debug
-	fmt.Printf("\nValidateSevEvidence, after InitProved:\n")
-	PrintProvedStatements(alreadyProved)
-
-	// ConstructProofFromSevPlatformEvidence()
-	toProve, proof := ConstructProofFromSevPlatformEvidence(pubPolicyKey, purpose, alreadyProved)
-	if toProve == nil || proof == nil {
-		fmt.Printf("ValidateSevEvidence: Can't construct proof\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\n")
-	fmt.Printf("ValidateSevEvidence, toProve: ")
-	PrintVseClause(toProve)
-	fmt.Printf("\n")
-	PrintProof(proof)
-	fmt.Printf("\n")
-
-	if !VerifyProof(pubPolicyKey, toProve, proof, alreadyProved) {
-		fmt.Printf("ValidateSevEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("ValidateSevEvidence: Proof verifies\n")
-	fmt.Printf("\nProved statements\n")
-	PrintProvedStatements(alreadyProved)
-
-	me := alreadyProved.Proved[2]
-	if me.Clause == nil || me.Clause.Subject == nil ||
-		me.Clause.Subject.GetEntityType() != "measurement" {
-		fmt.Printf("ValidateSevEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	return true, toProve, me.Clause.Subject.Measurement
+	originalPolicy *certprotos.ProvedStatements, purpose string) (*ValidationResult, error) {
+	v := &builtinVerifier{FilterSevPolicy, ConstructProofFromSevPlatformEvidence}
+	return ValidateEvidenceWithVerifier(v, pubPolicyKey, evp, originalPolicy, purpose)
 }
 
 func ConstructGramineClaim(enclaveKey *certprotos.KeyMessage,
@@ -2679,68 +2529,12 @@ func ConstructProofFromGramineEvidence(publicPolicyKey *certprotos.KeyMessage, p
 	return toProve, proof
 }
 
-// returns success, toProve, measurement
+// ValidateGramineEvidence validates gramine-evidence evidence with
+// ValidateEvidenceWithVerifier.
 func ValidateGramineEvidence(pubPolicyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
-	originalPolicy *certprotos.ProvedStatements, purpose string) (bool,
-	*certprotos.VseClause, []byte) {
-
-	// Debug
-	fmt.Printf("\nValidateGramineEvidence, Original policy:\n")
-	PrintProvedStatements(originalPolicy)
-
-	alreadyProved := FilterGraminePolicy(pubPolicyKey, evp, originalPolicy)
-	if alreadyProved == nil {
-		fmt.Printf("ValidateGramineEvidence: Can't filterpolicy\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\nfiltered policy:\n")
-	PrintProvedStatements(alreadyProved)
-	fmt.Printf("\n")
-
-	if !InitProvedStatements(*pubPolicyKey, evp.FactAssertion, alreadyProved) {
-		fmt.Printf("ValidateGramineEvidence: Can't InitProvedStatements\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\nValidateGramineEvidence, after InitProved:\n")
-	PrintProvedStatements(alreadyProved)
-
-	// ConstructProofFromSevPlatformEvidence()
-	toProve, proof := ConstructProofFromGramineEvidence(pubPolicyKey, purpose, alreadyProved)
-	if toProve == nil || proof == nil {
-		fmt.Printf("ValidateGramineEvidence: Can't construct proof\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\n")
-	fmt.Printf("ValidateGramineEvidence, toProve: ")
-	PrintVseClause(toProve)
-	fmt.Printf("\n")
-	PrintProof(proof)
-	fmt.Printf("\n")
-
-	if !VerifyProof(pubPolicyKey, toProve, proof, alreadyProved) {
-		fmt.Printf("ValidateGramineEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("ValidateGramineEvidence: Proof verifies\n")
-	fmt.Printf("\nProved statements\n")
-	PrintProvedStatements(alreadyProved)
-
-	me := alreadyProved.Proved[2]
-	if me.Clause == nil || me.Clause.Subject == nil ||
-		me.Clause.Subject.GetEntityType() != "measurement" {
-		fmt.Printf("ValidateGramineEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	return true, toProve, me.Clause.Subject.Measurement
+	originalPolicy *certprotos.ProvedStatements, purpose string) (*ValidationResult, error) {
+	v := &builtinVerifier{FilterGraminePolicy, ConstructProofFromGramineEvidence}
+	return ValidateEvidenceWithVerifier(v, pubPolicyKey, evp, originalPolicy, purpose)
 }
 
 func FilterKeystonePolicy(policyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
@@ -2884,68 +2678,12 @@ func ConstructProofFromKeystoneEvidence(publicPolicyKey *certprotos.KeyMessage,
 	return toProve, proof
 }
 
-// returns success, toProve, measurement
+// ValidateKeystoneEvidence validates keystone-evidence evidence with
+// ValidateEvidenceWithVerifier.
 func ValidateKeystoneEvidence(pubPolicyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
-	originalPolicy *certprotos.ProvedStatements, purpose string) (bool,
-	*certprotos.VseClause, []byte) {
-
-	// Debug
-	fmt.Printf("\nValidateKeystoneEvidence, Original policy:\n")
-	PrintProvedStatements(originalPolicy)
-
-	alreadyProved := FilterKeystonePolicy(pubPolicyKey, evp, originalPolicy)
-	if alreadyProved == nil {
-		fmt.Printf("ValidateKeystoneEvidence: Can't filterpolicy\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\nfiltered policy:\n")
-	PrintProvedStatements(alreadyProved)
-	fmt.Printf("\n")
-
-	if !InitProvedStatements(*pubPolicyKey, evp.FactAssertion, alreadyProved) {
-		fmt.Printf("ValidateKeystoneEvidence: Can't InitProvedStatements\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\nValidateKeystoneEvidence, after InitProved:\n")
-	PrintProvedStatements(alreadyProved)
-
-	// ConstructProofFromSevPlatformEvidence()
-	toProve, proof := ConstructProofFromKeystoneEvidence(pubPolicyKey, purpose, alreadyProved)
-	if toProve == nil || proof == nil {
-		fmt.Printf("ValidateKeystoneEvidence: Can't construct proof\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\n")
-	fmt.Printf("ValidateKeystoneEvidence, toProve: ")
-	PrintVseClause(toProve)
-	fmt.Printf("\n")
-	PrintProof(proof)
-	fmt.Printf("\n")
-
-	if !VerifyProof(pubPolicyKey, toProve, proof, alreadyProved) {
-		fmt.Printf("ValidateKeystoneEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("ValidateKeystoneEvidence: Proof verifies\n")
-	fmt.Printf("\nProved statements\n")
-	PrintProvedStatements(alreadyProved)
-
-	me := alreadyProved.Proved[2]
-	if me.Clause == nil || me.Clause.Subject == nil ||
-		me.Clause.Subject.GetEntityType() != "measurement" {
-		fmt.Printf("ValidateKeystoneEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	return true, toProve, me.Clause.Subject.Measurement
+	originalPolicy *certprotos.ProvedStatements, purpose string) (*ValidationResult, error) {
+	v := &builtinVerifier{FilterKeystonePolicy, ConstructProofFromKeystoneEvidence}
+	return ValidateEvidenceWithVerifier(v, pubPolicyKey, evp, originalPolicy, purpose)
 }
 
 func FilterIsletPolicy(policyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
@@ -3089,65 +2827,10 @@ func ConstructProofFromIsletEvidence(publicPolicyKey *certprotos.KeyMessage, pur
 	return toProve, proof
 }
 
-// returns success, toProve, measurement
+// ValidateIsletEvidence validates islet-evidence evidence with
+// ValidateEvidenceWithVerifier.
 func ValidateIsletEvidence(pubPolicyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
-	originalPolicy *certprotos.ProvedStatements, purpose string) (bool,
-	*certprotos.VseClause, []byte) {
-
-	// Debug
-	fmt.Printf("\nValidateIsletEvidence, Original policy:\n")
-	PrintProvedStatements(originalPolicy)
-
-	alreadyProved := FilterIsletPolicy(pubPolicyKey, evp, originalPolicy)
-	if alreadyProved == nil {
-		fmt.Printf("ValidateIsletEvidence: Can't filterpolicy\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\nfiltered policy:\n")
-	PrintProvedStatements(alreadyProved)
-	fmt.Printf("\n")
-
-	if !InitProvedStatements(*pubPolicyKey, evp.FactAssertion, alreadyProved) {
-		fmt.Printf("ValidateIsletEvidence: Can't InitProvedStatements\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\nValidateIsletEvidence, after InitProved:\n")
-	PrintProvedStatements(alreadyProved)
-
-	toProve, proof := ConstructProofFromIsletEvidence(pubPolicyKey, purpose, alreadyProved)
-	if toProve == nil || proof == nil {
-		fmt.Printf("ValidateKeystoneEvidence: Can't construct proof\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("\n")
-	fmt.Printf("ValidateIsletEvidence, toProve: ")
-	PrintVseClause(toProve)
-	fmt.Printf("\n")
-	PrintProof(proof)
-	fmt.Printf("\n")
-
-	if !VerifyProof(pubPolicyKey, toProve, proof, alreadyProved) {
-		fmt.Printf("ValidateIsletEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	// Debug
-	fmt.Printf("ValidateIsletEvidence: Proof verifies\n")
-	fmt.Printf("\nProved statements\n")
-	PrintProvedStatements(alreadyProved)
-
-	me := alreadyProved.Proved[2]
-	if me.Clause == nil || me.Clause.Subject == nil ||
-		me.Clause.Subject.GetEntityType() != "measurement" {
-		fmt.Printf("ValidateIsletEvidence: Proof does not verify\n")
-		return false, nil, nil
-	}
-
-	return true, toProve, me.Clause.Subject.Measurement
+	originalPolicy *certprotos.ProvedStatements, purpose string) (*ValidationResult, error) {
+	v := &builtinVerifier{FilterIsletPolicy, ConstructProofFromIsletEvidence}
+	return ValidateEvidenceWithVerifier(v, pubPolicyKey, evp, originalPolicy, purpose)
 }
@@ -0,0 +1,255 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certlib
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+)
+
+// Platforms plug into the certifier at two points.  An EvidenceParser turns
+// one entry of an evidence package (keyed by Evidence.EvidenceType, e.g.
+// "sev-attestation") into proved statements for InitProvedStatements.  An
+// EvidenceVerifier handles a submitted evidence type (keyed by
+// TrustRequestMessage.SubmittedEvidenceType, e.g. "sev-platform-package")
+// and supplies the policy filter, proof construction and validation.
+//
+// The built in platforms register themselves below.  Another platform can
+// be added from its own package by calling RegisterEvidenceParser and
+// RegisterEvidenceVerifier from an init function.
+
+// EvidenceParseState is passed to each EvidenceParser.  EvidenceList is the
+// whole evidence package and Index is the position of the entry being parsed,
+// so a parser can look at earlier entries (e.g. an endorsement cert chain).
+type EvidenceParseState struct {
+	PolicyKey    *certprotos.KeyMessage
+	EvidenceList []*certprotos.Evidence
+	Index        int
+	SeenList     *CertSeenList
+	// Certs verified so far, for the ValidationResult.
+	Certs []*x509.Certificate
+	// The attestation_user_data of the attestations verified so far, for
+	// the ValidationResult.
+	UserData []*certprotos.AttestationUserData
+}
+
+// EvidenceParser verifies ev and appends the statements it establishes to ps.
+// It should return a *ValidationError saying which stage failed; other
+// errors are reported as StageEvidence.
+type EvidenceParser func(st *EvidenceParseState, ev *certprotos.Evidence,
+	ps *certprotos.ProvedStatements) error
+
+// EvidenceVerifier is implemented for each submitted evidence type.
+type EvidenceVerifier interface {
+	// FilterPolicy returns the policy statements relevant to evp.
+	FilterPolicy(policyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
+		original *certprotos.ProvedStatements) *certprotos.ProvedStatements
+
+	// ConstructProof returns the statement to prove for purpose and its
+	// proof from the statements in alreadyProved.
+	ConstructProof(policyKey *certprotos.KeyMessage, purpose string,
+		alreadyProved *certprotos.ProvedStatements) (*certprotos.VseClause, *certprotos.Proof)
+
+	// Validate returns what the evidence proves, or a *ValidationError
+	// saying why it doesn't satisfy the policy.  Most verifiers can use
+	// ValidateEvidenceWithVerifier.
+	Validate(policyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
+		originalPolicy *certprotos.ProvedStatements, purpose string) (*ValidationResult, error)
+}
+
+var registryLock sync.RWMutex
+var evidenceParsers = map[string]EvidenceParser{}
+var evidenceVerifiers = map[string]EvidenceVerifier{}
+
+// RegisterEvidenceParser adds the parser for an evidence type.
+func RegisterEvidenceParser(evidenceType string, p EvidenceParser) error {
+	if evidenceType == "" || p == nil {
+		return errors.New("RegisterEvidenceParser: empty evidence type or parser")
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := evidenceParsers[evidenceType]; ok {
+		return fmt.Errorf("RegisterEvidenceParser: %s already registered", evidenceType)
+	}
+	evidenceParsers[evidenceType] = p
+	return nil
+}
+
+// FindEvidenceParser returns nil if evidenceType is not registered.
+func FindEvidenceParser(evidenceType string) EvidenceParser {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return evidenceParsers[evidenceType]
+}
+
+// RegisterEvidenceVerifier adds the verifier for a submitted evidence type.
+func RegisterEvidenceVerifier(evidenceType string, v EvidenceVerifier) error {
+	if evidenceType == "" || v == nil {
+		return errors.New("RegisterEvidenceVerifier: empty evidence type or verifier")
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := evidenceVerifiers[evidenceType]; ok {
+		return fmt.Errorf("RegisterEvidenceVerifier: %s already registered", evidenceType)
+	}
+	evidenceVerifiers[evidenceType] = v
+	return nil
+}
+
+// FindEvidenceVerifier returns nil if evidenceType is not registered.
+func FindEvidenceVerifier(evidenceType string) EvidenceVerifier {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return evidenceVerifiers[evidenceType]
+}
+
+// RegisteredEvidenceVerifiers returns the submitted evidence types, sorted.
+func RegisteredEvidenceVerifiers() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	var types []string
+	for t := range evidenceVerifiers {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ValidateEvidence dispatches to the verifier registered for evidenceType.
+func ValidateEvidence(evidenceType string, pubPolicyKey *certprotos.KeyMessage,
+	evp *certprotos.EvidencePackage, originalPolicy *certprotos.ProvedStatements,
+	purpose string) (*ValidationResult, error) {
+
+	v := FindEvidenceVerifier(evidenceType)
+	if v == nil {
+		return nil, newValidationError(StageParse, "no verifier for %s", evidenceType)
+	}
+	return v.Validate(pubPolicyKey, evp, originalPolicy, purpose)
+}
+
+// ValidateEvidenceWithVerifier runs the usual steps with v: filter the
+// policy, add the evidence with InitProvedStatements, construct the proof
+// and verify it.  The proof must conclude that a measurement is trusted.
+func ValidateEvidenceWithVerifier(v EvidenceVerifier, pubPolicyKey *certprotos.KeyMessage,
+	evp *certprotos.EvidencePackage, originalPolicy *certprotos.ProvedStatements,
+	purpose string) (*ValidationResult, error) {
+
+	// Debug
+	fmt.Printf("\nValidateEvidence, original policy:\n")
+	PrintProvedStatements(originalPolicy)
+
+	alreadyProved := v.FilterPolicy(pubPolicyKey, evp, originalPolicy)
+	if alreadyProved == nil {
+		return nil, newValidationError(StagePolicyFilter, "can't filter policy")
+	}
+	policy := alreadyProved.Proved
+
+	// Debug
+	fmt.Printf("\nValidateEvidence, filtered policy:\n")
+	PrintProvedStatements(alreadyProved)
+
+	st, err := initProvedStatements(pubPolicyKey, evp.FactAssertion, alreadyProved)
+	if err != nil {
+		return nil, err
+	}
+
+	// Debug
+	fmt.Printf("\nValidateEvidence, after InitProved:\n")
+	PrintProvedStatements(alreadyProved)
+
+	toProve, proof := v.ConstructProof(pubPolicyKey, purpose, alreadyProved)
+	if toProve == nil || proof == nil {
+		return nil, newValidationError(StageProof, "can't construct proof")
+	}
+
+	// Debug
+	fmt.Printf("\nValidateEvidence, toProve: ")
+	PrintVseClause(toProve)
+	fmt.Printf("\n")
+	PrintProof(proof)
+	fmt.Printf("\n")
+
+	nProved := len(alreadyProved.Proved)
+	if err := VerifyProof(pubPolicyKey, toProve, proof, alreadyProved); err != nil {
+		return nil, err
+	}
+
+	// Debug
+	fmt.Printf("ValidateEvidence: Proof verifies\n")
+
+	return newValidationResult(toProve, proof, policy, alreadyProved.Proved[nProved:], st)
+}
+
+// builtinVerifier adapts the Filter and ConstructProofFrom functions of a
+// built in platform to EvidenceVerifier.
+type builtinVerifier struct {
+	filter    func(*certprotos.KeyMessage, *certprotos.EvidencePackage, *certprotos.ProvedStatements) *certprotos.ProvedStatements
+	construct func(*certprotos.KeyMessage, string, *certprotos.ProvedStatements) (*certprotos.VseClause, *certprotos.Proof)
+}
+
+func (b *builtinVerifier) FilterPolicy(policyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
+	original *certprotos.ProvedStatements) *certprotos.ProvedStatements {
+	return b.filter(policyKey, evp, original)
+}
+
+func (b *builtinVerifier) ConstructProof(policyKey *certprotos.KeyMessage, purpose string,
+	alreadyProved *certprotos.ProvedStatements) (*certprotos.VseClause, *certprotos.Proof) {
+	return b.construct(policyKey, purpose, alreadyProved)
+}
+
+func (b *builtinVerifier) Validate(policyKey *certprotos.KeyMessage, evp *certprotos.EvidencePackage,
+	originalPolicy *certprotos.ProvedStatements, purpose string) (*ValidationResult, error) {
+	return ValidateEvidenceWithVerifier(b, policyKey, evp, originalPolicy, purpose)
+}
+
+func init() {
+	parsers := map[string]EvidenceParser{
+		"signed-claim":                  parseSignedClaimEvidence,
+		"pem-cert-chain":                parsePemCertChainEvidence,
+		"gramine-attestation":           parseGramineAttestationEvidence,
+		"oe-attestation-report":         parseOeAttestationReportEvidence,
+		"islet-attestation":             parseIsletAttestationEvidence,
+		"keystone-attestation":          parseKeystoneAttestationEvidence,
+		"sev-attestation":               parseSevAttestationEvidence,
+		"cert":                          parseCertEvidence,
+		"signed-vse-attestation-report": parseSignedVseAttestationReportEvidence,
+	}
+	for t, p := range parsers {
+		RegisterEvidenceParser(t, p)
+	}
+
+	verifiers := map[string]EvidenceVerifier{
+		"vse-attestation-package": &builtinVerifier{FilterInternalPolicy,
+			ConstructProofFromInternalPlatformEvidence},
+		"sev-platform-package": &builtinVerifier{FilterSevPolicy,
+			ConstructProofFromSevPlatformEvidence},
+		"oe-evidence": &builtinVerifier{FilterOePolicy,
+			ConstructProofFromOeEvidence},
+		"gramine-evidence": &builtinVerifier{FilterGraminePolicy,
+			ConstructProofFromGramineEvidence},
+		"keystone-evidence": &builtinVerifier{FilterKeystonePolicy,
+			ConstructProofFromKeystoneEvidence},
+		"islet-evidence": &builtinVerifier{FilterIsletPolicy,
+			ConstructProofFromIsletEvidence},
+	}
+	for t, v := range verifiers {
+		RegisterEvidenceVerifier(t, v)
+	}
+}
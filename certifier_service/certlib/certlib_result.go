@@ -0,0 +1,181 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certlib
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+
+	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+)
+
+// ValidationResult is what validating an evidence package established.
+// Everything in it was verified, so issuance, logging and authorization
+// checks can use it without parsing the evidence again.
+type ValidationResult struct {
+	// The statement proved, e.g. "enclaveKey is-trusted-for-authentication".
+	Statement *certprotos.VseClause
+	// The measurement the proof concluded is trusted.
+	Measurement []byte
+	// The attested platform and its properties, nil for platforms that
+	// don't report them.
+	Platform *certprotos.Platform
+	// The policy statements the proof used.
+	PolicyStatements []*certprotos.VseClause
+	// The certs the evidence was verified with, in the order given.
+	CertChain []*x509.Certificate
+	// The attestation_user_data of the attestations verified, in order.
+	UserData []*certprotos.AttestationUserData
+	// The proof and the statements it concluded, in order.
+	Proof     *certprotos.Proof
+	Concluded []*certprotos.VseClause
+}
+
+// EnclaveKey returns the key the statement is about, or nil.
+func (r *ValidationResult) EnclaveKey() *certprotos.KeyMessage {
+	if r == nil || r.Statement == nil || r.Statement.Subject == nil {
+		return nil
+	}
+	return r.Statement.Subject.Key
+}
+
+// AttestedUserData returns the attestation_user_data that names the
+// enclave key, or nil if no verified attestation does.
+func (r *ValidationResult) AttestedUserData() *certprotos.AttestationUserData {
+	enclaveKey := r.EnclaveKey()
+	if enclaveKey == nil {
+		return nil
+	}
+	for _, ud := range r.UserData {
+		if ud.EnclaveKey != nil && SameKey(ud.EnclaveKey, enclaveKey) {
+			return ud
+		}
+	}
+	return nil
+}
+
+// PlatformType returns the type of the attested platform, e.g.
+// "amd-sev-snp", or "" if there is none.
+func (r *ValidationResult) PlatformType() string {
+	if r == nil {
+		return ""
+	}
+	return r.Platform.GetPlatformType()
+}
+
+// PlatformProperties returns the properties of the attested platform by
+// name, or nil if there is none.
+func (r *ValidationResult) PlatformProperties() map[string]string {
+	if r == nil || r.Platform == nil {
+		return nil
+	}
+	props := map[string]string{}
+	for _, p := range r.Platform.GetProps().GetProps() {
+		if p.GetValueType() == "int" {
+			props[p.GetPropertyName()] = strconv.FormatUint(p.GetIntValue(), 10)
+		} else {
+			props[p.GetPropertyName()] = p.GetStringValue()
+		}
+	}
+	return props
+}
+
+// newValidationResult collects the result of a verified proof.  policy is
+// the filtered policy, concluded the statements VerifyProof added and st
+// the state the evidence was parsed with.
+func newValidationResult(toProve *certprotos.VseClause, proof *certprotos.Proof,
+	policy []*certprotos.VseClause, concluded []*certprotos.VseClause,
+	st *EvidenceParseState) (*ValidationResult, error) {
+
+	r := &ValidationResult{
+		Statement: toProve,
+		CertChain: st.Certs,
+		UserData:  st.UserData,
+		Proof:     proof,
+		Concluded: concluded,
+	}
+	for _, c := range concluded {
+		if c.Clause != nil || c.Subject == nil {
+			continue
+		}
+		switch c.Subject.GetEntityType() {
+		case "measurement":
+			if r.Measurement == nil && c.GetVerb() == "is-trusted" {
+				r.Measurement = c.Subject.Measurement
+			}
+		case "environment":
+			if r.Platform == nil {
+				r.Platform = c.Subject.GetEnvironmentEnt().GetThePlatform()
+			}
+		}
+	}
+	if r.Measurement == nil {
+		return nil, newValidationError(StageMeasurement, "proof doesn't conclude a trusted measurement")
+	}
+
+	// The policy statements are the premises of the steps that concluded
+	// something, other than the axiom.
+	used := &certprotos.ProvedStatements{}
+	conclusions := &certprotos.ProvedStatements{Proved: concluded}
+	for _, step := range proof.Steps {
+		if !StatementAlreadyProved(step.Conclusion, conclusions) {
+			continue
+		}
+		for _, s := range []*certprotos.VseClause{step.S1, step.S2} {
+			if s.GetVerb() != "says" || StatementAlreadyProved(s, used) {
+				continue
+			}
+			for _, p := range policy {
+				if SameVseClause(s, p) {
+					used.Proved = append(used.Proved, s)
+					break
+				}
+			}
+		}
+	}
+	r.PolicyStatements = used.Proved
+	return r, nil
+}
+
+// PrintValidationResult prints r.
+func PrintValidationResult(r *ValidationResult) {
+	fmt.Printf("Proved: ")
+	PrintVseClause(r.Statement)
+	fmt.Printf("\nMeasurement: %s\n", hex.EncodeToString(r.Measurement))
+	if r.Platform != nil {
+		fmt.Printf("Platform: %s\n", r.Platform.GetPlatformType())
+		props := r.PlatformProperties()
+		var names []string
+		for name := range props {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("    %s: %s\n", name, props[name])
+		}
+	}
+	fmt.Printf("Policy statements used:\n")
+	for _, s := range r.PolicyStatements {
+		fmt.Printf("    ")
+		PrintVseClause(s)
+		fmt.Printf("\n")
+	}
+	for _, c := range r.CertChain {
+		fmt.Printf("Cert: %s, issued by %s\n", c.Subject.String(), c.Issuer.String())
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/rand"
@@ -29,12 +30,19 @@ import (
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	b64 "encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+	"golang.org/x/crypto/ocsp"
 	"google.golang.org/protobuf/proto"
+	"io"
+	"math"
 	"math/big"
 	"net"
+	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 	"time"
 	// oeverify   "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/oeverify"
@@ -443,6 +451,83 @@ func GetInternalKeyFromEccPublicKey(name string, PK *ecdsa.PublicKey, km *certpr
 	return true
 }
 
+func GetInternalKeyFromEccPrivateKey(name string, pK *ecdsa.PrivateKey, km *certprotos.KeyMessage) bool {
+	if !GetInternalKeyFromEccPublicKey(name, &pK.PublicKey, km) {
+		return false
+	}
+	var kt string
+	if km.GetKeyType() == "ecc-256-public" {
+		kt = "ecc-256-private"
+	} else {
+		kt = "ecc-384-private"
+	}
+	km.KeyType = &kt
+	byteSize := (pK.Curve.Params().BitSize + 7) / 8
+	km.EccKey.PrivateMultiplier = pK.D.FillBytes(make([]byte, byteSize))
+	return true
+}
+
+// GetEd25519KeysFromInternal returns the private key in k, if it is an
+// "ed25519-private" key, and the public key.
+func GetEd25519KeysFromInternal(k *certprotos.KeyMessage) (ed25519.PrivateKey, ed25519.PublicKey, error) {
+	if k == nil || k.Ed25519Key == nil {
+		fmt.Printf("GetEd25519KeysFromInternal: no ed25519 key\n")
+		return nil, nil, errors.New("Ed25519Key")
+	}
+	if len(k.Ed25519Key.PublicKey) != ed25519.PublicKeySize {
+		fmt.Printf("GetEd25519KeysFromInternal: bad public key\n")
+		return nil, nil, errors.New("Ed25519Key")
+	}
+	PK := ed25519.PublicKey(k.Ed25519Key.PublicKey)
+	if k.GetKeyType() == "ed25519-public" {
+		return nil, PK, nil
+	} else if k.GetKeyType() == "ed25519-private" {
+		if len(k.Ed25519Key.PrivateKey) != ed25519.SeedSize {
+			fmt.Printf("GetEd25519KeysFromInternal: bad private key\n")
+			return nil, nil, errors.New("Ed25519Key")
+		}
+		pK := ed25519.NewKeyFromSeed(k.Ed25519Key.PrivateKey)
+		if !bytes.Equal(pK.Public().(ed25519.PublicKey), PK) {
+			fmt.Printf("GetEd25519KeysFromInternal: private key doesn't match public key\n")
+			return nil, nil, errors.New("Ed25519Key")
+		}
+		return pK, PK, nil
+	} else {
+		fmt.Printf("GetEd25519KeysFromInternal: Wrong key type %s\n", k.GetKeyType())
+		return nil, nil, errors.New("Ed25519Key")
+	}
+}
+
+func GetInternalKeyFromEd25519PublicKey(name string, PK ed25519.PublicKey, km *certprotos.KeyMessage) bool {
+	if len(PK) != ed25519.PublicKeySize {
+		fmt.Printf("GetInternalKeyFromEd25519PublicKey: bad key size (%d)\n", len(PK))
+		return false
+	}
+	km.KeyName = &name
+	format := "vse-key"
+	km.KeyFormat = &format
+	kt := "ed25519-public"
+	km.KeyType = &kt
+	km.Ed25519Key = &certprotos.Ed25519Message{
+		PublicKey: append([]byte(nil), PK...),
+	}
+	return true
+}
+
+func GetInternalKeyFromEd25519PrivateKey(name string, pK ed25519.PrivateKey, km *certprotos.KeyMessage) bool {
+	if len(pK) != ed25519.PrivateKeySize {
+		fmt.Printf("GetInternalKeyFromEd25519PrivateKey: bad key size (%d)\n", len(pK))
+		return false
+	}
+	if !GetInternalKeyFromEd25519PublicKey(name, pK.Public().(ed25519.PublicKey), km) {
+		return false
+	}
+	kt := "ed25519-private"
+	km.KeyType = &kt
+	km.Ed25519Key.PrivateKey = append([]byte(nil), pK.Seed()...)
+	return true
+}
+
 func GetRsaKeysFromInternal(k *certprotos.KeyMessage, pK *rsa.PrivateKey, PK *rsa.PublicKey) bool {
 	PK.N = &big.Int{}
 	PK.N.SetBytes(k.RsaKey.PublicModulus)
@@ -467,6 +552,8 @@ func GetInternalKeyFromRsaPublicKey(name string, PK *rsa.PublicKey, km *certprot
 		kt = "rsa-1024-public"
 	} else if modLen == 256 {
 		kt = "rsa-2048-public"
+	} else if modLen == 384 {
+		kt = "rsa-3072-public"
 	} else if modLen == 512 {
 		kt = "rsa-4096-public"
 	} else {
@@ -493,10 +580,45 @@ func GetInternalKeyFromRsaPrivateKey(name string, pK *rsa.PrivateKey, km *certpr
 
 func InternalPublicFromPrivateKey(privateKey *certprotos.KeyMessage) *certprotos.KeyMessage {
 	var kt string
+	if privateKey.GetKeyType() == "ecc-256-private" || privateKey.GetKeyType() == "ecc-384-private" {
+		if privateKey.GetEccKey() == nil {
+			return nil
+		}
+		kt = strings.TrimSuffix(privateKey.GetKeyType(), "-private") + "-public"
+		publicKey := certprotos.KeyMessage{}
+		publicKey.KeyType = &kt
+		publicKey.KeyName = privateKey.KeyName
+		publicKey.KeyFormat = privateKey.KeyFormat
+		publicKey.EccKey = proto.Clone(privateKey.GetEccKey()).(*certprotos.EccMessage)
+		publicKey.EccKey.PrivateMultiplier = nil
+		publicKey.Certificate = privateKey.Certificate
+		publicKey.NotBefore = privateKey.NotBefore
+		publicKey.NotAfter = privateKey.NotAfter
+		return &publicKey
+	}
+	if privateKey.GetKeyType() == "ed25519-private" {
+		if privateKey.GetEd25519Key() == nil {
+			return nil
+		}
+		kt = "ed25519-public"
+		publicKey := certprotos.KeyMessage{}
+		publicKey.KeyType = &kt
+		publicKey.KeyName = privateKey.KeyName
+		publicKey.KeyFormat = privateKey.KeyFormat
+		publicKey.Ed25519Key = &certprotos.Ed25519Message{
+			PublicKey: privateKey.GetEd25519Key().PublicKey,
+		}
+		publicKey.Certificate = privateKey.Certificate
+		publicKey.NotBefore = privateKey.NotBefore
+		publicKey.NotAfter = privateKey.NotAfter
+		return &publicKey
+	}
 	if privateKey.GetKeyType() == "rsa-1024-private" {
 		kt = "rsa-1024-public"
 	} else if privateKey.GetKeyType() == "rsa-2048-private" {
 		kt = "rsa-2048-public"
+	} else if privateKey.GetKeyType() == "rsa-3072-private" {
+		kt = "rsa-3072-public"
 	} else if privateKey.GetKeyType() == "rsa-4096-private" {
 		kt = "rsa-4096-public"
 	} else {
@@ -539,6 +661,8 @@ func MakeVseRsaKey(n int) *certprotos.KeyMessage {
 		kf = "rsa-1024-private"
 	} else if n == 2048 {
 		kf = "rsa-2048-private"
+	} else if n == 3072 {
+		kf = "rsa-3072-private"
 	} else if n == 4096 {
 		kf = "rsa-4096-private"
 	} else {
@@ -551,6 +675,46 @@ func MakeVseRsaKey(n int) *certprotos.KeyMessage {
 	return &km
 }
 
+func MakeEccKey(n int) *ecdsa.PrivateKey {
+	var curve elliptic.Curve
+	if n == 256 {
+		curve = elliptic.P256()
+	} else if n == 384 {
+		curve = elliptic.P384()
+	} else {
+		return nil
+	}
+	pK, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil
+	}
+	return pK
+}
+
+func MakeVseEccKey(n int) *certprotos.KeyMessage {
+	pK := MakeEccKey(n)
+	if pK == nil {
+		return nil
+	}
+	km := certprotos.KeyMessage{}
+	if GetInternalKeyFromEccPrivateKey("generatedKey", pK, &km) == false {
+		return nil
+	}
+	return &km
+}
+
+func MakeVseEd25519Key() *certprotos.KeyMessage {
+	_, pK, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	km := certprotos.KeyMessage{}
+	if GetInternalKeyFromEd25519PrivateKey("generatedKey", pK, &km) == false {
+		return nil
+	}
+	return &km
+}
+
 func RsaPublicEncrypt(r *rsa.PublicKey, in []byte) []byte {
 	return nil
 }
@@ -692,8 +856,12 @@ func SameKey(k1 *certprotos.KeyMessage, k2 *certprotos.KeyMessage) bool {
 		return false
 	}
 	if k1.GetKeyType() == "rsa-2048-private" || k1.GetKeyType() == "rsa-2048-public" ||
+		k1.GetKeyType() == "rsa-3072-private" || k1.GetKeyType() == "rsa-3072-public" ||
 		k1.GetKeyType() == "rsa-4096-private" || k1.GetKeyType() == "rsa-4096-public" ||
 		k1.GetKeyType() == "rsa-1024-private" || k1.GetKeyType() == "rsa-1024-public" {
+		if k1.RsaKey == nil || k2.RsaKey == nil {
+			return false
+		}
 		return bytes.Equal(k1.RsaKey.PublicModulus, k2.RsaKey.PublicModulus) &&
 			bytes.Equal(k1.RsaKey.PublicExponent, k2.RsaKey.PublicExponent)
 	}
@@ -715,6 +883,12 @@ func SameKey(k1 *certprotos.KeyMessage, k2 *certprotos.KeyMessage) bool {
 		return SamePoint(k1.EccKey.BasePoint, k2.EccKey.BasePoint) &&
 			SamePoint(k1.EccKey.PublicPoint, k2.EccKey.PublicPoint)
 	}
+	if k1.GetKeyType() == "ed25519-private" || k1.GetKeyType() == "ed25519-public" {
+		if k1.Ed25519Key == nil || k2.Ed25519Key == nil || k1.Ed25519Key.PublicKey == nil {
+			return false
+		}
+		return bytes.Equal(k1.Ed25519Key.PublicKey, k2.Ed25519Key.PublicKey)
+	}
 	return false
 }
 
@@ -861,6 +1035,19 @@ func PrintEccKey(e *certprotos.EccMessage) {
 	}
 }
 
+func PrintEd25519Key(e *certprotos.Ed25519Message) {
+	if e.PublicKey != nil {
+		fmt.Printf("Public key: ")
+		PrintBytes(e.PublicKey)
+		fmt.Printf("\n")
+	}
+	if e.PrivateKey != nil {
+		fmt.Printf("Private key: ")
+		PrintBytes(e.PrivateKey)
+		fmt.Printf("\n")
+	}
+}
+
 func PrintRsaKey(r *certprotos.RsaMessage) {
 	if len(r.GetPublicModulus()) > 0 {
 		fmt.Printf("Public Modulus : ")
@@ -908,6 +1095,7 @@ func PrintKey(k *certprotos.KeyMessage) {
 	}
 
 	if k.GetKeyType() == "rsa-1024-public" || k.GetKeyType() == "rsa-2048-public" ||
+		k.GetKeyType() == "rsa-3072-public" || k.GetKeyType() == "rsa-3072-private" ||
 		k.GetKeyType() == "rsa-4096-public" || k.GetKeyType() == "rsa-1024-private" ||
 		k.GetKeyType() == "rsa-2048-private" || k.GetKeyType() == "rsa-4096-private" {
 		if k.GetRsaKey() != nil {
@@ -918,6 +1106,10 @@ func PrintKey(k *certprotos.KeyMessage) {
 		if k.EccKey != nil {
 			PrintEccKey(k.EccKey)
 		}
+	} else if k.GetKeyType() == "ed25519-public" || k.GetKeyType() == "ed25519-private" {
+		if k.Ed25519Key != nil {
+			PrintEd25519Key(k.Ed25519Key)
+		}
 	} else {
 		fmt.Printf("Unknown key type\n")
 	}
@@ -930,6 +1122,7 @@ func PrintKeyDescriptor(k *certprotos.KeyMessage) {
 	}
 
 	if k.GetKeyType() == "rsa-2048-private" || k.GetKeyType() == "rsa-2048-public" ||
+		k.GetKeyType() == "rsa-3072-private" || k.GetKeyType() == "rsa-3072-public" ||
 		k.GetKeyType() == "rsa-4096-private" || k.GetKeyType() == "rsa-4096-public" ||
 		k.GetKeyType() == "rsa-1024-private" || k.GetKeyType() == "rsa-1024-public" {
 		fmt.Printf("Key[rsa, ")
@@ -956,6 +1149,16 @@ func PrintKeyDescriptor(k *certprotos.KeyMessage) {
 		}
 		fmt.Printf("]")
 	}
+	if k.GetKeyType() == "ed25519-private" || k.GetKeyType() == "ed25519-public" {
+		fmt.Printf("Key[ed25519, ")
+		if k.GetKeyName() != "" {
+			fmt.Printf("%s, ", k.GetKeyName())
+		}
+		if k.GetEd25519Key() != nil {
+			PrintBytes(k.GetEd25519Key().GetPublicKey())
+		}
+		fmt.Printf("]")
+	}
 	return
 }
 
@@ -1122,39 +1325,35 @@ func MakeClaim(serialized []byte, format string, desc string, nb string, na stri
 	return &c
 }
 
+// MakeSignedClaim signs s with the private key k using the usual
+// algorithm for k (SigningAlgorithmForKey).
 func MakeSignedClaim(s *certprotos.ClaimMessage, k *certprotos.KeyMessage) *certprotos.SignedClaimMessage {
-	if k.GetKeyType() == "" {
+	return MakeSignedClaimWithAlgorithm(s, k, SigningAlgorithmForKey(k))
+}
+
+// MakeSignedClaimWithAlgorithm signs s with the private key k using alg,
+// e.g. "rsa-3072-sha384-pss-sign", which must suit k.
+func MakeSignedClaimWithAlgorithm(s *certprotos.ClaimMessage, k *certprotos.KeyMessage,
+	alg string) *certprotos.SignedClaimMessage {
+	if !strings.HasSuffix(k.GetKeyType(), "-private") {
 		return nil
 	}
 	sm := certprotos.SignedClaimMessage{}
-	if k.GetKeyType() == "rsa-1024-private" {
-		var ss string = "rsa-1024-sha256-pkcs-sign"
-		sm.SigningAlgorithm = &ss
-	} else if k.GetKeyType() == "rsa-2048-private" {
-		var ss string = "rsa-2048-sha256-pkcs-sign"
-		sm.SigningAlgorithm = &ss
-	} else if k.GetKeyType() == "rsa-4096-private" {
-		var ss string = "rsa-4096-sha384-pkcs-sign"
-		sm.SigningAlgorithm = &ss
-	} else {
-		return nil
-	}
+	sm.SigningAlgorithm = &alg
 
 	psk := InternalPublicFromPrivateKey(k)
-	sm.SigningKey = psk
-
-	PK := rsa.PublicKey{}
-	pK := rsa.PrivateKey{}
-	if GetRsaKeysFromInternal(k, &pK, &PK) == false {
+	if psk == nil {
 		return nil
 	}
+	sm.SigningKey = psk
+
 	// now sign it
 	ser, err := proto.Marshal(s)
 	if err != nil {
 		return nil
 	}
 	sm.SerializedClaimMessage = ser
-	sig := RsaSha256Sign(&pK, ser)
+	sig := SignWithKey(alg, k, ser)
 	if sig == nil {
 		return nil
 	}
@@ -1478,14 +1677,34 @@ func GetVseFromSignedClaim(sc *certprotos.SignedClaimMessage) *certprotos.VseCla
 	return &vseClause
 }
 
+// MaxSizedSocketMessage is the largest message SizedSocketRead accepts.
+const MaxSizedSocketMessage = 16 * 1024 * 1024
+
+// SizedSocketRead reads a message sent by SizedSocketWrite: its size as 4
+// little-endian bytes, then the message.
 func SizedSocketRead(conn net.Conn) []byte {
+	return SizedSocketReadMax(conn, MaxSizedSocketMessage)
+}
+
+// SizedSocketReadMax is SizedSocketRead, refusing messages over maxSize
+// bytes before allocating for them.  A maxSize of 0 means
+// MaxSizedSocketMessage.
+func SizedSocketReadMax(conn net.Conn, maxSize int) []byte {
+	if maxSize <= 0 {
+		maxSize = MaxSizedSocketMessage
+	}
+	// A TLS conn may return the size in a short read, so read it fully.
 	bsize := make([]byte, 4)
-	n, err := conn.Read(bsize)
+	n, err := io.ReadFull(conn, bsize)
 	if err != nil {
 		fmt.Printf("SizedSocketRead, error: %d\n", n)
 		return nil
 	}
-	size := int(bsize[0]) + 256*int(bsize[1]) + 256*256*int(bsize[2])
+	size := int(binary.LittleEndian.Uint32(bsize))
+	if size > maxSize {
+		fmt.Printf("SizedSocketRead, message of %d bytes is over the limit of %d\n", size, maxSize)
+		return nil
+	}
 	b := make([]byte, size)
 	total := 0
 	for total < size {
@@ -1499,13 +1718,15 @@ func SizedSocketRead(conn net.Conn) []byte {
 	return b
 }
 
+// SizedSocketWrite sends b with its size, as SizedSocketRead reads it.  The
+// C++ side reads the size as an int, so b must be under 2GB.
 func SizedSocketWrite(conn net.Conn, b []byte) bool {
-	size := len(b)
+	if int64(len(b)) > math.MaxInt32 {
+		fmt.Printf("SizedSocketWrite, message of %d bytes is too big\n", len(b))
+		return false
+	}
 	bs := make([]byte, 4)
-	bs[0] = byte(size & 0xff)
-	bs[1] = byte((size >> 8) & 0xff)
-	bs[2] = byte((size >> 16) & 0xff)
-	bs[3] = 0
+	binary.LittleEndian.PutUint32(bs, uint32(len(b)))
 	_, err := conn.Write(bs)
 	if err != nil {
 		fmt.Printf("SizedSocketWrite error(1)\n")
@@ -1575,11 +1796,12 @@ func MakeEnvironment(pl *certprotos.Platform, measurement []byte) *certprotos.En
 	return e
 }
 
+// VerifySignedClaim checks the signature on c with k using the algorithm
+// named in c, which must suit k.
 func VerifySignedClaim(c *certprotos.SignedClaimMessage, k *certprotos.KeyMessage) bool {
-	PK := rsa.PublicKey{}
-	pK := rsa.PrivateKey{}
-	if GetRsaKeysFromInternal(k, &pK, &PK) == false {
-		fmt.Printf("VerifySignedClaim: Can't get RSA keys\n")
+	if !SigningAlgorithmSuitsKey(c.GetSigningAlgorithm(), k) {
+		fmt.Printf("VerifySignedClaim: Wrong signing algorithm %s for %s key\n", c.GetSigningAlgorithm(),
+			k.GetKeyType())
 		return false
 	}
 
@@ -1605,12 +1827,7 @@ func VerifySignedClaim(c *certprotos.SignedClaimMessage, k *certprotos.KeyMessag
 		}
 	}
 
-	// I remover the following hack:
-	// || FakeRsaSha256Verify(&PK, c.GetSerializedClaimMessage(), c.GetSignature()) {
-	if RsaSha256Verify(&PK, c.GetSerializedClaimMessage(), c.GetSignature()) {
-		return true
-	}
-	return false
+	return VerifyWithKey(c.GetSigningAlgorithm(), k, c.GetSerializedClaimMessage(), c.GetSignature())
 }
 
 func VerifySignedAssertion(scm certprotos.SignedClaimMessage, k *certprotos.KeyMessage, vseClause *certprotos.VseClause) bool {
@@ -1691,9 +1908,110 @@ func LittleToBigEndian(in []byte) []byte {
 	return out
 }
 
+// AdmissionCertOptions has the optional parts of an admission cert.
+type AdmissionCertOptions struct {
+	// URLs of the CRL for the cert.
+	CrlDistributionPoints []string
+	// URLs of the OCSP responder, put in the AIA extension.
+	OcspServers []string
+	// Profile replaces the usual subject, SANs, usages and constraints.
+	Profile *AdmissionCertProfile
+	// Attestation is put in the attestation extension, with AttestationOid.
+	Attestation    *AttestationInfo
+	AttestationOid asn1.ObjectIdentifier
+}
+
+// AdmissionCertProfile is the subject, SANs, usages and path constraints of
+// an admission cert.  With a profile, subjName and subjOrg are not used and
+// the remote IP is only in the cert if it is in IPAddresses.
+type AdmissionCertProfile struct {
+	CommonName   string
+	Organization string
+	DNSNames     []string
+	URIs         []*url.URL
+	IPAddresses  []net.IP
+	KeyUsage     x509.KeyUsage
+	ExtKeyUsage  []x509.ExtKeyUsage
+	IsCA         bool
+	// Limit on the certs below a CA cert, -1 for none.
+	MaxPathLen int
+}
+
+// The attestation extension of admission certs tells relying parties what
+// was attested.  The extension is not critical and its value is the DER of
+//
+//	AttestationInfo ::= SEQUENCE {
+//	    measurement   OCTET STRING,
+//	    platformType  UTF8String,
+//	    properties    SEQUENCE OF Property }
+//
+//	Property ::= SEQUENCE {
+//	    name   UTF8String,
+//	    value  UTF8String }
+//
+// platformType is the platform named in the evidence, such as
+// "amd-sev-snp", or the submitted evidence type if it names none.
+// Properties are sorted by name.
+//
+// There is no registered OID for the extension.  The certifier is given one
+// under an arc its operator controls, and relying parties must be told it.
+
+type AttestationProperty struct {
+	Name  string `asn1:"utf8"`
+	Value string `asn1:"utf8"`
+}
+
+type AttestationInfo struct {
+	Measurement  []byte
+	PlatformType string `asn1:"utf8"`
+	Properties   []AttestationProperty
+}
+
+// MakeAttestationInfo returns the attestation extension contents for a
+// measurement, platform type and platform properties.
+func MakeAttestationInfo(measurement []byte, platformType string, props map[string]string) *AttestationInfo {
+	info := &AttestationInfo{
+		Measurement:  measurement,
+		PlatformType: platformType,
+		Properties:   []AttestationProperty{},
+	}
+	for name, value := range props {
+		info.Properties = append(info.Properties, AttestationProperty{Name: name, Value: value})
+	}
+	sort.Slice(info.Properties, func(i, j int) bool {
+		return info.Properties[i].Name < info.Properties[j].Name
+	})
+	return info
+}
+
+// GetAttestationInfo returns the attestation extension of cert with the
+// given OID, or nil if it has none or it can't be parsed.
+func GetAttestationInfo(cert *x509.Certificate, oid asn1.ObjectIdentifier) *AttestationInfo {
+	for _, ext := range cert.Extensions {
+		if len(oid) == 0 || !ext.Id.Equal(oid) {
+			continue
+		}
+		info := &AttestationInfo{}
+		rest, err := asn1.Unmarshal(ext.Value, info)
+		if err != nil || len(rest) != 0 {
+			fmt.Printf("GetAttestationInfo: Can't parse attestation extension\n")
+			return nil
+		}
+		return info
+	}
+	return nil
+}
+
 func ProduceAdmissionCert(remoteIP string, issuerKey *certprotos.KeyMessage, issuerCert *x509.Certificate,
 	subjKey *certprotos.KeyMessage, subjName string, subjOrg string,
 	serialNumber uint64, durationSeconds float64) *x509.Certificate {
+	return ProduceAdmissionCertWithOptions(remoteIP, issuerKey, issuerCert, subjKey, subjName, subjOrg,
+		serialNumber, durationSeconds, nil)
+}
+
+func ProduceAdmissionCertWithOptions(remoteIP string, issuerKey *certprotos.KeyMessage, issuerCert *x509.Certificate,
+	subjKey *certprotos.KeyMessage, subjName string, subjOrg string,
+	serialNumber uint64, durationSeconds float64, options *AdmissionCertOptions) *x509.Certificate {
 
 	dur := int64(durationSeconds * 1000 * 1000 * 1000)
 	cert := x509.Certificate{
@@ -1712,21 +2030,52 @@ func ProduceAdmissionCert(remoteIP string, issuerKey *certprotos.KeyMessage, iss
 	if remoteIP != "" {
 		cert.IPAddresses = []net.IP{net.ParseIP(remoteIP)}
 	}
-	spK := rsa.PrivateKey{}
-	sPK := rsa.PublicKey{}
-	if !GetRsaKeysFromInternal(subjKey, &spK, &sPK) {
-		fmt.Printf("ProduceAdmissionCert: Can't get Rsa sunject key\n")
+	if options != nil {
+		cert.CRLDistributionPoints = options.CrlDistributionPoints
+		cert.OCSPServer = options.OcspServers
+		if p := options.Profile; p != nil {
+			cert.Subject = pkix.Name{CommonName: p.CommonName}
+			if p.Organization != "" {
+				cert.Subject.Organization = []string{p.Organization}
+			}
+			cert.DNSNames = p.DNSNames
+			cert.URIs = p.URIs
+			cert.IPAddresses = p.IPAddresses
+			cert.KeyUsage = p.KeyUsage
+			cert.ExtKeyUsage = p.ExtKeyUsage
+			cert.IsCA = p.IsCA
+			if p.IsCA {
+				cert.MaxPathLen = p.MaxPathLen
+				cert.MaxPathLenZero = p.MaxPathLen == 0
+			}
+		}
+		if options.Attestation != nil {
+			if len(options.AttestationOid) == 0 {
+				fmt.Printf("ProduceAdmissionCert: No OID for the attestation extension\n")
+				return nil
+			}
+			value, err := asn1.Marshal(*options.Attestation)
+			if err != nil {
+				fmt.Printf("ProduceAdmissionCert: Can't marshal attestation extension\n")
+				return nil
+			}
+			cert.ExtraExtensions = append(cert.ExtraExtensions,
+				pkix.Extension{Id: options.AttestationOid, Value: value})
+		}
+	}
+	subjPublic := GetPublicKeyFromInternal(subjKey)
+	if subjPublic == nil {
+		fmt.Printf("ProduceAdmissionCert: Can't get subject key\n")
 		return nil
 	}
 
-	ipK := rsa.PrivateKey{}
-	iPK := rsa.PublicKey{}
-	if !GetRsaKeysFromInternal(issuerKey, &ipK, &iPK) {
-		fmt.Printf("ProduceAdmissionCert: Can't get Rsa issuer keys\n")
+	issuerSigner := GetSignerFromInternal(issuerKey)
+	if issuerSigner == nil {
+		fmt.Printf("ProduceAdmissionCert: Can't get issuer key\n")
 		return nil
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &cert, issuerCert, &sPK, crypto.Signer(&ipK))
+	derBytes, err := x509.CreateCertificate(rand.Reader, &cert, issuerCert, subjPublic, issuerSigner)
 	if err != nil {
 		fmt.Printf("ProduceAdmissionCert: Can't Create Certificate\n")
 		return nil
@@ -1771,6 +2120,15 @@ func GetSubjectKey(cert *x509.Certificate) *certprotos.KeyMessage {
 		}
 		return &k
 	}
+	PKed25519, ok := cert.PublicKey.(ed25519.PublicKey)
+	if ok {
+		k := certprotos.KeyMessage{}
+		if !GetInternalKeyFromEd25519PublicKey(*name, PKed25519, &k) {
+			fmt.Printf("GetSubjectKey: Can't internal ed25519 public key\n")
+			return nil
+		}
+		return &k
+	}
 	return nil
 }
 
@@ -1778,7 +2136,24 @@ func GetIssuerKey(cert *x509.Certificate) *certprotos.KeyMessage {
 	return nil
 }
 
+// AdmissionCertVerifyOptions has the optional checks of VerifyAdmissionCertWithOptions.
+type AdmissionCertVerifyOptions struct {
+	// DER CRL signed by the policy key.  If set, the CRL must be current
+	// and must not list the cert.
+	Crl []byte
+	// DER OCSP response, e.g. stapled by the peer.  If set, it must be
+	// current and say the cert is good.
+	OcspResponse []byte
+	// If there is no OcspResponse, fetch one from the cert's OCSP server.
+	FetchOcsp bool
+}
+
 func VerifyAdmissionCert(policyCert *x509.Certificate, cert *x509.Certificate) bool {
+	return VerifyAdmissionCertWithOptions(policyCert, cert, nil)
+}
+
+func VerifyAdmissionCertWithOptions(policyCert *x509.Certificate, cert *x509.Certificate,
+	options *AdmissionCertVerifyOptions) bool {
 	certPool := x509.NewCertPool()
 	certPool.AddCert(policyCert)
 	opts := x509.VerifyOptions{
@@ -1788,6 +2163,548 @@ func VerifyAdmissionCert(policyCert *x509.Certificate, cert *x509.Certificate) b
 	if _, err := cert.Verify(opts); err != nil {
 		return false
 	}
+
+	if options != nil && options.Crl != nil {
+		if !CheckCrl(policyCert, options.Crl, cert.SerialNumber) {
+			return false
+		}
+	}
+	if options != nil && (options.OcspResponse != nil || options.FetchOcsp) {
+		resp := options.OcspResponse
+		if resp == nil {
+			resp = FetchOcspResponse(policyCert, cert)
+			if resp == nil {
+				return false
+			}
+		}
+		if !CheckOcspResponse(policyCert, cert, resp) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckCrl returns false if crl isn't signed by issuerCert, has expired, or
+// lists serialNumber.
+func CheckCrl(issuerCert *x509.Certificate, crl []byte, serialNumber *big.Int) bool {
+	certList, err := x509.ParseDERCRL(crl)
+	if err != nil {
+		fmt.Printf("CheckCrl: Can't parse CRL\n")
+		return false
+	}
+	err = issuerCert.CheckCRLSignature(certList)
+	if err != nil {
+		fmt.Printf("CheckCrl: CRL signature doesn't verify\n")
+		return false
+	}
+	if certList.HasExpired(time.Now()) {
+		fmt.Printf("CheckCrl: CRL has expired\n")
+		return false
+	}
+	for _, revoked := range certList.TBSCertList.RevokedCertificates {
+		if revoked.SerialNumber.Cmp(serialNumber) == 0 {
+			fmt.Printf("CheckCrl: cert %s is revoked\n", serialNumber.String())
+			return false
+		}
+	}
+	return true
+}
+
+// ProduceCrl returns a DER CRL listing revoked, signed by issuerKey.
+// number must increase with each CRL the issuer produces.
+func ProduceCrl(issuerKey *certprotos.KeyMessage, issuerCert *x509.Certificate,
+	revoked []pkix.RevokedCertificate, number *big.Int, durationSeconds float64) []byte {
+
+	issuerSigner := GetSignerFromInternal(issuerKey)
+	if issuerSigner == nil {
+		fmt.Printf("ProduceCrl: Can't get issuer key\n")
+		return nil
+	}
+
+	now := time.Now()
+	dur := int64(durationSeconds * 1000 * 1000 * 1000)
+	template := &x509.RevocationList{
+		RevokedCertificates: revoked,
+		Number:              number,
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(time.Duration(dur)),
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, template, issuerCert, issuerSigner)
+	if err != nil {
+		fmt.Printf("ProduceCrl: Can't create CRL, %s\n", err.Error())
+		return nil
+	}
+	return crl
+}
+
+// GetSignerFromInternal returns the private key in k for crypto functions
+// that take a crypto.Signer.
+func GetSignerFromInternal(k *certprotos.KeyMessage) crypto.Signer {
+	if k == nil {
+		return nil
+	}
+	if k.RsaKey != nil {
+		pK := rsa.PrivateKey{}
+		PK := rsa.PublicKey{}
+		if !GetRsaKeysFromInternal(k, &pK, &PK) || pK.D == nil {
+			fmt.Printf("GetSignerFromInternal: no private rsa key\n")
+			return nil
+		}
+		return &pK
+	}
+	if k.EccKey != nil {
+		pK, _, err := GetEccKeysFromInternal(k)
+		if err != nil || pK == nil {
+			fmt.Printf("GetSignerFromInternal: no private ecc key\n")
+			return nil
+		}
+		return pK
+	}
+	if k.Ed25519Key != nil {
+		pK, _, err := GetEd25519KeysFromInternal(k)
+		if err != nil || pK == nil {
+			fmt.Printf("GetSignerFromInternal: no private ed25519 key\n")
+			return nil
+		}
+		return pK
+	}
+	fmt.Printf("GetSignerFromInternal: unsupported key type %s\n", k.GetKeyType())
+	return nil
+}
+
+// GetPublicKeyFromInternal returns the public key in k for crypto functions
+// that take a crypto.PublicKey.
+func GetPublicKeyFromInternal(k *certprotos.KeyMessage) crypto.PublicKey {
+	if k == nil {
+		return nil
+	}
+	if k.RsaKey != nil {
+		pK := rsa.PrivateKey{}
+		PK := rsa.PublicKey{}
+		if !GetRsaKeysFromInternal(k, &pK, &PK) {
+			return nil
+		}
+		return &PK
+	}
+	if k.EccKey != nil {
+		_, PK, err := GetEccKeysFromInternal(k)
+		if err != nil || PK == nil {
+			return nil
+		}
+		return PK
+	}
+	if k.Ed25519Key != nil {
+		_, PK, err := GetEd25519KeysFromInternal(k)
+		if err != nil {
+			return nil
+		}
+		return PK
+	}
+	fmt.Printf("GetPublicKeyFromInternal: unsupported key type %s\n", k.GetKeyType())
+	return nil
+}
+
+// OcspStatus is the status of a serial number reported by an OCSP responder.
+// Status is ocsp.Good, ocsp.Revoked or ocsp.Unknown.
+type OcspStatus struct {
+	Status    int
+	RevokedAt time.Time
+}
+
+// ProduceOcspResponse answers the DER OCSP request for a cert issued by
+// issuerCert.  lookup gives the status of a serial number.  The response is
+// signed with signerKey; signerCert is issuerCert, or a delegated responder
+// cert with the OCSP signing usage issued by issuerCert.  Requests that
+// can't be parsed or name another issuer get an OCSP error response.
+func ProduceOcspResponse(request []byte, lookup func(serial *big.Int) OcspStatus,
+	signerKey *certprotos.KeyMessage, signerCert *x509.Certificate, issuerCert *x509.Certificate,
+	durationSeconds float64) []byte {
+
+	req, err := ocsp.ParseRequest(request)
+	if err != nil {
+		fmt.Printf("ProduceOcspResponse: Can't parse request\n")
+		return ocsp.MalformedRequestErrorResponse
+	}
+	if !bytes.Equal(req.IssuerKeyHash, ocspIssuerKeyHash(issuerCert, req.HashAlgorithm)) {
+		fmt.Printf("ProduceOcspResponse: request for another issuer\n")
+		return ocsp.UnauthorizedErrorResponse
+	}
+	signer := GetSignerFromInternal(signerKey)
+	if signer == nil {
+		return ocsp.InternalErrorErrorResponse
+	}
+
+	st := lookup(req.SerialNumber)
+	now := time.Now()
+	dur := int64(durationSeconds * 1000 * 1000 * 1000)
+	template := ocsp.Response{
+		Status:       st.Status,
+		SerialNumber: req.SerialNumber,
+		IssuerHash:   req.HashAlgorithm,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(time.Duration(dur)),
+	}
+	if st.Status == ocsp.Revoked {
+		template.RevokedAt = st.RevokedAt
+		template.RevocationReason = ocsp.Unspecified
+	}
+	if signerCert != issuerCert {
+		template.Certificate = signerCert
+	}
+	resp, err := ocsp.CreateResponse(issuerCert, signerCert, template, signer)
+	if err != nil {
+		fmt.Printf("ProduceOcspResponse: Can't create response, %s\n", err.Error())
+		return ocsp.InternalErrorErrorResponse
+	}
+	return resp
+}
+
+// OcspRequestIssuedBy returns true if the DER OCSP request asks about a
+// cert issued by issuerCert.
+func OcspRequestIssuedBy(request []byte, issuerCert *x509.Certificate) bool {
+	req, err := ocsp.ParseRequest(request)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(req.IssuerKeyHash, ocspIssuerKeyHash(issuerCert, req.HashAlgorithm))
+}
+
+// ocspIssuerKeyHash is the hash of the issuer's public key in an OCSP CertID.
+func ocspIssuerKeyHash(issuerCert *x509.Certificate, h crypto.Hash) []byte {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if !h.Available() {
+		return nil
+	}
+	if _, err := asn1.Unmarshal(issuerCert.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return nil
+	}
+	hh := h.New()
+	hh.Write(publicKeyInfo.PublicKey.RightAlign())
+	return hh.Sum(nil)
+}
+
+// CheckOcspResponse returns true if resp is a current response, signed by
+// issuerCert or a responder it delegated to, saying cert is good.
+func CheckOcspResponse(issuerCert *x509.Certificate, cert *x509.Certificate, resp []byte) bool {
+	r, err := ocsp.ParseResponseForCert(resp, cert, issuerCert)
+	if err != nil {
+		fmt.Printf("CheckOcspResponse: bad response, %s\n", err.Error())
+		return false
+	}
+	now := time.Now()
+	if r.Certificate != nil {
+		// ParseResponseForCert checked that issuerCert signed the
+		// responder cert, but not that it may sign OCSP responses.
+		delegated := false
+		for _, u := range r.Certificate.ExtKeyUsage {
+			if u == x509.ExtKeyUsageOCSPSigning {
+				delegated = true
+			}
+		}
+		if !delegated || now.Before(r.Certificate.NotBefore) || now.After(r.Certificate.NotAfter) {
+			fmt.Printf("CheckOcspResponse: responder cert can't sign OCSP responses\n")
+			return false
+		}
+	}
+	if now.Before(r.ThisUpdate) || (!r.NextUpdate.IsZero() && now.After(r.NextUpdate)) {
+		fmt.Printf("CheckOcspResponse: response isn't current\n")
+		return false
+	}
+	if r.Status != ocsp.Good {
+		fmt.Printf("CheckOcspResponse: cert %s is not good\n", cert.SerialNumber.String())
+		return false
+	}
+	return true
+}
+
+// FetchOcspResponse asks the cert's OCSP server for the cert's status.
+func FetchOcspResponse(issuerCert *x509.Certificate, cert *x509.Certificate) []byte {
+	if len(cert.OCSPServer) == 0 {
+		fmt.Printf("FetchOcspResponse: cert has no OCSP server\n")
+		return nil
+	}
+	req, err := ocsp.CreateRequest(cert, issuerCert, &ocsp.RequestOptions{Hash: crypto.SHA256})
+	if err != nil {
+		fmt.Printf("FetchOcspResponse: Can't create request\n")
+		return nil
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	httpResp, err := client.Post(cert.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		fmt.Printf("FetchOcspResponse: %s\n", err.Error())
+		return nil
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		fmt.Printf("FetchOcspResponse: responder returned %s\n", httpResp.Status)
+		return nil
+	}
+	resp, err := io.ReadAll(io.LimitReader(httpResp.Body, 64*1024))
+	if err != nil {
+		fmt.Printf("FetchOcspResponse: Can't read response\n")
+		return nil
+	}
+	return resp
+}
+
+// A signingAlgorithm is what a signing_algorithm name stands for: the key
+// type it is used with, without "-private" or "-public", the hash and, for
+// RSA, whether the padding is PSS rather than PKCS #1 v1.5.  Ed25519 signs
+// the message itself, so it has no hash.
+type signingAlgorithm struct {
+	keyType string
+	hash    crypto.Hash
+	pss     bool
+}
+
+var signingAlgorithms = map[string]signingAlgorithm{
+	"rsa-1024-sha256-pkcs-sign": {"rsa-1024", crypto.SHA256, false},
+	"rsa-2048-sha256-pkcs-sign": {"rsa-2048", crypto.SHA256, false},
+	"rsa-2048-sha256-pss-sign":  {"rsa-2048", crypto.SHA256, true},
+	"rsa-3072-sha384-pkcs-sign": {"rsa-3072", crypto.SHA384, false},
+	"rsa-3072-sha384-pss-sign":  {"rsa-3072", crypto.SHA384, true},
+	"rsa-4096-sha384-pkcs-sign": {"rsa-4096", crypto.SHA384, false},
+	"rsa-4096-sha384-pss-sign":  {"rsa-4096", crypto.SHA384, true},
+	"ecc-256-sha256-pkcs-sign":  {"ecc-256", crypto.SHA256, false},
+	"ecc-384-sha384-pkcs-sign":  {"ecc-384", crypto.SHA384, false},
+	"ed25519-sign":              {"ed25519", 0, false},
+}
+
+// baseKeyType returns the key_type of k without "-private" or "-public",
+// e.g. "rsa-2048", or "" if the key in k isn't of that type.
+func baseKeyType(k *certprotos.KeyMessage) string {
+	t := strings.TrimSuffix(k.GetKeyType(), "-private")
+	t = strings.TrimSuffix(t, "-public")
+	if t != keyMaterialType(k) {
+		return ""
+	}
+	return t
+}
+
+// keyMaterialType returns the type of the key in k as baseKeyType names
+// it, from the modulus size or the curve rather than key_type, or "" if it
+// isn't a supported key.
+func keyMaterialType(k *certprotos.KeyMessage) string {
+	switch {
+	case k.GetRsaKey() != nil:
+		bits := new(big.Int).SetBytes(k.RsaKey.PublicModulus).BitLen()
+		switch bits {
+		case 1024, 2048, 3072, 4096:
+			return fmt.Sprintf("rsa-%d", bits)
+		}
+	case k.GetEccKey() != nil:
+		var curve elliptic.Curve
+		switch k.EccKey.GetCurveName() {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return ""
+		}
+		p := curve.Params()
+		if k.EccKey.CurveP != nil && new(big.Int).SetBytes(k.EccKey.CurveP).Cmp(p.P) != 0 {
+			return ""
+		}
+		pt := k.EccKey.GetPublicPoint()
+		if pt == nil || !curve.IsOnCurve(new(big.Int).SetBytes(pt.X), new(big.Int).SetBytes(pt.Y)) {
+			return ""
+		}
+		return fmt.Sprintf("ecc-%d", p.BitSize)
+	case k.GetEd25519Key() != nil:
+		if len(k.Ed25519Key.PublicKey) == ed25519.PublicKeySize {
+			return "ed25519"
+		}
+	}
+	return ""
+}
+
+// SigningAlgorithmForKey returns the name of the usual signing algorithm
+// for k, e.g. "rsa-2048-sha256-pkcs-sign", or "" if there is none.
+func SigningAlgorithmForKey(k *certprotos.KeyMessage) string {
+	switch baseKeyType(k) {
+	case "rsa-1024":
+		return "rsa-1024-sha256-pkcs-sign"
+	case "rsa-2048":
+		return "rsa-2048-sha256-pkcs-sign"
+	case "rsa-3072":
+		return "rsa-3072-sha384-pkcs-sign"
+	case "rsa-4096":
+		return "rsa-4096-sha384-pkcs-sign"
+	case "ecc-256":
+		return "ecc-256-sha256-pkcs-sign"
+	case "ecc-384":
+		return "ecc-384-sha384-pkcs-sign"
+	case "ed25519":
+		return "ed25519-sign"
+	}
+	return ""
+}
+
+// SigningAlgorithmSuitsKey reports whether alg is a known signing
+// algorithm for keys of k's type, and k is a key of that type.
+func SigningAlgorithmSuitsKey(alg string, k *certprotos.KeyMessage) bool {
+	a, ok := signingAlgorithms[alg]
+	return ok && a.keyType == baseKeyType(k)
+}
+
+// SignWithKey signs in with the private key k using alg, which must suit
+// k.  ECC signatures are DER encoded; Ed25519 signatures are as in RFC 8032.
+func SignWithKey(alg string, k *certprotos.KeyMessage, in []byte) []byte {
+	if !SigningAlgorithmSuitsKey(alg, k) {
+		fmt.Printf("SignWithKey: algorithm %s doesn't match key\n", alg)
+		return nil
+	}
+	a := signingAlgorithms[alg]
+	signer := GetSignerFromInternal(k)
+	if signer == nil {
+		return nil
+	}
+	toSign := in
+	if a.keyType == "ed25519" {
+		if _, ok := signer.(ed25519.PrivateKey); !ok {
+			fmt.Printf("SignWithKey: no ed25519 key\n")
+			return nil
+		}
+	} else {
+		h := a.hash.New()
+		h.Write(in)
+		toSign = h.Sum(nil)
+	}
+	var opts crypto.SignerOpts = a.hash
+	if a.pss {
+		// The salt is as long as the hash.
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: a.hash}
+	}
+	sig, err := signer.Sign(rand.Reader, toSign, opts)
+	if err != nil {
+		fmt.Printf("SignWithKey: %s\n", err.Error())
+		return nil
+	}
+	return sig
+}
+
+// VerifyWithKey checks a signature made by SignWithKey with the public
+// half of k.
+func VerifyWithKey(alg string, k *certprotos.KeyMessage, in []byte, sig []byte) bool {
+	if !SigningAlgorithmSuitsKey(alg, k) {
+		fmt.Printf("VerifyWithKey: algorithm %s doesn't match key\n", alg)
+		return false
+	}
+	a := signingAlgorithms[alg]
+	if a.keyType == "ed25519" {
+		_, PK, err := GetEd25519KeysFromInternal(k)
+		if err != nil {
+			return false
+		}
+		return ed25519.Verify(PK, in, sig)
+	}
+	h := a.hash.New()
+	h.Write(in)
+	hashed := h.Sum(nil)
+	if k.RsaKey != nil {
+		pK := rsa.PrivateKey{}
+		PK := rsa.PublicKey{}
+		if !GetRsaKeysFromInternal(k, &pK, &PK) {
+			return false
+		}
+		if a.pss {
+			return rsa.VerifyPSS(&PK, a.hash, hashed, sig,
+				&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+		return rsa.VerifyPKCS1v15(&PK, a.hash, hashed, sig) == nil
+	}
+	if k.EccKey != nil {
+		_, PK, err := GetEccKeysFromInternal(k)
+		if err != nil || PK == nil {
+			return false
+		}
+		return ecdsa.VerifyASN1(PK, hashed, sig)
+	}
+	return false
+}
+
+// KeyStrength returns the security strength of k in bits, as in NIST SP
+// 800-57, or 0 for an unknown key type or a key that isn't of its type.
+func KeyStrength(k *certprotos.KeyMessage) int {
+	switch baseKeyType(k) {
+	case "rsa-1024":
+		return 80
+	case "rsa-2048":
+		return 112
+	case "rsa-3072":
+		return 128
+	case "rsa-4096":
+		return 152
+	case "ecc-256":
+		return 128
+	case "ecc-384":
+		return 192
+	case "ed25519":
+		return 128
+	}
+	return 0
+}
+
+// possessionToBeSigned returns the bytes signed for a proof of possession:
+// the request with the signature removed.
+func possessionToBeSigned(request *certprotos.TrustRequestMessage) []byte {
+	tbs := proto.Clone(request).(*certprotos.TrustRequestMessage)
+	if tbs.Possession != nil {
+		tbs.Possession.Signature = nil
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(tbs)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// SignTrustRequest adds a proof of possession of the private enclave key to
+// request, over nonce and the rest of the request.  It should be called
+// once the request is otherwise complete.
+func SignTrustRequest(request *certprotos.TrustRequestMessage, enclaveKey *certprotos.KeyMessage,
+	nonce []byte) bool {
+
+	alg := SigningAlgorithmForKey(enclaveKey)
+	request.Possession = &certprotos.ProofOfPossession{
+		Nonce:            nonce,
+		SigningAlgorithm: &alg,
+	}
+	tbs := possessionToBeSigned(request)
+	if tbs == nil {
+		return false
+	}
+	sig := SignWithKey(alg, enclaveKey, tbs)
+	if sig == nil {
+		request.Possession = nil
+		return false
+	}
+	request.Possession.Signature = sig
+	return true
+}
+
+// VerifyTrustRequestPossession returns true if the proof of possession in
+// request is signed by enclaveKey.  The caller checks the nonce.
+func VerifyTrustRequestPossession(request *certprotos.TrustRequestMessage,
+	enclaveKey *certprotos.KeyMessage) bool {
+
+	p := request.GetPossession()
+	if p == nil || p.Signature == nil {
+		fmt.Printf("VerifyTrustRequestPossession: no proof of possession\n")
+		return false
+	}
+	tbs := possessionToBeSigned(request)
+	if tbs == nil {
+		return false
+	}
+	if !VerifyWithKey(p.GetSigningAlgorithm(), enclaveKey, tbs, p.Signature) {
+		fmt.Printf("VerifyTrustRequestPossession: signature does not verify\n")
+		return false
+	}
 	return true
 }
 
@@ -1912,116 +2829,3 @@ func PrintX509Cert(cert *x509.Certificate) {
 	fmt.Printf("\tNot after : %+v\n", cert.NotAfter)
 	fmt.Printf("\tSignature Alg: %+v\n", cert.SignatureAlgorithm)
 }
-
-//  --------------------------------------------------------------------
-
-//  Simulated enclave
-//  --------------------------------------------------------------------
-
-var privateAttestKey *certprotos.KeyMessage = nil
-var publicAttestKey *certprotos.KeyMessage = nil
-var rsaPublicAttestKey rsa.PublicKey
-var rsaPrivateAttestKey rsa.PrivateKey
-var sealingKey [64]byte
-var sealIv [16]byte
-var simulatedInitialized bool = false
-
-func InitSimulatedEnclave() bool {
-	privateAttestKey = MakeVseRsaKey(2048)
-	var tk string = "simulatedAttestKey"
-	privateAttestKey.KeyName = &tk
-	publicAttestKey = InternalPublicFromPrivateKey(privateAttestKey)
-	if publicAttestKey == nil {
-		return false
-	}
-	if !GetRsaKeysFromInternal(privateAttestKey, &rsaPrivateAttestKey, &rsaPublicAttestKey) {
-		return false
-	}
-	// now initialize sealing key and iv
-	for i := 0; i < 64; i++ {
-		sealingKey[i] = byte(i)
-	}
-	for i := 0; i < 16; i++ {
-		sealIv[i] = byte(i + 17)
-	}
-	simulatedInitialized = true
-	return true
-}
-
-func simultatedGetMeasurement(etype string, id string) []byte {
-	m := make([]byte, 32)
-	for i := 0; i < 32; i++ {
-		m[i] = byte(i)
-	}
-	return m
-}
-
-func simultatedSeal(eType string, eId string, toSeal []byte) []byte {
-	if !simulatedInitialized {
-		return nil
-	}
-	return AuthenticatedEncrypt(toSeal, sealingKey[0:64], sealIv[0:16])
-}
-
-func simultatedUnseal(eType string, eId string, toUnseal []byte) []byte {
-	if !simulatedInitialized {
-		return nil
-	}
-	return AuthenticatedDecrypt(toUnseal, sealingKey[0:64])
-}
-
-func simultatedAttest(eType string, toSay []byte) []byte {
-	if !simulatedInitialized {
-		return nil
-	}
-	// toSay is a serilized attestation, turn it into a signed claim
-	tn := TimePointNow()
-	tf := TimePointPlus(tn, 365*86400)
-	nb := TimePointToString(tn)
-	na := TimePointToString(tf)
-	cl1 := MakeClaim(toSay, "vse-attestation", "attestation", nb, na)
-	serCl, err := proto.Marshal(cl1)
-	if err != nil {
-		return nil
-	}
-	sc := certprotos.SignedClaimMessage{}
-	sc.SerializedClaimMessage = serCl
-	sc.SigningKey = publicAttestKey
-	var ss string = "rsa-2048-sha256-pkcs-sign"
-	sc.SigningAlgorithm = &ss
-	sig := RsaSha256Sign(&rsaPrivateAttestKey, toSay)
-	sc.Signature = sig
-	serSignedClaim, err := proto.Marshal(&sc)
-	if err != nil {
-		return nil
-	}
-	return serSignedClaim
-}
-
-func GetMeasurement(eType string, id string) []byte {
-	if eType == "simulated-enclave" {
-		return simultatedGetMeasurement(eType, id)
-	}
-	return nil
-}
-
-func Seal(eType string, eId string, toSeal []byte) []byte {
-	if eType == "simulated-enclave" {
-		return simultatedSeal(eType, eId, toSeal)
-	}
-	return nil
-}
-
-func Unseal(eType string, eId string, toUnseal []byte) []byte {
-	if eType == "simulated-enclave" {
-		return simultatedUnseal(eType, eId, toUnseal)
-	}
-	return nil
-}
-
-func Attest(eType string, toSay []byte) []byte {
-	if eType == "simulated-enclave" {
-		return simultatedAttest(eType, toSay)
-	}
-	return nil
-}
@@ -0,0 +1,221 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package certmetrics keeps the certifier's request counters and latency
+// histograms and writes them in the Prometheus text exposition format.
+package certmetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, of the validation latency buckets.
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestLabels are the labels on the request metrics.
+type requestLabels struct {
+	evidenceType string
+	purpose      string
+	outcome      string
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+type policyState struct {
+	digest string
+	loaded time.Time
+}
+
+// Metrics is safe for concurrent use.
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestLabels]uint64
+	latency  map[requestLabels]*histogram
+	issued   map[requestLabels]uint64
+	policies map[string]policyState // by domain, "" for the default
+}
+
+func New() *Metrics {
+	return &Metrics{
+		requests: map[requestLabels]uint64{},
+		latency:  map[requestLabels]*histogram{},
+		issued:   map[requestLabels]uint64{},
+		policies: map[string]policyState{},
+	}
+}
+
+// ObserveRequest counts a finished request and its validation time.
+func (m *Metrics) ObserveRequest(evidenceType, purpose, outcome string, elapsed time.Duration) {
+	l := requestLabels{evidenceType, purpose, outcome}
+	seconds := elapsed.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[l]++
+	h := m.latency[l]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(LatencyBuckets)+1)}
+		m.latency[l] = h
+	}
+	i := sort.SearchFloat64s(LatencyBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// CertIssued counts an issued admission cert or platform rule.
+func (m *Metrics) CertIssued(evidenceType, purpose string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.issued[requestLabels{evidenceType: evidenceType, purpose: purpose}]++
+}
+
+// SetPolicy records the digest and load time of the active policy.
+func (m *Metrics) SetPolicy(digest string, loaded time.Time) {
+	m.SetDomainPolicy("", digest, loaded)
+}
+
+// SetDomainPolicy records the active policy of a named policy domain.  Its
+// policy metrics have a domain label.
+func (m *Metrics) SetDomainPolicy(domain string, digest string, loaded time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.policies[domain] = policyState{digest, loaded}
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (l requestLabels) String() string {
+	s := fmt.Sprintf(`evidence_type="%s",purpose="%s"`, escapeLabel(l.evidenceType), escapeLabel(l.purpose))
+	if l.outcome != "" {
+		s += fmt.Sprintf(`,outcome="%s"`, escapeLabel(l.outcome))
+	}
+	return s
+}
+
+// sortLabels puts the label sets of a metric in a stable order.
+func sortLabels(keys []requestLabels) []requestLabels {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	return keys
+}
+
+func counterLabels(m map[requestLabels]uint64) []requestLabels {
+	var keys []requestLabels
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return sortLabels(keys)
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP certifier_requests_total Certification requests by evidence type, purpose and outcome.\n")
+	b.WriteString("# TYPE certifier_requests_total counter\n")
+	for _, l := range counterLabels(m.requests) {
+		fmt.Fprintf(&b, "certifier_requests_total{%s} %d\n", l, m.requests[l])
+	}
+
+	b.WriteString("# HELP certifier_validation_duration_seconds Time to validate a request and produce its artifact.\n")
+	b.WriteString("# TYPE certifier_validation_duration_seconds histogram\n")
+	var latencyLabels []requestLabels
+	for k := range m.latency {
+		latencyLabels = append(latencyLabels, k)
+	}
+	for _, l := range sortLabels(latencyLabels) {
+		h := m.latency[l]
+		var cumulative uint64
+		for i, c := range h.counts {
+			cumulative += c
+			le := math.Inf(1)
+			if i < len(LatencyBuckets) {
+				le = LatencyBuckets[i]
+			}
+			fmt.Fprintf(&b, "certifier_validation_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				l, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(&b, "certifier_validation_duration_seconds_sum{%s} %s\n", l, formatFloat(h.sum))
+		fmt.Fprintf(&b, "certifier_validation_duration_seconds_count{%s} %d\n", l, h.count)
+	}
+
+	b.WriteString("# HELP certifier_certs_issued_total Admission certs and platform rules issued.\n")
+	b.WriteString("# TYPE certifier_certs_issued_total counter\n")
+	for _, l := range counterLabels(m.issued) {
+		fmt.Fprintf(&b, "certifier_certs_issued_total{%s} %d\n", l, m.issued[l])
+	}
+
+	if len(m.policies) > 0 {
+		var domains []string
+		for d := range m.policies {
+			domains = append(domains, d)
+		}
+		sort.Strings(domains)
+		domainLabel := func(d string, sep string) string {
+			if d == "" {
+				return ""
+			}
+			return fmt.Sprintf(`domain="%s"`, escapeLabel(d)) + sep
+		}
+		b.WriteString("# HELP certifier_policy_info Digest of the active policy.\n")
+		b.WriteString("# TYPE certifier_policy_info gauge\n")
+		for _, d := range domains {
+			fmt.Fprintf(&b, "certifier_policy_info{%sdigest=\"%s\"} 1\n", domainLabel(d, ","),
+				escapeLabel(m.policies[d].digest))
+		}
+		b.WriteString("# HELP certifier_policy_load_timestamp_seconds Time the active policy was loaded.\n")
+		b.WriteString("# TYPE certifier_policy_load_timestamp_seconds gauge\n")
+		for _, d := range domains {
+			labels := domainLabel(d, "")
+			if labels != "" {
+				labels = "{" + labels + "}"
+			}
+			fmt.Fprintf(&b, "certifier_policy_load_timestamp_seconds%s %d\n", labels, m.policies[d].loaded.Unix())
+		}
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP serves the metrics, so a Metrics can be registered at /metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
@@ -0,0 +1,60 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmetrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExposition(t *testing.T) {
+	m := New()
+	m.ObserveRequest("sev-platform-package", "authentication", "succeeded", 30*time.Millisecond)
+	m.ObserveRequest("sev-platform-package", "authentication", "succeeded", 2*time.Second)
+	m.ObserveRequest("oe-evidence", "attestation", "failed", time.Millisecond)
+	m.CertIssued("sev-platform-package", "authentication")
+	m.SetPolicy("abcd", time.Unix(1700000000, 0))
+	m.SetDomainPolicy("payments", "ef01", time.Unix(1700000100, 0))
+
+	var b strings.Builder
+	m.WriteTo(&b)
+	out := b.String()
+
+	expected := []string{
+		`certifier_requests_total{evidence_type="sev-platform-package",purpose="authentication",outcome="succeeded"} 2`,
+		`certifier_requests_total{evidence_type="oe-evidence",purpose="attestation",outcome="failed"} 1`,
+		`certifier_validation_duration_seconds_bucket{evidence_type="sev-platform-package",purpose="authentication",outcome="succeeded",le="0.025"} 0`,
+		`certifier_validation_duration_seconds_bucket{evidence_type="sev-platform-package",purpose="authentication",outcome="succeeded",le="0.05"} 1`,
+		`certifier_validation_duration_seconds_bucket{evidence_type="sev-platform-package",purpose="authentication",outcome="succeeded",le="+Inf"} 2`,
+		`certifier_validation_duration_seconds_count{evidence_type="sev-platform-package",purpose="authentication",outcome="succeeded"} 2`,
+		`certifier_certs_issued_total{evidence_type="sev-platform-package",purpose="authentication"} 1`,
+		`certifier_policy_info{digest="abcd"} 1`,
+		`certifier_policy_load_timestamp_seconds 1700000000`,
+		`certifier_policy_info{domain="payments",digest="ef01"} 1`,
+		`certifier_policy_load_timestamp_seconds{domain="payments"} 1700000100`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(out, e+"\n") {
+			t.Errorf("missing %s in:\n%s", e, out)
+		}
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if escapeLabel("a\"b\\c\nd") != `a\"b\\c\nd` {
+		t.Errorf("bad escape: %s", escapeLabel("a\"b\\c\nd"))
+	}
+}
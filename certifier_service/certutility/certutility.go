@@ -0,0 +1,226 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: certutility.go
+
+// certutility has the offline operations on the files simpleserver keeps
+// and on the requests it is sent.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	auditlog "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/auditlog"
+	issuancedb "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/issuancedb"
+)
+
+var operation = flag.String("operation", "", "operation to perform")
+var auditLogFile = flag.String("auditLogFile", "audit.log", "audit log to verify")
+var issuanceDbFile = flag.String("issuanceDbFile", "issuance.db", "issuance database")
+
+// query-issuance selectors
+var serial = flag.Uint64("serial", 0, "serial number")
+var measurement = flag.String("measurement", "", "measurement in hex")
+var subjectKey = flag.String("subjectKey", "", "subject key name")
+var remoteIP = flag.String("remoteIP", "", "client IP address")
+var artifactType = flag.String("artifactType", "", "admission-cert or platform-rule")
+var reason = flag.String("reason", "", "reason for revoking")
+var since = flag.String("since", "", "issued at or after, RFC3339 time or a duration before now such as 168h")
+var until = flag.String("until", "", "issued before, RFC3339 time or a duration before now")
+
+// inspect and dry-run inputs
+var inputFile = flag.String("inputFile", "", "file to inspect, e.g. SSReq-3")
+var policyFile = flag.String("policyFile", "policy.bin", "signed policy")
+var policyCertFile = flag.String("policyCertFile", "", "policy cert, DER or PEM")
+var purposeFlag = flag.String("purpose", "", "purpose to validate for, the request's if empty")
+
+func usage() {
+	fmt.Printf("%s: Certifier service utility\n", os.Args[0])
+	fmt.Printf("\n%s --operation=verify-audit-log --auditLogFile=<audit.log> "+
+		"[--policyCertFile=<cert>]\n", os.Args[0])
+	fmt.Printf("\n%s --operation=revoke --issuanceDbFile=<issuance.db> "+
+		"[--serial=<n>] [--measurement=<hex>] [--subjectKey=<name>] [--reason=<text>]\n", os.Args[0])
+	fmt.Printf("\n%s --operation=query-issuance --issuanceDbFile=<issuance.db> [--serial=<n>] "+
+		"[--measurement=<hex>] [--subjectKey=<name>] [--remoteIP=<ip>] [--artifactType=<type>] "+
+		"[--since=<time>] [--until=<time>]\n", os.Args[0])
+	fmt.Printf("\n%s --operation=inspect-request|inspect-response|inspect-evidence|inspect-cert "+
+		"--inputFile=<file>\n", os.Args[0])
+	fmt.Printf("\n%s --operation=inspect-policy --inputFile=<policy.bin> [--policyCertFile=<cert>]\n", os.Args[0])
+	fmt.Printf("\n%s --operation=dry-run --inputFile=<SSReq-n> --policyFile=<policy.bin> "+
+		"--policyCertFile=<cert> [--purpose=<purpose>]\n", os.Args[0])
+}
+
+// verifyAuditLog also checks the signed head with the key in
+// --policyCertFile, if given.
+func verifyAuditLog() bool {
+	cert, _, ok := readPolicyCert()
+	if !ok {
+		return false
+	}
+	var n int
+	var err error
+	if cert != nil {
+		n, err = auditlog.VerifyWithKey(*auditLogFile, cert.PublicKey)
+	} else {
+		n, err = auditlog.Verify(*auditLogFile)
+	}
+	if errors.Is(err, auditlog.ErrUnsignedRecord) {
+		fmt.Printf("%s: %d records verify, but %s\n", *auditLogFile, n, err.Error())
+		return false
+	}
+	if err != nil {
+		fmt.Printf("%s: verification failed after %d good records: %s\n", *auditLogFile, n, err.Error())
+		return false
+	}
+	if cert != nil {
+		fmt.Printf("%s: %d records, chain and signed head verify\n", *auditLogFile, n)
+	} else {
+		fmt.Printf("%s: %d records, chain verifies\n", *auditLogFile, n)
+	}
+	return true
+}
+
+// parseTime accepts an RFC3339 time or a duration before now.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// openIssuanceDb opens an existing database; a misspelled name shouldn't
+// create an empty one.
+func openIssuanceDb() *issuancedb.DB {
+	if _, err := os.Stat(*issuanceDbFile); err != nil {
+		fmt.Printf("Can't open %s: %s\n", *issuanceDbFile, err.Error())
+		return nil
+	}
+	db, err := issuancedb.Open(*issuanceDbFile)
+	if err != nil {
+		fmt.Printf("Can't open %s: %s\n", *issuanceDbFile, err.Error())
+		return nil
+	}
+	return db
+}
+
+func queryIssuance() bool {
+	var err error
+	f := &issuancedb.Filter{
+		Serial:         *serial,
+		Measurement:    *measurement,
+		SubjectKeyName: *subjectKey,
+		RemoteIP:       *remoteIP,
+		ArtifactType:   *artifactType,
+	}
+	f.IssuedAfter, err = parseTime(*since)
+	if err != nil {
+		fmt.Printf("Bad --since: %s\n", err.Error())
+		return false
+	}
+	f.IssuedBefore, err = parseTime(*until)
+	if err != nil {
+		fmt.Printf("Bad --until: %s\n", err.Error())
+		return false
+	}
+
+	db := openIssuanceDb()
+	if db == nil {
+		return false
+	}
+	defer db.Close()
+
+	// One JSON record per line, so the output can be piped to jq.
+	enc := json.NewEncoder(os.Stdout)
+	for _, r := range db.Query(f) {
+		enc.Encode(r)
+	}
+	return true
+}
+
+// revoke marks the selected admission certs and platform rules as revoked.
+// A running certifier puts them on its next CRL.  Revoking by --measurement
+// alone also stops the certifier issuing anything new for it.
+func revoke() bool {
+	if *serial == 0 && *measurement == "" && *subjectKey == "" {
+		fmt.Printf("revoke needs --serial, --measurement or --subjectKey\n")
+		return false
+	}
+	db := openIssuanceDb()
+	if db == nil {
+		return false
+	}
+	defer db.Close()
+
+	f := &issuancedb.Filter{
+		Serial:         *serial,
+		Measurement:    *measurement,
+		SubjectKeyName: *subjectKey,
+	}
+	revoked, err := db.Revoke(f, *reason)
+	for _, r := range revoked {
+		fmt.Printf("Revoked %s %d, measurement %s\n", r.ArtifactType, r.Serial, r.Measurement)
+	}
+	if err != nil {
+		fmt.Printf("Revoke failed: %s\n", err.Error())
+		return false
+	}
+	fmt.Printf("%d revoked\n", len(revoked))
+	if *serial == 0 && *subjectKey == "" {
+		fmt.Printf("Measurement %s revoked, new requests for it are refused\n", *measurement)
+	}
+	return true
+}
+
+func main() {
+	flag.Parse()
+
+	var ok bool
+	switch *operation {
+	case "":
+		usage()
+		return
+	case "verify-audit-log":
+		ok = verifyAuditLog()
+	case "query-issuance":
+		ok = queryIssuance()
+	case "revoke":
+		ok = revoke()
+	case "inspect-request":
+		ok = inspectRequest()
+	case "inspect-response":
+		ok = inspectResponse()
+	case "inspect-evidence":
+		ok = inspectEvidence()
+	case "inspect-policy":
+		ok = inspectPolicy()
+	case "inspect-cert":
+		ok = inspectCert()
+	case "dry-run":
+		ok = dryRun()
+	default:
+		fmt.Printf("Unknown operation\n")
+		ok = false
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,426 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+// File: inspect.go
+
+// The inspect operations decode the request and response files simpleserver
+// writes with --enableLog, policies and certs.  dry-run validates a logged
+// request against a policy as the server would, printing each step.  None
+// of them need the private policy key.
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	certlib "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certlib"
+	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+	"google.golang.org/protobuf/proto"
+)
+
+func readInput(fileName string) []byte {
+	if fileName == "" {
+		fmt.Printf("No input file\n")
+		return nil
+	}
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		fmt.Printf("Can't read %s: %s\n", fileName, err.Error())
+		return nil
+	}
+	return b
+}
+
+func unmarshalInput(fileName string, m proto.Message) bool {
+	b := readInput(fileName)
+	if b == nil {
+		return false
+	}
+	if err := proto.Unmarshal(b, m); err != nil {
+		fmt.Printf("Can't parse %s: %s\n", fileName, err.Error())
+		return false
+	}
+	return true
+}
+
+// readCert accepts DER, as in policy_cert_file.bin, or PEM.
+func readCert(fileName string) *x509.Certificate {
+	b := readInput(fileName)
+	if b == nil {
+		return nil
+	}
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(b)
+	if err != nil {
+		fmt.Printf("Can't parse cert in %s: %s\n", fileName, err.Error())
+		return nil
+	}
+	return cert
+}
+
+func printCert(cert *x509.Certificate) {
+	certlib.PrintX509Cert(cert)
+	if key := certlib.GetSubjectKey(cert); key != nil {
+		fmt.Printf("\tSubject key: ")
+		certlib.PrintKeyDescriptor(key)
+		fmt.Printf("\n")
+	}
+	for _, ext := range cert.Extensions {
+		fmt.Printf("\tExtension %s\n", ext.Id.String())
+	}
+}
+
+// printSignedClaim prints the clause in a signed claim, not just its bytes,
+// and checks the signature and validity period.  If policyKey isn't nil it
+// also says whether the claim is signed by the policy key.
+func printSignedClaim(sc *certprotos.SignedClaimMessage, policyKey *certprotos.KeyMessage) {
+	cm := &certprotos.ClaimMessage{}
+	if proto.Unmarshal(sc.SerializedClaimMessage, cm) != nil {
+		fmt.Printf("Can't parse claim\n")
+		return
+	}
+	fmt.Printf("Claim format: %s\n", cm.GetClaimFormat())
+	if cm.GetClaimDescriptor() != "" {
+		fmt.Printf("Description : %s\n", cm.GetClaimDescriptor())
+	}
+	fmt.Printf("Valid       : %s to %s\n", cm.GetNotBefore(), cm.GetNotAfter())
+	if vse := certlib.GetVseFromSignedClaim(sc); vse != nil {
+		fmt.Printf("Clause      : ")
+		certlib.PrintVseClause(vse)
+		fmt.Printf("\n")
+	}
+	if sc.SigningKey == nil {
+		fmt.Printf("No signing key\n")
+		return
+	}
+	fmt.Printf("Signed by   : ")
+	certlib.PrintKeyDescriptor(sc.SigningKey)
+	fmt.Printf(" with %s\n", sc.GetSigningAlgorithm())
+	if certlib.VerifySignedClaim(sc, sc.SigningKey) {
+		fmt.Printf("Signature   : verifies, in validity period\n")
+	} else {
+		fmt.Printf("Signature   : DOES NOT verify or claim has expired\n")
+	}
+	if policyKey != nil && !certlib.SameKey(sc.SigningKey, policyKey) {
+		fmt.Printf("Signer      : NOT the policy key\n")
+	}
+}
+
+func printUserData(b []byte) {
+	ud := &certprotos.AttestationUserData{}
+	if proto.Unmarshal(b, ud) != nil {
+		fmt.Printf("User data   : ")
+		certlib.PrintBytes(b)
+		fmt.Printf("\n")
+		return
+	}
+	certlib.PrintAttestationUserData(ud)
+	if ud.Nonce != nil {
+		fmt.Printf("Nonce       : %s\n", hex.EncodeToString(ud.Nonce))
+	}
+}
+
+// printEvidence decodes the evidence types certlib.PrintEvidence only
+// prints the bytes of.
+func printEvidence(ev *certprotos.Evidence) {
+	fmt.Printf("Evidence type: %s\n", ev.GetEvidenceType())
+	switch ev.GetEvidenceType() {
+	case "signed-claim":
+		sc := &certprotos.SignedClaimMessage{}
+		if proto.Unmarshal(ev.SerializedEvidence, sc) != nil {
+			fmt.Printf("Can't parse signed claim\n")
+			return
+		}
+		printSignedClaim(sc, nil)
+	case "signed-vse-attestation-report":
+		sr := &certprotos.SignedReport{}
+		info := &certprotos.VseAttestationReportInfo{}
+		if proto.Unmarshal(ev.SerializedEvidence, sr) != nil || proto.Unmarshal(sr.Report, info) != nil {
+			fmt.Printf("Can't parse signed report\n")
+			return
+		}
+		fmt.Printf("Signed by   : ")
+		if sr.SigningKey != nil {
+			certlib.PrintKeyDescriptor(sr.SigningKey)
+		}
+		fmt.Printf(" with %s\n", sr.GetSigningAlgorithm())
+		if certlib.VerifyReport("vse-attestation-report", sr.SigningKey, ev.SerializedEvidence) {
+			fmt.Printf("Signature   : verifies\n")
+		} else {
+			fmt.Printf("Signature   : DOES NOT verify\n")
+		}
+		fmt.Printf("Measurement : %s\n", hex.EncodeToString(info.VerifiedMeasurement))
+		fmt.Printf("Valid       : %s to %s\n", info.GetNotBefore(), info.GetNotAfter())
+		printUserData(info.UserData)
+	case "sev-attestation":
+		am := &certprotos.SevAttestationMessage{}
+		if proto.Unmarshal(ev.SerializedEvidence, am) != nil {
+			fmt.Printf("Can't parse sev attestation\n")
+			return
+		}
+		// The platform info GetPlatformFromSevAttest reads ends at 0x188.
+		if len(am.ReportedAttestation) >= 0x188 {
+			fmt.Printf("Measurement : %s\n", hex.EncodeToString(certlib.GetMeasurementFromSevAttest(am.ReportedAttestation)))
+			certlib.PrintPlatform(certlib.GetPlatformFromSevAttest(am.ReportedAttestation))
+		} else {
+			fmt.Printf("Sev report is too short (%d bytes)\n", len(am.ReportedAttestation))
+		}
+		printUserData(am.WhatWasSaid)
+	case "cert":
+		cert, err := x509.ParseCertificate(ev.SerializedEvidence)
+		if err != nil {
+			fmt.Printf("Can't parse cert: %s\n", err.Error())
+			return
+		}
+		printCert(cert)
+	default:
+		certlib.PrintBytes(ev.SerializedEvidence)
+		fmt.Printf("\n")
+	}
+}
+
+func printEvidencePackage(ep *certprotos.EvidencePackage) {
+	fmt.Printf("Prover type: %s\n", ep.GetProverType())
+	for i, ev := range ep.FactAssertion {
+		fmt.Printf("\n[%d] ", i)
+		printEvidence(ev)
+	}
+}
+
+func printTrustRequest(req *certprotos.TrustRequestMessage) {
+	if req.GetRequestNonce() {
+		fmt.Printf("Nonce request\n")
+		return
+	}
+	fmt.Printf("Requesting enclave tag : %s\n", req.GetRequestingEnclaveTag())
+	fmt.Printf("Providing enclave tag  : %s\n", req.GetProvidingEnclaveTag())
+	fmt.Printf("Submitted evidence type: %s\n", req.GetSubmittedEvidenceType())
+	fmt.Printf("Purpose                : %s\n", req.GetPurpose())
+	if req.Domain != nil {
+		fmt.Printf("Domain                 : %s\n", req.GetDomain())
+	}
+	if req.Profile != nil {
+		fmt.Printf("Profile                : %s\n", req.GetProfile())
+	}
+	if req.Possession != nil {
+		fmt.Printf("Proof of possession with %s, nonce %s\n",
+			req.Possession.GetSigningAlgorithm(), hex.EncodeToString(req.Possession.Nonce))
+	}
+	if req.Support != nil {
+		fmt.Printf("\n")
+		printEvidencePackage(req.Support)
+	}
+}
+
+func inspectRequest() bool {
+	req := &certprotos.TrustRequestMessage{}
+	if !unmarshalInput(*inputFile, req) {
+		return false
+	}
+	printTrustRequest(req)
+	return true
+}
+
+// inspectResponse also checks the artifact against --policyCertFile, if given.
+func inspectResponse() bool {
+	resp := &certprotos.TrustResponseMessage{}
+	if !unmarshalInput(*inputFile, resp) {
+		return false
+	}
+	policyCert, policyKey, ok := readPolicyCert()
+	if !ok {
+		return false
+	}
+	fmt.Printf("Status: %s\n", resp.GetStatus())
+	if resp.Nonce != nil {
+		fmt.Printf("Nonce : %s\n", hex.EncodeToString(resp.Nonce))
+	}
+	if resp.Artifact == nil {
+		return true
+	}
+	// The artifact is an admission cert or a signed platform rule.
+	if cert, err := x509.ParseCertificate(resp.Artifact); err == nil {
+		printCert(cert)
+		if policyCert != nil {
+			if certlib.VerifyAdmissionCert(policyCert, cert) {
+				fmt.Printf("\tIssued by the policy cert\n")
+			} else {
+				fmt.Printf("\tNOT issued by the policy cert\n")
+			}
+		}
+		return true
+	}
+	sc := &certprotos.SignedClaimMessage{}
+	if proto.Unmarshal(resp.Artifact, sc) == nil && sc.SerializedClaimMessage != nil {
+		printSignedClaim(sc, policyKey)
+		return true
+	}
+	fmt.Printf("Artifact: ")
+	certlib.PrintBytes(resp.Artifact)
+	fmt.Printf("\n")
+	return true
+}
+
+func inspectEvidence() bool {
+	ep := &certprotos.EvidencePackage{}
+	if !unmarshalInput(*inputFile, ep) {
+		return false
+	}
+	printEvidencePackage(ep)
+	return true
+}
+
+// readPolicyCert returns the cert in --policyCertFile and the policy key
+// in it, or nils if there is no --policyCertFile.
+func readPolicyCert() (*x509.Certificate, *certprotos.KeyMessage, bool) {
+	if *policyCertFile == "" {
+		return nil, nil, true
+	}
+	cert := readCert(*policyCertFile)
+	if cert == nil {
+		return nil, nil, false
+	}
+	key := certlib.GetSubjectKey(cert)
+	if key == nil {
+		fmt.Printf("Can't get the policy key from %s\n", *policyCertFile)
+		return nil, nil, false
+	}
+	return cert, key, true
+}
+
+func inspectPolicy() bool {
+	policy := &certprotos.SignedClaimSequence{}
+	if !unmarshalInput(*inputFile, policy) {
+		return false
+	}
+	_, policyKey, ok := readPolicyCert()
+	if !ok {
+		return false
+	}
+	fmt.Printf("%d claims\n", len(policy.Claims))
+	for i, sc := range policy.Claims {
+		fmt.Printf("\n[%d]\n", i)
+		printSignedClaim(sc, policyKey)
+	}
+	return true
+}
+
+func inspectCert() bool {
+	cert := readCert(*inputFile)
+	if cert == nil {
+		return false
+	}
+	printCert(cert)
+	return true
+}
+
+// dryRun repeats what ValidateEvidenceWithVerifier does for the request in
+// --inputFile, printing the filtered policy, the proved statements and the
+// proof, then runs the verifier's Validate as the server does.  The nonce,
+// proof of possession and rate limits depend on the server's state and
+// aren't checked.
+func dryRun() bool {
+	req := &certprotos.TrustRequestMessage{}
+	if !unmarshalInput(*inputFile, req) {
+		return false
+	}
+	if req.GetRequestNonce() || req.Support == nil {
+		fmt.Printf("%s has no evidence\n", *inputFile)
+		return false
+	}
+	if *policyCertFile == "" {
+		fmt.Printf("dry-run needs --policyCertFile\n")
+		return false
+	}
+	_, policyKey, ok := readPolicyCert()
+	if !ok {
+		return false
+	}
+	signedPolicy := &certprotos.SignedClaimSequence{}
+	if !unmarshalInput(*policyFile, signedPolicy) {
+		return false
+	}
+	policy := &certprotos.ProvedStatements{}
+	if !certlib.InitAxiom(*policyKey, policy) || !certlib.InitPolicy(policyKey, signedPolicy, policy) {
+		fmt.Printf("Policy in %s doesn't verify with the policy key\n", *policyFile)
+		return false
+	}
+
+	evType := req.GetSubmittedEvidenceType()
+	verifier := certlib.FindEvidenceVerifier(evType)
+	if verifier == nil {
+		fmt.Printf("No verifier for evidence type %s\n", evType)
+		return false
+	}
+	purpose := req.GetPurpose()
+	if *purposeFlag != "" {
+		purpose = *purposeFlag
+	}
+	fmt.Printf("Evidence type %s, purpose %s\n", evType, purpose)
+
+	fmt.Printf("\nEvidence:\n")
+	printEvidencePackage(req.Support)
+
+	filtered := verifier.FilterPolicy(policyKey, req.Support, policy)
+	if filtered == nil {
+		fmt.Printf("\nCan't filter the policy\n")
+		return false
+	}
+	fmt.Printf("\nFiltered policy:\n")
+	certlib.PrintProvedStatements(filtered)
+
+	if err := certlib.InitProvedStatements(*policyKey, req.Support.FactAssertion, filtered); err != nil {
+		fmt.Printf("\nCan't add the evidence to the proved statements: ")
+		certlib.PrintValidationError(err)
+		return false
+	}
+	fmt.Printf("\nProved statements:\n")
+	certlib.PrintProvedStatements(filtered)
+
+	toProve, proof := verifier.ConstructProof(policyKey, purpose, filtered)
+	if toProve == nil || proof == nil {
+		fmt.Printf("\nCan't construct a proof\n")
+		return false
+	}
+	fmt.Printf("\nTo prove: ")
+	certlib.PrintVseClause(toProve)
+	fmt.Printf("\n\nProof:\n")
+	certlib.PrintProof(proof)
+	if err := certlib.VerifyProof(policyKey, toProve, proof, filtered); err != nil {
+		fmt.Printf("\nProof does not verify: ")
+		certlib.PrintValidationError(err)
+		return false
+	}
+
+	// Custom verifiers may check more than the steps above.
+	fmt.Printf("\nValidate:\n")
+	result, err := verifier.Validate(policyKey, req.Support, policy, purpose)
+	if err != nil {
+		fmt.Printf("\nValidate failed, reason %s: ", certlib.ReasonCode(err))
+		certlib.PrintValidationError(err)
+		return false
+	}
+	fmt.Printf("\nValidate succeeded\n")
+	certlib.PrintValidationResult(result)
+	if k := result.EnclaveKey(); k != nil {
+		fmt.Printf("Enclave key %s, strength %d bits\n", k.GetKeyType(), certlib.KeyStrength(k))
+	}
+	return true
+}
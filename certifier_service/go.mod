@@ -3,6 +3,15 @@ module github.com/vmware-research/certifier-framework-for-confidential-computing
 go 1.18
 
 require (
-	github.com/golang/protobuf v1.5.2
-	google.golang.org/protobuf v1.28.1
+	github.com/golang/protobuf v1.5.3
+	golang.org/x/crypto v0.10.0
+	google.golang.org/grpc v1.56.3
+	google.golang.org/protobuf v1.30.0
+)
+
+require (
+	golang.org/x/net v0.11.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
 )
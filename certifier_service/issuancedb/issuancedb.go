@@ -0,0 +1,358 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package issuancedb records every admission cert and platform rule the
+// certifier issues, and their revocations.  The database is a file of JSON
+// lines that is only appended to; it is read into memory when opened.
+// Another process, such as certutility, may append revocations while the
+// certifier has it open; Refresh reads them.
+package issuancedb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Artifact types
+const (
+	AdmissionCert = "admission-cert"
+	PlatformRule  = "platform-rule"
+)
+
+// Record describes one issued artifact.
+type Record struct {
+	Serial             uint64            `json:"serial"`
+	ArtifactType       string            `json:"artifact_type"`
+	IssuedAt           time.Time         `json:"issued_at"`
+	SubjectKeyName     string            `json:"subject_key_name,omitempty"`
+	SubjectKey         []byte            `json:"subject_key,omitempty"` // serialized KeyMessage
+	Measurement        string            `json:"measurement,omitempty"` // hex
+	EvidenceType       string            `json:"evidence_type,omitempty"`
+	Platform           string            `json:"platform,omitempty"`
+	PlatformProperties map[string]string `json:"platform_properties,omitempty"`
+	RemoteIP           string            `json:"remote_ip,omitempty"`
+	NotBefore          time.Time         `json:"not_before"`
+	NotAfter           time.Time         `json:"not_after"`
+	EvidenceDigest     string            `json:"evidence_digest,omitempty"` // hex sha256
+	Profile            string            `json:"profile,omitempty"`
+
+	// Set from the revocation entry, if any; not stored with the record.
+	Revoked *Revocation `json:"revoked,omitempty"`
+}
+
+// Revocation of one serial number.
+type Revocation struct {
+	Serial    uint64    `json:"serial"`
+	RevokedAt time.Time `json:"revoked_at"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// MeasurementRevocation stops new artifacts being issued for a measurement.
+type MeasurementRevocation struct {
+	Measurement string    `json:"measurement"` // hex
+	RevokedAt   time.Time `json:"revoked_at"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// entry is one line of the database file.
+type entry struct {
+	Issued             *Record                `json:"issued,omitempty"`
+	Revoked            *Revocation            `json:"revoked,omitempty"`
+	RevokedMeasurement *MeasurementRevocation `json:"revoked_measurement,omitempty"`
+}
+
+// DB is safe for concurrent use.
+type DB struct {
+	mu          sync.Mutex
+	f           *os.File
+	offset      int64 // of the first line not yet read
+	records     []*Record
+	bySerial    map[uint64]*Record
+	revocations []*Revocation
+	lastSerial  uint64
+
+	// By lower case hex measurement.
+	revokedMeasurements map[string]*MeasurementRevocation
+}
+
+// Open reads the database in fileName, creating it if needed.
+func Open(fileName string) (*DB, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{f: f, bySerial: map[uint64]*Record{},
+		revokedMeasurements: map[string]*MeasurementRevocation{}}
+	err = db.load()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// load reads the complete lines after db.offset.  Entries this process
+// wrote itself are read again here, so adding an entry is idempotent.
+func (db *DB) load() error {
+	info, err := db.f.Stat()
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(io.NewSectionReader(db.f, db.offset, info.Size()-db.offset))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line is still being written.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e := &entry{}
+		err = json.Unmarshal(bytes.TrimSpace(line), e)
+		if err != nil {
+			return fmt.Errorf("issuancedb at offset %d: %v", db.offset, err)
+		}
+		if e.Issued != nil {
+			db.add(e.Issued)
+		}
+		if e.Revoked != nil {
+			db.addRevocation(e.Revoked)
+		}
+		if m := e.RevokedMeasurement; m != nil && db.revokedMeasurements[strings.ToLower(m.Measurement)] == nil {
+			db.revokedMeasurements[strings.ToLower(m.Measurement)] = m
+		}
+		db.offset += int64(len(line))
+	}
+}
+
+func (db *DB) add(r *Record) {
+	if db.bySerial[r.Serial] != nil {
+		return
+	}
+	db.records = append(db.records, r)
+	db.bySerial[r.Serial] = r
+	if r.Serial > db.lastSerial {
+		db.lastSerial = r.Serial
+	}
+}
+
+func (db *DB) addRevocation(rev *Revocation) {
+	r := db.bySerial[rev.Serial]
+	if r == nil || r.Revoked != nil {
+		return
+	}
+	r.Revoked = rev
+	db.revocations = append(db.revocations, rev)
+}
+
+// Refresh reads entries appended by other processes.
+func (db *DB) Refresh() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.load()
+}
+
+func (db *DB) append(e *entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = db.f.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	return db.f.Sync()
+}
+
+// NextSerial returns a serial number that hasn't been issued.  Serials
+// start from the current time in nanoseconds, as the certifier always
+// did, and are above every serial in the database.
+func (db *DB) NextSerial() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	next := uint64(time.Now().UnixNano())
+	if next <= db.lastSerial {
+		next = db.lastSerial + 1
+	}
+	db.lastSerial = next
+	return next
+}
+
+// Record writes r.  The artifact must not be handed out if this fails.
+func (db *DB) Record(r *Record) error {
+	if r.Serial == 0 {
+		return errors.New("issuancedb: record has no serial")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.bySerial[r.Serial] != nil {
+		return fmt.Errorf("issuancedb: serial %d already issued", r.Serial)
+	}
+	r.Revoked = nil
+	if r.IssuedAt.IsZero() {
+		r.IssuedAt = time.Now().UTC()
+	}
+	err := db.append(&entry{Issued: r})
+	if err != nil {
+		return err
+	}
+	db.add(r)
+	return nil
+}
+
+// Lookup returns a copy of the record for serial, or nil.
+func (db *DB) Lookup(serial uint64) *Record {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	r := db.bySerial[serial]
+	if r == nil {
+		return nil
+	}
+	c := *r
+	return &c
+}
+
+// Filter selects records in Query and Revoke.  Empty fields match everything.
+type Filter struct {
+	Serial         uint64
+	Measurement    string
+	SubjectKeyName string
+	RemoteIP       string
+	ArtifactType   string
+	IssuedAfter    time.Time
+	IssuedBefore   time.Time
+}
+
+// selectsIssued is true if the filter names a serial, measurement or key.
+func (f *Filter) selectsIssued() bool {
+	return f.Serial != 0 || f.Measurement != "" || f.SubjectKeyName != ""
+}
+
+func (f *Filter) matches(r *Record) bool {
+	if f.Serial != 0 && r.Serial != f.Serial {
+		return false
+	}
+	if f.Measurement != "" && !strings.EqualFold(r.Measurement, f.Measurement) {
+		return false
+	}
+	if f.SubjectKeyName != "" && r.SubjectKeyName != f.SubjectKeyName {
+		return false
+	}
+	if f.RemoteIP != "" && r.RemoteIP != f.RemoteIP {
+		return false
+	}
+	if f.ArtifactType != "" && r.ArtifactType != f.ArtifactType {
+		return false
+	}
+	if !f.IssuedAfter.IsZero() && r.IssuedAt.Before(f.IssuedAfter) {
+		return false
+	}
+	if !f.IssuedBefore.IsZero() && !r.IssuedAt.Before(f.IssuedBefore) {
+		return false
+	}
+	return true
+}
+
+// Query returns copies of the matching records in the order they were issued.
+func (db *DB) Query(f *Filter) []*Record {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var out []*Record
+	for _, r := range db.records {
+		if f.matches(r) {
+			c := *r
+			out = append(out, &c)
+		}
+	}
+	return out
+}
+
+// Revoke revokes the unrevoked records selected by f.  f must select by
+// serial, measurement or subject key, so a mistake can't revoke everything.
+// If f selects only by measurement, the measurement is revoked too, so
+// nothing new is issued for it.
+func (db *DB) Revoke(f *Filter, reason string) ([]*Record, error) {
+	if !f.selectsIssued() {
+		return nil, errors.New("issuancedb: revoke needs a serial, measurement or subject key")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	err := db.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var revoked []*Record
+	now := time.Now().UTC()
+	m := strings.ToLower(f.Measurement)
+	if *f == (Filter{Measurement: f.Measurement}) && db.revokedMeasurements[m] == nil {
+		rev := &MeasurementRevocation{Measurement: m, RevokedAt: now, Reason: reason}
+		err = db.append(&entry{RevokedMeasurement: rev})
+		if err != nil {
+			return nil, err
+		}
+		db.revokedMeasurements[m] = rev
+	}
+	for _, r := range db.records {
+		if r.Revoked != nil || !f.matches(r) {
+			continue
+		}
+		rev := &Revocation{Serial: r.Serial, RevokedAt: now, Reason: reason}
+		err = db.append(&entry{Revoked: rev})
+		if err != nil {
+			return revoked, err
+		}
+		db.addRevocation(rev)
+		revoked = append(revoked, r)
+	}
+	return revoked, nil
+}
+
+// Revocations returns every revocation, ordered by serial.
+func (db *DB) Revocations() []*Revocation {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	out := make([]*Revocation, len(db.revocations))
+	copy(out, db.revocations)
+	sort.Slice(out, func(i, j int) bool { return out[i].Serial < out[j].Serial })
+	return out
+}
+
+// MeasurementRevoked returns the revocation of the hex measurement, or nil.
+func (db *DB) MeasurementRevoked(measurement string) *MeasurementRevocation {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rev := db.revokedMeasurements[strings.ToLower(measurement)]
+	if rev == nil {
+		return nil
+	}
+	c := *rev
+	return &c
+}
+
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.f.Close()
+}
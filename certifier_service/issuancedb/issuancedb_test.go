@@ -0,0 +1,166 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuancedb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIssuance(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "issuance.db")
+	db, err := Open(fileName)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	s1 := db.NextSerial()
+	s2 := db.NextSerial()
+	if s2 <= s1 {
+		t.Errorf("serials not increasing: %d %d", s1, s2)
+	}
+	old := time.Now().Add(-8 * 24 * time.Hour)
+	err = db.Record(&Record{Serial: s1, ArtifactType: AdmissionCert, Measurement: "0102",
+		RemoteIP: "10.0.0.1", IssuedAt: old})
+	if err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	err = db.Record(&Record{Serial: s2, ArtifactType: PlatformRule, Measurement: "0a0b"})
+	if err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	if db.Record(&Record{Serial: s2}) == nil {
+		t.Errorf("duplicate serial recorded")
+	}
+	db.Close()
+
+	db, err = Open(fileName)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	if r := db.Lookup(s1); r == nil || r.RemoteIP != "10.0.0.1" {
+		t.Errorf("Lookup(%d) = %v", s1, r)
+	}
+
+	found := db.Query(&Filter{Measurement: "0A0B"})
+	if len(found) != 1 || found[0].Serial != s2 {
+		t.Errorf("query by measurement: %v", found)
+	}
+	found = db.Query(&Filter{IssuedAfter: time.Now().Add(-7 * 24 * time.Hour)})
+	if len(found) != 1 || found[0].Serial != s2 {
+		t.Errorf("query by time: %v", found)
+	}
+	if found = db.Query(&Filter{}); len(found) != 2 {
+		t.Errorf("query all: %d records", len(found))
+	}
+}
+
+// Serials stay unique after reopening, even if the clock goes back.
+func TestReopenKeepsLastSerial(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "issuance.db")
+	db, _ := Open(fileName)
+	future := uint64(time.Now().Add(time.Hour).UnixNano())
+	db.Record(&Record{Serial: future, ArtifactType: AdmissionCert})
+	db.Close()
+
+	db, err := Open(fileName)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer db.Close()
+	if s := db.NextSerial(); s != future+1 {
+		t.Errorf("NextSerial %d, want %d", s, future+1)
+	}
+}
+
+// The server and certutility have the database open at the same time.
+func TestRevoke(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "issuance.db")
+	server, err := Open(fileName)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer server.Close()
+	var serials []uint64
+	for _, m := range []string{"01", "02", "01"} {
+		s := server.NextSerial()
+		serials = append(serials, s)
+		server.Record(&Record{Serial: s, ArtifactType: AdmissionCert, Measurement: m})
+	}
+
+	utility, err := Open(fileName)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if _, err := utility.Revoke(&Filter{}, "all"); err == nil {
+		t.Errorf("empty filter revoked")
+	}
+	revoked, err := utility.Revoke(&Filter{Measurement: "01"}, "vulnerable")
+	if err != nil || len(revoked) != 2 {
+		t.Fatalf("Revoke: %d, %v", len(revoked), err)
+	}
+	revoked, _ = utility.Revoke(&Filter{Measurement: "01"}, "again")
+	if len(revoked) != 0 {
+		t.Errorf("revoked twice")
+	}
+	utility.Close()
+
+	if len(server.Revocations()) != 0 {
+		t.Errorf("revocations seen before Refresh")
+	}
+	if err := server.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	revs := server.Revocations()
+	if len(revs) != 2 || revs[0].Serial != serials[0] || revs[1].Serial != serials[2] {
+		t.Errorf("Revocations after Refresh: %v", revs)
+	}
+	if r := server.Lookup(serials[0]); r.Revoked == nil || r.Revoked.Reason != "vulnerable" {
+		t.Errorf("record not marked revoked: %v", r)
+	}
+	if len(server.Query(&Filter{})) != 3 {
+		t.Errorf("Refresh duplicated records")
+	}
+	if rev := server.MeasurementRevoked("01"); rev == nil || rev.Reason != "vulnerable" {
+		t.Errorf("measurement not revoked: %v", rev)
+	}
+	if server.MeasurementRevoked("02") != nil {
+		t.Errorf("measurement revoked with no revocation")
+	}
+}
+
+// Only revoking by measurement alone stops new issuance.
+func TestRevokeMeasurement(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "issuance.db"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer db.Close()
+	s := db.NextSerial()
+	db.Record(&Record{Serial: s, ArtifactType: AdmissionCert, Measurement: "0a"})
+
+	db.Revoke(&Filter{Serial: s, Measurement: "0a"}, "one cert")
+	if db.MeasurementRevoked("0a") != nil {
+		t.Errorf("measurement revoked by serial")
+	}
+	revoked, err := db.Revoke(&Filter{Measurement: "0B"}, "never issued")
+	if err != nil || len(revoked) != 0 {
+		t.Errorf("Revoke: %d, %v", len(revoked), err)
+	}
+	if db.MeasurementRevoked("0b") == nil {
+		t.Errorf("measurement with nothing issued not revoked")
+	}
+}
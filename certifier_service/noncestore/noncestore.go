@@ -0,0 +1,102 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package noncestore keeps the nonces the certifier hands out so that
+// evidence can only be used once, while its nonce is fresh.
+package noncestore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// NonceSize is the length in bytes of the nonces issued.
+const NonceSize = 32
+
+// Store holds the outstanding nonces.  It is safe for concurrent use.
+type Store struct {
+	mu       sync.Mutex
+	lifetime time.Duration
+	max      int
+	nonces   map[string]time.Time // nonce to expiry
+	now      func() time.Time
+}
+
+// New returns a store whose nonces are valid for lifetime.  At most max
+// nonces are outstanding; 0 or less means no limit.
+func New(lifetime time.Duration, max int) *Store {
+	return &Store{
+		lifetime: lifetime,
+		max:      max,
+		nonces:   map[string]time.Time{},
+		now:      time.Now,
+	}
+}
+
+// Issue returns a new random nonce.  It fails if too many are outstanding.
+func (s *Store) Issue() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.max > 0 && len(s.nonces) >= s.max {
+		s.dropExpired(now)
+		if len(s.nonces) >= s.max {
+			return nil, errors.New("too many outstanding nonces")
+		}
+	}
+	s.nonces[hex.EncodeToString(nonce)] = now.Add(s.lifetime)
+	return nonce, nil
+}
+
+// Consume removes nonce and reports whether it was issued and has not
+// expired.  A nonce can only be consumed once.
+func (s *Store) Consume(nonce []byte) bool {
+	if len(nonce) != NonceSize {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hex.EncodeToString(nonce)
+	expiry, ok := s.nonces[key]
+	if !ok {
+		return false
+	}
+	delete(s.nonces, key)
+	return s.now().Before(expiry)
+}
+
+// Outstanding returns the number of nonces issued and not yet consumed,
+// including expired ones not yet dropped.
+func (s *Store) Outstanding() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.nonces)
+}
+
+func (s *Store) dropExpired(now time.Time) {
+	for key, expiry := range s.nonces {
+		if !now.Before(expiry) {
+			delete(s.nonces, key)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package noncestore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := New(time.Minute, 2)
+	s.now = func() time.Time { return now }
+
+	n1, err := s.Issue()
+	if err != nil || len(n1) != NonceSize {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if !s.Consume(n1) {
+		t.Errorf("fresh nonce refused")
+	}
+	if s.Consume(n1) {
+		t.Errorf("nonce consumed twice")
+	}
+	if s.Consume(make([]byte, NonceSize)) {
+		t.Errorf("nonce that was never issued accepted")
+	}
+
+	n2, _ := s.Issue()
+	now = now.Add(2 * time.Minute)
+	if s.Consume(n2) {
+		t.Errorf("expired nonce accepted")
+	}
+}
+
+func TestStoreLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := New(time.Minute, 2)
+	s.now = func() time.Time { return now }
+
+	s.Issue()
+	s.Issue()
+	if _, err := s.Issue(); err == nil {
+		t.Errorf("nonce issued over the limit")
+	}
+
+	// Expired nonces make room.
+	now = now.Add(2 * time.Minute)
+	if _, err := s.Issue(); err != nil {
+		t.Errorf("Issue after expiry failed: %v", err)
+	}
+	if s.Outstanding() != 1 {
+		t.Errorf("outstanding: got %d, want 1", s.Outstanding())
+	}
+}
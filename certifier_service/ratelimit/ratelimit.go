@@ -0,0 +1,143 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ratelimit has the per-client token buckets and the limit on
+// concurrent work used by the certifier.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Idle buckets are dropped once there are this many.
+const maxIdleBuckets = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter gives each client a token bucket that refills at rate tokens per
+// second up to burst.  It is safe for concurrent use.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+// NewLimiter returns a limiter.  A rate of 0 or less allows everything.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from client's bucket and reports whether there was one.
+func (l *Limiter) Allow(client string) bool {
+	if l == nil || l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b := l.buckets[client]
+	if b == nil {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.dropFullBuckets(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Limited reports whether client's bucket is empty, without taking a token.
+// It lets a connection be refused before any work is done on it.
+func (l *Limiter) Limited(client string) bool {
+	if l == nil || l.rate <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.buckets[client]
+	if b == nil {
+		return false
+	}
+	return b.tokens+l.now().Sub(b.last).Seconds()*l.rate < 1
+}
+
+// dropFullBuckets removes clients whose buckets have refilled; a new
+// bucket for them would be the same.
+func (l *Limiter) dropFullBuckets(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Semaphore limits how many callers hold a slot at once.
+type Semaphore struct {
+	slots chan struct{}
+}
+
+// NewSemaphore returns a semaphore with n slots.  If n is 0 or less,
+// TryAcquire always succeeds.
+func NewSemaphore(n int) *Semaphore {
+	if n <= 0 {
+		return &Semaphore{}
+	}
+	return &Semaphore{slots: make(chan struct{}, n)}
+}
+
+// TryAcquire takes a slot without waiting and reports whether it got one.
+// Each successful TryAcquire must be followed by Release.
+func (s *Semaphore) TryAcquire() bool {
+	if s.slots == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Semaphore) Release() {
+	if s.slots == nil {
+		return
+	}
+	<-s.slots
+}
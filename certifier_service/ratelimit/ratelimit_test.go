@@ -0,0 +1,93 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if !l.Allow("10.0.0.1") {
+			t.Errorf("request %d within burst refused", i)
+		}
+	}
+	if l.Allow("10.0.0.1") {
+		t.Errorf("request over burst allowed")
+	}
+	if !l.Allow("10.0.0.2") {
+		t.Errorf("other client refused")
+	}
+
+	// 2 tokens per second
+	now = now.Add(500 * time.Millisecond)
+	if !l.Allow("10.0.0.1") {
+		t.Errorf("refilled token refused")
+	}
+	if l.Allow("10.0.0.1") {
+		t.Errorf("request allowed before refill")
+	}
+
+	if !NewLimiter(0, 1).Allow("10.0.0.1") {
+		t.Errorf("disabled limiter refused")
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	s := NewSemaphore(2)
+	if !s.TryAcquire() || !s.TryAcquire() {
+		t.Errorf("free slot refused")
+	}
+	if s.TryAcquire() {
+		t.Errorf("acquired more than 2 slots")
+	}
+	s.Release()
+	if !s.TryAcquire() {
+		t.Errorf("released slot refused")
+	}
+
+	u := NewSemaphore(0)
+	for i := 0; i < 100; i++ {
+		if !u.TryAcquire() {
+			t.Errorf("unlimited semaphore refused")
+		}
+	}
+}
+
+func TestLimited(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewLimiter(1, 1)
+	l.now = func() time.Time { return now }
+
+	if l.Limited("10.0.0.1") {
+		t.Errorf("new client limited")
+	}
+	l.Allow("10.0.0.1")
+	if !l.Limited("10.0.0.1") {
+		t.Errorf("client with an empty bucket not limited")
+	}
+	now = now.Add(time.Second)
+	if l.Limited("10.0.0.1") {
+		t.Errorf("client limited after the bucket refilled")
+	}
+	if !l.Allow("10.0.0.1") {
+		t.Errorf("Limited took a token")
+	}
+}
@@ -0,0 +1,179 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serverconfig
+
+import (
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Errors from SelectProfile.
+var ErrUnknownProfile = errors.New("unknown profile")
+var ErrProfileNotAllowed = errors.New("profile not allowed")
+
+// SelectProfile returns the profile for a request naming requested, or the
+// default profile if it names none, for an enclave with measurement.  It
+// returns a nil profile if neither names one.  A request can only name the
+// default profile or one in RequestableProfiles.
+func (i *Issuance) SelectProfile(requested string, measurement []byte) (string, *Profile, error) {
+	name := requested
+	defaultProfile := ""
+	if i.DefaultProfile != nil {
+		defaultProfile = *i.DefaultProfile
+	}
+	if name == "" {
+		name = defaultProfile
+	}
+	if name == "" {
+		return "", nil, nil
+	}
+	p, ok := i.Profiles[name]
+	if !ok {
+		return name, nil, fmt.Errorf("%w %s", ErrUnknownProfile, name)
+	}
+	if name != defaultProfile && !contains(i.RequestableProfiles, name) {
+		return name, nil, fmt.Errorf("%w: %s can't be requested", ErrProfileNotAllowed, name)
+	}
+	if len(p.Measurements) > 0 && !contains(p.Measurements, hex.EncodeToString(measurement)) {
+		return name, nil, fmt.Errorf("%w: %s is not for measurement %x", ErrProfileNotAllowed, name, measurement)
+	}
+	return name, &p, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProfileNames are the names in a profile with the placeholders filled in.
+// A nil field is one the profile leaves out.
+type ProfileNames struct {
+	CommonName   *string
+	Organization *string
+	DnsNames     []string
+	Uris         []*url.URL
+	IpAddresses  []net.IP
+}
+
+// ExpandNames fills in the placeholders in the names of p from values,
+// keyed by placeholder, e.g. "{key_name}".  The enclave picks its key name,
+// so if p uses it, it must be a DNS label and can't add names or change
+// the structure of a URI.
+func (p *Profile) ExpandNames(values map[string]string) (*ProfileNames, error) {
+	if v := values["{key_name}"]; p.uses("{key_name}") && !validDnsLabel(v) {
+		return nil, fmt.Errorf("key name %q is not a DNS label", v)
+	}
+	var pairs []string
+	for _, ph := range Placeholders {
+		pairs = append(pairs, ph, values[ph])
+	}
+	r := strings.NewReplacer(pairs...)
+
+	n := &ProfileNames{}
+	if p.CommonName != nil {
+		cn := r.Replace(*p.CommonName)
+		n.CommonName = &cn
+	}
+	if p.Organization != nil {
+		o := r.Replace(*p.Organization)
+		n.Organization = &o
+	}
+	for _, d := range p.DnsNames {
+		n.DnsNames = append(n.DnsNames, r.Replace(d))
+	}
+	for _, u := range p.Uris {
+		parsed, err := url.Parse(r.Replace(u))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a URI", r.Replace(u))
+		}
+		n.Uris = append(n.Uris, parsed)
+	}
+	if p.IpAddresses != nil {
+		n.IpAddresses = []net.IP{}
+	}
+	for _, a := range p.IpAddresses {
+		if a == "{remote_ip}" && values[a] == "" {
+			// The transport didn't give the client's address.
+			continue
+		}
+		ip := net.ParseIP(r.Replace(a))
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address", r.Replace(a))
+		}
+		n.IpAddresses = append(n.IpAddresses, ip)
+	}
+	return n, nil
+}
+
+// uses returns true if a name in p uses the placeholder ph.
+func (p *Profile) uses(ph string) bool {
+	names := append(append(append([]string{}, p.DnsNames...), p.Uris...), p.IpAddresses...)
+	if p.CommonName != nil {
+		names = append(names, *p.CommonName)
+	}
+	if p.Organization != nil {
+		names = append(names, *p.Organization)
+	}
+	for _, n := range names {
+		if strings.Contains(n, ph) {
+			return true
+		}
+	}
+	return false
+}
+
+// validDnsLabel returns true for 1 to 63 letters, digits and '-', not
+// starting or ending with '-'.
+func validDnsLabel(s string) bool {
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseOid parses a dotted OID such as "1.3.6.1.4.1.99999.1".
+func ParseOid(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%q is not an OID", s)
+	}
+	oid := asn1.ObjectIdentifier{}
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%q is not an OID", s)
+		}
+		oid = append(oid, n)
+	}
+	if oid[0] > 2 || oid[0] < 2 && oid[1] > 39 {
+		return nil, fmt.Errorf("%q is not an OID", s)
+	}
+	return oid, nil
+}
@@ -0,0 +1,129 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serverconfig
+
+import (
+	"encoding/asn1"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSelectProfile(t *testing.T) {
+	c, err := Parse([]byte(`{"version": 1, "issuance": {"default_profile": "server",
+		"requestable_profiles": ["client", "ca"],
+		"profiles": {"server": {}, "client": {"measurements": ["0A0B"]}, "hidden": {},
+			"ca": {"is_ca": true, "allow_ca": true, "measurements": ["0c0d"]}}}}`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	i := c.Issuance
+	tests := []struct {
+		requested   string
+		measurement []byte
+		want        string
+		err         error
+	}{
+		{"", []byte{1}, "server", nil},
+		{"server", []byte{1}, "server", nil},
+		{"client", []byte{0x0a, 0x0b}, "client", nil},
+		{"client", []byte{1}, "", ErrProfileNotAllowed},
+		{"ca", []byte{0x0a, 0x0b}, "", ErrProfileNotAllowed},
+		{"ca", []byte{0x0c, 0x0d}, "ca", nil},
+		{"hidden", []byte{1}, "", ErrProfileNotAllowed},
+		{"none", []byte{1}, "", ErrUnknownProfile},
+	}
+	for _, tc := range tests {
+		name, p, err := i.SelectProfile(tc.requested, tc.measurement)
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) || p != nil {
+				t.Errorf("%s for %x: got %v, want %v", tc.requested, tc.measurement, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || p == nil || name != tc.want {
+			t.Errorf("%s for %x: got %s, %v", tc.requested, tc.measurement, name, err)
+		}
+	}
+
+	// Without a default profile, a request naming none gets the usual cert.
+	i.DefaultProfile = nil
+	if name, p, err := i.SelectProfile("", []byte{1}); name != "" || p != nil || err != nil {
+		t.Errorf("no default: got %s, %v, %v", name, p, err)
+	}
+}
+
+func TestExpandNames(t *testing.T) {
+	c, err := Parse([]byte(`{"version": 1, "issuance": {"profiles": {
+		"p": {"common_name": "{key_name}.{platform}", "organization": "Measured-{measurement}",
+			"dns_names": ["{measurement}.enclaves.example"], "uris": ["spiffe://example/{key_name}"],
+			"ip_addresses": ["{remote_ip}", "10.0.0.1"]},
+		"measured": {"dns_names": ["{measurement}.enclaves.example"]}}}}`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	p := c.Issuance.Profiles["p"]
+	values := map[string]string{"{measurement}": "0a0b", "{platform}": "amd-sev-snp",
+		"{key_name}": "enclave-1", "{remote_ip}": "10.0.0.2"}
+	n, err := p.ExpandNames(values)
+	if err != nil {
+		t.Fatalf("ExpandNames: %v", err)
+	}
+	if *n.CommonName != "enclave-1.amd-sev-snp" || *n.Organization != "Measured-0a0b" {
+		t.Errorf("subject: got %s, %s", *n.CommonName, *n.Organization)
+	}
+	if len(n.DnsNames) != 1 || n.DnsNames[0] != "0a0b.enclaves.example" {
+		t.Errorf("dns names: got %v", n.DnsNames)
+	}
+	if len(n.Uris) != 1 || n.Uris[0].String() != "spiffe://example/enclave-1" {
+		t.Errorf("uris: got %v", n.Uris)
+	}
+	if len(n.IpAddresses) != 2 || !n.IpAddresses[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("ip addresses: got %v", n.IpAddresses)
+	}
+
+	// Key names that would add a name or change a URI are refused.
+	for _, bad := range []string{"", "a.evil.example", "x/../../admin", "a?b", "-a", "a b"} {
+		values["{key_name}"] = bad
+		if _, err := p.ExpandNames(values); err == nil {
+			t.Errorf("key name %q accepted", bad)
+		}
+	}
+	// but only if the profile uses them.
+	m := c.Issuance.Profiles["measured"]
+	n, err = m.ExpandNames(values)
+	if err != nil || n.CommonName != nil || n.IpAddresses != nil {
+		t.Errorf("profile without key name: got %+v, %v", n, err)
+	}
+
+	// A transport without the client's address leaves it out.
+	values["{key_name}"] = "enclave-1"
+	values["{remote_ip}"] = ""
+	if n, err = p.ExpandNames(values); err != nil || len(n.IpAddresses) != 1 {
+		t.Errorf("no remote IP: got %v, %v", n, err)
+	}
+}
+
+func TestParseOid(t *testing.T) {
+	oid, err := ParseOid("1.3.6.1.4.1.32473.1")
+	if err != nil || !oid.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 32473, 1}) {
+		t.Errorf("ParseOid: got %v, %v", oid, err)
+	}
+	for _, bad := range []string{"", "1", "1.x", "1.-3", "3.1", "1.40", "1..2"} {
+		if _, err := ParseOid(bad); err == nil {
+			t.Errorf("ParseOid accepted %q", bad)
+		}
+	}
+}
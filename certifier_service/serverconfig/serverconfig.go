@@ -0,0 +1,678 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package serverconfig reads the simpleserver config file.  The file is
+// JSON; every setting is optional and corresponds to a simpleserver flag,
+// which overrides it when given on the command line.
+//
+//	{
+//	  "version": 1,
+//	  "listeners": {"host": "0.0.0.0", "port": "8123", "grpc_port": "8124"},
+//	  "policy": {"file": "policy.bin", "poll_interval": "30s"},
+//	  "evidence_types": ["sev-platform-package"]
+//	}
+package serverconfig
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CurrentVersion is the config file version this package reads.
+const CurrentVersion = 1
+
+// Duration is a time.Duration written as a string such as "90s" or "24h".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be a string like \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+type Tls struct {
+	Enabled           *bool   `json:"enabled,omitempty"`
+	CertFile          *string `json:"cert_file,omitempty"`
+	KeyFile           *string `json:"key_file,omitempty"`
+	ClientCaFile      *string `json:"client_ca_file,omitempty"`
+	RequireClientCert *bool   `json:"require_client_cert,omitempty"`
+}
+
+// Listeners are the addresses simpleserver serves on.  An empty port
+// disables that listener.
+type Listeners struct {
+	Host        *string `json:"host,omitempty"`
+	Port        *string `json:"port,omitempty"`
+	GrpcPort    *string `json:"grpc_port,omitempty"`
+	HttpPort    *string `json:"http_port,omitempty"`
+	MetricsPort *string `json:"metrics_port,omitempty"`
+	CrlPort     *string `json:"crl_port,omitempty"`
+	OcspPort    *string `json:"ocsp_port,omitempty"`
+	Tls         *Tls    `json:"tls,omitempty"`
+}
+
+// Policy is where the policy key, cert and rules come from.
+type Policy struct {
+	KeyFile      *string   `json:"key_file,omitempty"`
+	CertFile     *string   `json:"cert_file,omitempty"`
+	File         *string   `json:"file,omitempty"`
+	Read         *bool     `json:"read,omitempty"`
+	PollInterval *Duration `json:"poll_interval,omitempty"`
+}
+
+// Issuance covers the certs and revocation information the server issues.
+type Issuance struct {
+	CertDuration *Duration `json:"cert_duration,omitempty"`
+	DbFile       *string   `json:"db_file,omitempty"`
+	CrlUrl       *string   `json:"crl_url,omitempty"`
+	CrlValidity  *Duration `json:"crl_validity,omitempty"`
+	OcspUrl      *string   `json:"ocsp_url,omitempty"`
+	OcspKeyFile  *string   `json:"ocsp_key_file,omitempty"`
+	OcspCertFile *string   `json:"ocsp_cert_file,omitempty"`
+	OcspValidity *Duration `json:"ocsp_validity,omitempty"`
+	// Admission cert profiles by name, and the one used when a request
+	// doesn't name one.  Without a default profile, such requests get the
+	// usual admission cert.
+	Profiles       map[string]Profile `json:"profiles,omitempty"`
+	DefaultProfile *string            `json:"default_profile,omitempty"`
+	// Profiles a request may name.  Requests naming any other get nothing.
+	RequestableProfiles []string `json:"requestable_profiles,omitempty"`
+	// OID of the attestation extension, e.g. under your organization's
+	// IANA Private Enterprise Number.  The project has no OID for it.
+	AttestationOid *string `json:"attestation_oid,omitempty"`
+}
+
+// Profile sets the contents of an admission cert.  The names may use the
+// placeholders in Placeholders, which are filled in for each request.
+// Settings left out get the contents of the usual admission cert.
+type Profile struct {
+	CommonName   *string  `json:"common_name,omitempty"`
+	Organization *string  `json:"organization,omitempty"`
+	DnsNames     []string `json:"dns_names,omitempty"`
+	Uris         []string `json:"uris,omitempty"`
+	// IP addresses, or "{remote_ip}" for the client's address.
+	IpAddresses []string  `json:"ip_addresses,omitempty"`
+	KeyUsage    []string  `json:"key_usage,omitempty"`
+	ExtKeyUsage []string  `json:"ext_key_usage,omitempty"`
+	Validity    *Duration `json:"validity,omitempty"`
+	IsCa        *bool     `json:"is_ca,omitempty"`
+	// Only for CA certs; left out means no limit.
+	MaxPathLen *int `json:"max_path_len,omitempty"`
+	// Embed the measurement and platform in the attestation extension.
+	AttestationExtension *bool `json:"attestation_extension,omitempty"`
+	// Hex measurements the profile is for, any if empty.
+	Measurements []string `json:"measurements,omitempty"`
+	// Needed for is_ca or cert_sign, so CA certs are never issued by mistake.
+	AllowCa *bool `json:"allow_ca,omitempty"`
+}
+
+// Placeholders can be used in the names of a profile.
+var Placeholders = []string{"{measurement}", "{platform}", "{key_name}", "{remote_ip}"}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digital_signature":  x509.KeyUsageDigitalSignature,
+	"content_commitment": x509.KeyUsageContentCommitment,
+	"key_encipherment":   x509.KeyUsageKeyEncipherment,
+	"data_encipherment":  x509.KeyUsageDataEncipherment,
+	"key_agreement":      x509.KeyUsageKeyAgreement,
+	"cert_sign":          x509.KeyUsageCertSign,
+	"crl_sign":           x509.KeyUsageCRLSign,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":              x509.ExtKeyUsageAny,
+	"server_auth":      x509.ExtKeyUsageServerAuth,
+	"client_auth":      x509.ExtKeyUsageClientAuth,
+	"code_signing":     x509.ExtKeyUsageCodeSigning,
+	"email_protection": x509.ExtKeyUsageEmailProtection,
+	"time_stamping":    x509.ExtKeyUsageTimeStamping,
+	"ocsp_signing":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// Usages returns the key usages and extended key usages of a validated
+// profile.  ok is false for each that the profile leaves out.
+func (p *Profile) Usages() (ku x509.KeyUsage, kuOk bool, eku []x509.ExtKeyUsage, ekuOk bool) {
+	for _, u := range p.KeyUsage {
+		ku |= keyUsages[u]
+	}
+	eku = []x509.ExtKeyUsage{}
+	for _, u := range p.ExtKeyUsage {
+		eku = append(eku, extKeyUsages[u])
+	}
+	return ku, p.KeyUsage != nil, eku, p.ExtKeyUsage != nil
+}
+
+type Logging struct {
+	Enable         *bool   `json:"enable,omitempty"`
+	Dir            *string `json:"dir,omitempty"`
+	File           *string `json:"file,omitempty"`
+	SequenceNumber *int    `json:"sequence_number,omitempty"`
+	AuditLogFile   *string `json:"audit_log_file,omitempty"`
+	ReturnReasons  *bool   `json:"return_reasons,omitempty"`
+}
+
+type Limits struct {
+	RateLimit                *float64  `json:"rate_limit,omitempty"`
+	RateBurst                *int      `json:"rate_burst,omitempty"`
+	MaxConcurrentValidations *int      `json:"max_concurrent_validations,omitempty"`
+	MaxConnections           *int      `json:"max_connections,omitempty"`
+	ConnTimeout              *Duration `json:"conn_timeout,omitempty"`
+	MaxRequestSize           *int      `json:"max_request_size,omitempty"`
+	MaxOutstandingNonces     *int      `json:"max_outstanding_nonces,omitempty"`
+}
+
+// Freshness covers the nonce challenge and proof of possession.
+type Freshness struct {
+	RequireNonce      *bool     `json:"require_nonce,omitempty"`
+	NonceLifetime     *Duration `json:"nonce_lifetime,omitempty"`
+	RequirePossession *bool     `json:"require_possession,omitempty"`
+}
+
+// KeyStrength sets the weakest keys accepted, as security strengths in bits
+// (NIST SP 800-57): 112 for RSA-2048, 128 for RSA-3072 and P-256, 152 for
+// RSA-4096 and 192 for P-384.
+type KeyStrength struct {
+	MinPolicyKey  *int `json:"min_policy_key,omitempty"`
+	MinEnclaveKey *int `json:"min_enclave_key,omitempty"`
+}
+
+// Domain is a named policy domain with its own policy key, cert, policy,
+// issuance settings and logs.  Only the settings listed for Domain in
+// Validate can be given per domain; the others are server wide.
+type Domain struct {
+	Name string `json:"name"`
+	// TLS server names (SNI) that select the domain.
+	ServerNames []string  `json:"server_names,omitempty"`
+	Policy      *Policy   `json:"policy,omitempty"`
+	Issuance    *Issuance `json:"issuance,omitempty"`
+	Logging     *Logging  `json:"logging,omitempty"`
+}
+
+type Config struct {
+	Version   int        `json:"version"`
+	Listeners *Listeners `json:"listeners,omitempty"`
+	Policy    *Policy    `json:"policy,omitempty"`
+	Issuance  *Issuance  `json:"issuance,omitempty"`
+	Logging   *Logging   `json:"logging,omitempty"`
+	Limits    *Limits    `json:"limits,omitempty"`
+	Freshness *Freshness `json:"freshness,omitempty"`
+	// Applies to the policy keys of every domain.
+	KeyStrength *KeyStrength `json:"key_strength,omitempty"`
+	// Submitted evidence types accepted, all registered types if empty.
+	EvidenceTypes []string `json:"evidence_types,omitempty"`
+	// Policy domains served besides the default one the other settings
+	// describe.
+	Domains []Domain `json:"domains,omitempty"`
+}
+
+// Load reads and validates a config file.
+func Load(fileName string) (*Config, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fileName, err.Error())
+	}
+	return c, nil
+}
+
+// Parse decodes and validates a config.  Unknown fields are errors, so a
+// misspelt setting isn't silently ignored.
+func Parse(b []byte) (*Config, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	c := &Config{}
+	err := d.Decode(c)
+	if err != nil {
+		var se *json.SyntaxError
+		if errors.As(err, &se) {
+			line, col := position(b, se.Offset)
+			return nil, fmt.Errorf("line %d, column %d: %s", line, col, se.Error())
+		}
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			return nil, fmt.Errorf("%s: %s is not a %s", te.Field, te.Value, te.Type.String())
+		}
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("data after the config object")
+	}
+	err = c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Domain names are used in URL paths and file names; profile names follow
+// the same rules.
+func validName(name string) bool {
+	if name == "" || name[0] == '.' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func position(b []byte, offset int64) (int, int) {
+	line, col := 1, 1
+	for i := int64(0); i < offset && i < int64(len(b)); i++ {
+		if b[i] == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+// Validate checks each setting on its own; simpleserver checks settings
+// that depend on each other once the flags are applied.  All the problems
+// found are reported.
+func (c *Config) Validate() error {
+	var problems []string
+	bad := func(field string, format string, a ...interface{}) {
+		problems = append(problems, field+": "+fmt.Sprintf(format, a...))
+	}
+
+	if c.Version != CurrentVersion {
+		bad("version", "is %d, this server reads version %d", c.Version, CurrentVersion)
+	}
+	port := func(field string, p *string) {
+		if p == nil || *p == "" {
+			return
+		}
+		n, err := strconv.Atoi(*p)
+		if err != nil || n < 1 || n > 65535 {
+			bad(field, "%q is not a port number", *p)
+		}
+	}
+	positive := func(field string, d *Duration) {
+		if d != nil && d.Duration <= 0 {
+			bad(field, "must be more than 0")
+		}
+	}
+	nonNegative := func(field string, n *int) {
+		if n != nil && *n < 0 {
+			bad(field, "must not be negative")
+		}
+	}
+
+	if l := c.Listeners; l != nil {
+		port("listeners.port", l.Port)
+		port("listeners.grpc_port", l.GrpcPort)
+		port("listeners.http_port", l.HttpPort)
+		port("listeners.metrics_port", l.MetricsPort)
+		port("listeners.crl_port", l.CrlPort)
+		port("listeners.ocsp_port", l.OcspPort)
+		if l.Port != nil && *l.Port == "" {
+			bad("listeners.port", "must not be empty")
+		}
+		if t := l.Tls; t != nil && t.Enabled != nil && *t.Enabled {
+			if t.CertFile != nil && *t.CertFile == "" {
+				bad("listeners.tls.cert_file", "must be set when TLS is enabled")
+			}
+			if t.KeyFile != nil && *t.KeyFile == "" {
+				bad("listeners.tls.key_file", "must be set when TLS is enabled")
+			}
+		}
+	}
+	if p := c.Policy; p != nil {
+		if p.PollInterval != nil && p.PollInterval.Duration < 0 {
+			bad("policy.poll_interval", "must not be negative")
+		}
+		if p.File != nil && *p.File == "" {
+			bad("policy.file", "must not be empty")
+		}
+	}
+	profiles := func(field string, i *Issuance) {
+		names := make([]string, 0, len(i.Profiles))
+		for name := range i.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, problem := range i.Profiles[name].problems() {
+				bad(field+".profiles."+name, "%s", problem)
+			}
+			if !validName(name) {
+				bad(field+".profiles", "%q must be letters, digits, '.', '_' or '-'", name)
+			}
+		}
+		if d := i.DefaultProfile; d != nil && *d != "" {
+			if _, ok := i.Profiles[*d]; !ok {
+				bad(field+".default_profile", "there is no profile %s", *d)
+			}
+		}
+		for _, name := range i.RequestableProfiles {
+			if _, ok := i.Profiles[name]; !ok {
+				bad(field+".requestable_profiles", "there is no profile %s", name)
+			}
+		}
+		for _, name := range names {
+			if p := i.Profiles[name]; p.AttestationExtension != nil && *p.AttestationExtension &&
+				(c.Issuance == nil || c.Issuance.AttestationOid == nil) {
+				bad(field+".profiles."+name, "attestation_extension needs issuance.attestation_oid")
+			}
+		}
+	}
+	if i := c.Issuance; i != nil {
+		positive("issuance.cert_duration", i.CertDuration)
+		positive("issuance.crl_validity", i.CrlValidity)
+		positive("issuance.ocsp_validity", i.OcspValidity)
+		profiles("issuance", i)
+		if i.AttestationOid != nil {
+			if _, err := ParseOid(*i.AttestationOid); err != nil {
+				bad("issuance.attestation_oid", "%v", err)
+			}
+		}
+	}
+	if l := c.Logging; l != nil {
+		nonNegative("logging.sequence_number", l.SequenceNumber)
+	}
+	if l := c.Limits; l != nil {
+		if l.RateLimit != nil && *l.RateLimit < 0 {
+			bad("limits.rate_limit", "must not be negative")
+		}
+		if l.RateBurst != nil && *l.RateBurst < 1 {
+			bad("limits.rate_burst", "must be at least 1")
+		}
+		nonNegative("limits.max_concurrent_validations", l.MaxConcurrentValidations)
+		nonNegative("limits.max_connections", l.MaxConnections)
+		positive("limits.conn_timeout", l.ConnTimeout)
+		if l.MaxRequestSize != nil && *l.MaxRequestSize < 1 {
+			bad("limits.max_request_size", "must be at least 1")
+		}
+		nonNegative("limits.max_outstanding_nonces", l.MaxOutstandingNonces)
+	}
+	if f := c.Freshness; f != nil {
+		positive("freshness.nonce_lifetime", f.NonceLifetime)
+	}
+	if k := c.KeyStrength; k != nil {
+		nonNegative("key_strength.min_policy_key", k.MinPolicyKey)
+		nonNegative("key_strength.min_enclave_key", k.MinEnclaveKey)
+	}
+	seen := map[string]bool{}
+	for _, t := range c.EvidenceTypes {
+		if t == "" {
+			bad("evidence_types", "has an empty type")
+		} else if seen[t] {
+			bad("evidence_types", "lists %s twice", t)
+		}
+		seen[t] = true
+	}
+
+	// Domains appending to the same database or log would corrupt it.
+	files := map[string]string{}
+	file := func(field string, f *string) {
+		if f == nil || *f == "" {
+			return
+		}
+		clean := filepath.Clean(*f)
+		if other, ok := files[clean]; ok {
+			bad(field, "%s is also used by %s", *f, other)
+			return
+		}
+		files[clean] = field
+	}
+	if c.Issuance != nil {
+		file("issuance.db_file", c.Issuance.DbFile)
+	}
+	if c.Logging != nil {
+		file("logging.audit_log_file", c.Logging.AuditLogFile)
+	}
+
+	names := map[string]bool{}
+	serverNames := map[string]string{}
+	for i, d := range c.Domains {
+		field := fmt.Sprintf("domains[%d]", i)
+		if !validName(d.Name) {
+			bad(field+".name", "%q must be letters, digits, '.', '_' or '-'", d.Name)
+		} else if d.Name == "default" {
+			bad(field+".name", "default is the name of the server's own domain")
+		} else if names[d.Name] {
+			bad(field+".name", "%s is used twice", d.Name)
+		}
+		names[d.Name] = true
+		for _, n := range d.ServerNames {
+			if other, ok := serverNames[n]; ok {
+				bad(field+".server_names", "%s is also used by %s", n, other)
+			}
+			serverNames[n] = d.Name
+		}
+
+		p := d.Policy
+		if p == nil || p.KeyFile == nil || *p.KeyFile == "" || p.CertFile == nil || *p.CertFile == "" ||
+			p.File == nil || *p.File == "" {
+			bad(field+".policy", "key_file, cert_file and file are required")
+		} else if p.Read != nil || p.PollInterval != nil {
+			bad(field+".policy", "read and poll_interval can only be set for the whole server")
+		}
+		if is := d.Issuance; is != nil {
+			positive(field+".issuance.cert_duration", is.CertDuration)
+			if is.CrlValidity != nil || is.OcspValidity != nil || is.AttestationOid != nil {
+				bad(field+".issuance",
+					"crl_validity, ocsp_validity and attestation_oid can only be set for the whole server")
+			}
+			if (is.OcspKeyFile == nil || *is.OcspKeyFile == "") != (is.OcspCertFile == nil || *is.OcspCertFile == "") {
+				bad(field+".issuance", "ocsp_key_file and ocsp_cert_file must be given together")
+			}
+			profiles(field+".issuance", is)
+			file(field+".issuance.db_file", is.DbFile)
+		}
+		if d.Logging != nil {
+			file(field+".logging.audit_log_file", d.Logging.AuditLogFile)
+		}
+		if l := d.Logging; l != nil && (l.Enable != nil || l.SequenceNumber != nil || l.ReturnReasons != nil) {
+			bad(field+".logging", "enable, sequence_number and return_reasons can only be set for the whole server")
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// problems returns what is wrong with a profile.
+func (p Profile) problems() []string {
+	var problems []string
+	template := func(field string, s string) {
+		for _, ph := range Placeholders {
+			s = strings.ReplaceAll(s, ph, "x")
+		}
+		if strings.ContainsAny(s, "{}") {
+			problems = append(problems, fmt.Sprintf("%s has an unknown placeholder", field))
+		}
+	}
+	if p.CommonName != nil {
+		template("common_name", *p.CommonName)
+	}
+	if p.Organization != nil {
+		template("organization", *p.Organization)
+	}
+	for _, n := range p.DnsNames {
+		template("dns_names", n)
+	}
+	for _, u := range p.Uris {
+		template("uris", u)
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme == "" {
+			problems = append(problems, fmt.Sprintf("uris: %q is not an absolute URI", u))
+		}
+	}
+	for _, a := range p.IpAddresses {
+		if a != "{remote_ip}" && net.ParseIP(a) == nil {
+			problems = append(problems, fmt.Sprintf("ip_addresses: %q is not an IP address", a))
+		}
+	}
+	for _, u := range p.KeyUsage {
+		if _, ok := keyUsages[u]; !ok {
+			problems = append(problems, fmt.Sprintf("key_usage: unknown usage %s", u))
+		}
+	}
+	for _, u := range p.ExtKeyUsage {
+		if _, ok := extKeyUsages[u]; !ok {
+			problems = append(problems, fmt.Sprintf("ext_key_usage: unknown usage %s", u))
+		}
+	}
+	if p.Validity != nil && p.Validity.Duration <= 0 {
+		problems = append(problems, "validity: must be more than 0")
+	}
+	if p.MaxPathLen != nil {
+		if p.IsCa == nil || !*p.IsCa {
+			problems = append(problems, "max_path_len: needs is_ca")
+		} else if *p.MaxPathLen < 0 {
+			problems = append(problems, "max_path_len: must not be negative")
+		}
+	}
+	if ku, _, _, _ := p.Usages(); (p.IsCa != nil && *p.IsCa || ku&x509.KeyUsageCertSign != 0) &&
+		(p.AllowCa == nil || !*p.AllowCa) {
+		problems = append(problems, "is_ca and cert_sign need allow_ca")
+	}
+	for _, m := range p.Measurements {
+		if _, err := hex.DecodeString(m); err != nil || m == "" {
+			problems = append(problems, fmt.Sprintf("measurements: %q is not hex", m))
+		}
+	}
+	return problems
+}
+
+// FlagValues returns the settings in the config as simpleserver flag
+// values, keyed by flag name.  Settings not in the config are left out.
+func (c *Config) FlagValues() map[string]string {
+	m := map[string]string{}
+	str := func(name string, p *string) {
+		if p != nil {
+			m[name] = *p
+		}
+	}
+	boolean := func(name string, p *bool) {
+		if p != nil {
+			m[name] = strconv.FormatBool(*p)
+		}
+	}
+	integer := func(name string, p *int) {
+		if p != nil {
+			m[name] = strconv.Itoa(*p)
+		}
+	}
+	duration := func(name string, p *Duration) {
+		if p != nil {
+			m[name] = p.String()
+		}
+	}
+
+	if l := c.Listeners; l != nil {
+		str("host", l.Host)
+		str("port", l.Port)
+		str("grpcPort", l.GrpcPort)
+		str("httpPort", l.HttpPort)
+		str("metricsPort", l.MetricsPort)
+		str("crlPort", l.CrlPort)
+		str("ocspPort", l.OcspPort)
+		if t := l.Tls; t != nil {
+			boolean("useTls", t.Enabled)
+			str("tlsCertFile", t.CertFile)
+			str("tlsKeyFile", t.KeyFile)
+			str("tlsClientCAFile", t.ClientCaFile)
+			boolean("tlsRequireClientCert", t.RequireClientCert)
+		}
+	}
+	if p := c.Policy; p != nil {
+		str("policy_key_file", p.KeyFile)
+		str("policy_cert_file", p.CertFile)
+		str("policyFile", p.File)
+		boolean("readPolicy", p.Read)
+		duration("policyPollInterval", p.PollInterval)
+	}
+	if i := c.Issuance; i != nil {
+		duration("certDuration", i.CertDuration)
+		str("issuanceDbFile", i.DbFile)
+		str("crlUrl", i.CrlUrl)
+		duration("crlValidity", i.CrlValidity)
+		str("ocspUrl", i.OcspUrl)
+		str("ocspKeyFile", i.OcspKeyFile)
+		str("ocspCertFile", i.OcspCertFile)
+		duration("ocspValidity", i.OcspValidity)
+	}
+	if l := c.Logging; l != nil {
+		boolean("enableLog", l.Enable)
+		str("logDir", l.Dir)
+		str("logFile", l.File)
+		integer("loggingSequenceNumber", l.SequenceNumber)
+		str("auditLogFile", l.AuditLogFile)
+		boolean("returnReasons", l.ReturnReasons)
+	}
+	if l := c.Limits; l != nil {
+		if l.RateLimit != nil {
+			m["rateLimit"] = strconv.FormatFloat(*l.RateLimit, 'g', -1, 64)
+		}
+		integer("rateBurst", l.RateBurst)
+		integer("maxConcurrentValidations", l.MaxConcurrentValidations)
+		integer("maxConnections", l.MaxConnections)
+		duration("connTimeout", l.ConnTimeout)
+		integer("maxRequestSize", l.MaxRequestSize)
+		integer("maxOutstandingNonces", l.MaxOutstandingNonces)
+	}
+	if f := c.Freshness; f != nil {
+		boolean("requireNonce", f.RequireNonce)
+		duration("nonceLifetime", f.NonceLifetime)
+		boolean("requirePossession", f.RequirePossession)
+	}
+	if k := c.KeyStrength; k != nil {
+		integer("minPolicyKeyStrength", k.MinPolicyKey)
+		integer("minEnclaveKeyStrength", k.MinEnclaveKey)
+	}
+	if len(c.EvidenceTypes) > 0 {
+		types := append([]string(nil), c.EvidenceTypes...)
+		sort.Strings(types)
+		m["evidenceTypes"] = strings.Join(types, ",")
+	}
+	return m
+}
@@ -0,0 +1,168 @@
+//  Copyright (c) 2021-22, VMware Inc, and the Certifier Authors.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serverconfig
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExampleConfig(t *testing.T) {
+	c, err := Load("../simpleserver_config.json")
+	if err != nil {
+		t.Fatalf("example config: %v", err)
+	}
+	m := c.FlagValues()
+	want := map[string]string{
+		"port":                 "8123",
+		"policyFile":           "./certlib/policy.bin",
+		"policyPollInterval":   "10s",
+		"certDuration":         "8760h0m0s",
+		"useTls":               "false",
+		"rateBurst":            "10",
+		"minPolicyKeyStrength": "0",
+		"returnReasons":        "false",
+	}
+	for name, v := range want {
+		if m[name] != v {
+			t.Errorf("flag %s: got %q, want %q", name, m[name], v)
+		}
+	}
+	if _, ok := m["evidenceTypes"]; ok {
+		t.Errorf("empty evidence_types should not set a flag")
+	}
+}
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`{"version": 1, "policy": {"poll_interval": "30s"},
+		"evidence_types": ["sev-platform-package", "oe-evidence"]}`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if c.Policy.PollInterval.Duration != 30*time.Second {
+		t.Errorf("poll_interval: got %v", c.Policy.PollInterval)
+	}
+	m := c.FlagValues()
+	if m["evidenceTypes"] != "oe-evidence,sev-platform-package" {
+		t.Errorf("evidenceTypes: got %q", m["evidenceTypes"])
+	}
+	if _, ok := m["port"]; ok {
+		t.Errorf("unset setting returned as a flag")
+	}
+}
+
+func TestDomains(t *testing.T) {
+	c, err := Parse([]byte(`{"version": 1, "domains": [{"name": "payments",
+		"server_names": ["payments.certifier.example"],
+		"policy": {"key_file": "payments_key.bin", "cert_file": "payments_cert.bin", "file": "payments_policy.bin"},
+		"issuance": {"db_file": "payments.db"}, "logging": {"audit_log_file": "payments_audit.log"}}]}`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(c.Domains) != 1 || c.Domains[0].Name != "payments" || *c.Domains[0].Issuance.DbFile != "payments.db" {
+		t.Errorf("domains: got %+v", c.Domains)
+	}
+	// Domains are not flags.
+	if len(c.FlagValues()) != 0 {
+		t.Errorf("domain settings returned as flags: %v", c.FlagValues())
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	c, err := Parse([]byte(`{"version": 1, "issuance": {"default_profile": "tls",
+		"profiles": {"tls": {"common_name": "{measurement}.enclaves.example",
+			"dns_names": ["{measurement}.enclaves.example"], "uris": ["spiffe://example/{key_name}"],
+			"ip_addresses": ["{remote_ip}", "10.0.0.1"], "key_usage": ["digital_signature", "key_encipherment"],
+			"ext_key_usage": ["server_auth"], "validity": "24h", "attestation_extension": true},
+		"ca": {"is_ca": true, "max_path_len": 0, "key_usage": ["cert_sign"], "allow_ca": true}},
+		"attestation_oid": "1.3.6.1.4.1.99999.1"}}`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	p := c.Issuance.Profiles["tls"]
+	ku, kuOk, eku, ekuOk := p.Usages()
+	if !kuOk || ku != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment {
+		t.Errorf("key usage: got %v", ku)
+	}
+	if !ekuOk || len(eku) != 1 || eku[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("ext key usage: got %v", eku)
+	}
+	ca := c.Issuance.Profiles["ca"]
+	if _, _, _, ekuOk := ca.Usages(); ekuOk {
+		t.Errorf("left out ext key usage reported as set")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		want   []string
+	}{
+		{`{"version": 2}`, []string{"version: is 2"}},
+		{`{"version": 1, "policy": {"fle": "x"}}`, []string{"unknown field \"fle\""}},
+		{"{\"version\": 1,\n \"policy\": {]}", []string{"line 2"}},
+		{`{"version": 1, "policy": {"poll_interval": 10}}`, []string{"duration must be a string"}},
+		{`{"version": 1, "limits": {"rate_burst": "ten"}}`, []string{"limits.rate_burst", "not a int"}},
+		{`{"version": 1, "listeners": {"port": "http", "grpc_port": "70000"},
+			"issuance": {"cert_duration": "0s"}, "evidence_types": ["a", "a"]}`,
+			[]string{"listeners.port", "listeners.grpc_port", "issuance.cert_duration", "lists a twice"}},
+		{`{"version": 1, "domains": [
+			{"name": "a/b", "policy": {"key_file": "k", "cert_file": "c", "file": "p"}},
+			{"name": "x", "server_names": ["x.example"], "policy": {"file": "p"}},
+			{"name": "y", "server_names": ["x.example"], "policy": {"key_file": "k", "cert_file": "c",
+				"file": "p", "poll_interval": "1s"}, "logging": {"enable": true}}]}`,
+			[]string{"domains[0].name", "domains[1].policy: key_file", "x.example is also used by x",
+				"domains[2].policy: read and poll_interval", "domains[2].logging"}},
+		{`{"version": 1, "issuance": {"db_file": "issuance.db"}, "logging": {"audit_log_file": "./audit.log"},
+			"domains": [
+			{"name": "default", "policy": {"key_file": "k", "cert_file": "c", "file": "p"}},
+			{"name": "a", "policy": {"key_file": "k", "cert_file": "c", "file": "p"},
+				"issuance": {"db_file": "issuance.db"}, "logging": {"audit_log_file": "audit.log"}},
+			{"name": "b", "policy": {"key_file": "k", "cert_file": "c", "file": "p"},
+				"issuance": {"db_file": "a.db"}, "logging": {"audit_log_file": "a.db"}}]}`,
+			[]string{"domains[0].name: default is",
+				"domains[1].issuance.db_file: issuance.db is also used by issuance.db_file",
+				"domains[1].logging.audit_log_file: audit.log is also used by logging.audit_log_file",
+				"domains[2].logging.audit_log_file: a.db is also used by domains[2].issuance.db_file"}},
+		{`{"version": 1, "key_strength": {"min_enclave_key": -1}}`, []string{"key_strength.min_enclave_key"}},
+		{`{"version": 1, "issuance": {"default_profile": "none", "profiles": {
+			"a": {"common_name": "{serial}", "uris": ["no-scheme"], "ip_addresses": ["host"],
+				"key_usage": ["signing"], "ext_key_usage": ["web"], "validity": "-1h", "max_path_len": 1},
+			"b/c": {}, "ca": {"is_ca": true, "measurements": ["xyz"]}, "signer": {"key_usage": ["cert_sign"]},
+			"attested": {"attestation_extension": true}},
+			"requestable_profiles": ["tls"]}}`,
+			[]string{"profiles.a: common_name has an unknown placeholder", "not an absolute URI",
+				"\"host\" is not an IP address", "unknown usage signing", "unknown usage web",
+				"profiles.a: validity", "max_path_len: needs is_ca", "\"b/c\" must be", "no profile none",
+				"profiles.ca: is_ca and cert_sign need allow_ca", "measurements: \"xyz\" is not hex",
+				"profiles.signer: is_ca and cert_sign need allow_ca", "requestable_profiles: there is no profile tls",
+				"profiles.attested: attestation_extension needs issuance.attestation_oid"}},
+		{`{"version": 1, "issuance": {"attestation_oid": "1.3.x"}}`, []string{"issuance.attestation_oid"}},
+	}
+	for _, tc := range tests {
+		_, err := Parse([]byte(tc.config))
+		if err == nil {
+			t.Errorf("%s: no error", tc.config)
+			continue
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(err.Error(), w) {
+				t.Errorf("%s: error %q does not mention %q", tc.config, err.Error(), w)
+			}
+		}
+	}
+}
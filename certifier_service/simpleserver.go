@@ -17,24 +17,57 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	auditlog "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/auditlog"
 	certlib "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certlib"
+	certmetrics "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certmetrics"
 	certprotos "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/certprotos"
+	issuancedb "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/issuancedb"
+	noncestore "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/noncestore"
+	ratelimit "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/ratelimit"
+	serverconfig "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/serverconfig"
+	"golang.org/x/crypto/ocsp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 	// NOTE: Enable this line when you enable the test-code in main().
 	// gramineverify "github.com/vmware-research/certifier-framework-for-confidential-computing/certifier_service/gramineverify"
 )
 
+var configFile = flag.String("config", "", "JSON config file, see serverconfig; flags given on the command line override it")
+
 var serverHost = flag.String("host", "localhost", "address for client/server")
 var serverPort = flag.String("port", "8123", "port for client/server")
 
@@ -43,109 +76,534 @@ var policyCertFile = flag.String("policy_cert_file", "policy_cert_file.bin", "ce
 var readPolicy = flag.Bool("readPolicy", true, "read policy")
 var policyFile = flag.String("policyFile", "./certlib/policy.bin", "policy file name")
 
-var loggingSequenceNumber = *flag.Int("loggingSequenceNumber", 1, "sequence number for logging")
+var loggingSequenceNumber = flag.Int("loggingSequenceNumber", 1, "sequence number for logging")
 var enableLog = flag.Bool("enableLog", false, "enable logging")
 var logDir = flag.String("logDir", ".", "log directory")
 var logFile = flag.String("logFile", "simpleserver.log", "log file name")
+var rateLimit = flag.Float64("rateLimit", 0, "requests per second allowed from each client IP, 0 for no limit")
+var rateBurst = flag.Int("rateBurst", 10, "requests a client IP can make at once before rateLimit applies")
+var maxConcurrentValidations = flag.Int("maxConcurrentValidations", 0, "validations run at once, 0 for no limit")
+var maxConnections = flag.Int("maxConnections", 0, "open socket connections, 0 for no limit")
+var connTimeout = flag.Duration("connTimeout", 30*time.Second,
+	"time a socket client has for the TLS handshake and its request, and to read the response")
+var maxRequestSize = flag.Int("maxRequestSize", 16*1024*1024, "largest request accepted, in bytes")
+var metricsPort = flag.String("metricsPort", "", "port for the Prometheus /metrics listener, disabled if empty")
+var issuanceDbFile = flag.String("issuanceDbFile", "", "database of issued certs and platform rules, disabled if empty")
+var crlPort = flag.String("crlPort", "", "port for the plain HTTP /crl listener, disabled if empty")
+var crlUrl = flag.String("crlUrl", "", "CRL distribution point put in new admission certs, none if empty")
+var crlValidity = flag.Duration("crlValidity", 24*time.Hour, "time until the next CRL update")
+var ocspPort = flag.String("ocspPort", "", "port for the plain HTTP /ocsp responder, disabled if empty")
+var ocspUrl = flag.String("ocspUrl", "", "OCSP responder put in the AIA of new admission certs, none if empty")
+var ocspKeyFile = flag.String("ocspKeyFile", "", "delegated OCSP signing key file, the policy key if empty")
+var ocspCertFile = flag.String("ocspCertFile", "", "delegated OCSP signing cert file, issued by the policy key")
+var ocspValidity = flag.Duration("ocspValidity", time.Hour, "time until the next OCSP update")
+var requireNonce = flag.Bool("requireNonce", false, "reject evidence without a nonce from this certifier")
+var nonceLifetime = flag.Duration("nonceLifetime", 5*time.Minute, "time a client has to use a nonce")
+var requirePossession = flag.Bool("requirePossession", false, "reject requests not signed by the enclave key")
+var returnReasons = flag.Bool("returnReasons", false, "return the reason code of failed requests to the client")
+var maxOutstandingNonces = flag.Int("maxOutstandingNonces", 100000, "nonces issued and not yet used, 0 for no limit")
+var minPolicyKeyStrength = flag.Int("minPolicyKeyStrength", 0, "weakest policy key accepted, in bits of security")
+var minEnclaveKeyStrength = flag.Int("minEnclaveKeyStrength", 0, "weakest enclave key certified, in bits of security")
+var auditLogFile = flag.String("auditLogFile", "", "hash chained JSON-lines audit log, disabled if empty")
+var certDuration = flag.Duration("certDuration", 365*24*time.Hour, "validity of admission certs")
+var evidenceTypes = flag.String("evidenceTypes", "", "comma separated submitted evidence types accepted, all if empty")
+
+var useTls = flag.Bool("useTls", false, "accept TLS connections instead of plain TCP")
+var tlsCertFile = flag.String("tlsCertFile", "server_cert.pem", "PEM server cert for TLS")
+var tlsKeyFile = flag.String("tlsKeyFile", "server_key.pem", "PEM server key for TLS")
+var tlsClientCAFile = flag.String("tlsClientCAFile", "", "additional PEM CA certs trusted for client certs")
+var tlsRequireClientCert = flag.Bool("tlsRequireClientCert", false, "require a verified client cert")
 
-var privatePolicyKey *certprotos.KeyMessage = nil
-var publicPolicyKey *certprotos.KeyMessage = nil
-var serializedPolicyCert []byte
-var policyCert *x509.Certificate = nil
+var grpcPort = flag.String("grpcPort", "", "port for the gRPC CertifierService, disabled if empty")
+var httpPort = flag.String("httpPort", "", "port for the HTTP/JSON API, disabled if empty")
+
+var policyPollInterval = flag.Duration("policyPollInterval", 10*time.Second,
+	"how often to check the policy file for changes, 0 to reload only on SIGHUP")
 
 var sn uint64 = uint64(time.Now().UnixNano())
 var duration float64 = 365.0 * 86400
 
 var logging bool = false
-var logger *log.Logger
-var dataPacketFileNum int = loggingSequenceNumber
+var dataPacketFileNum int = 1
+var logLock sync.Mutex
+
+var metrics = certmetrics.New()
+
+// Nonces handed out in answer to request_nonce.
+var nonces *noncestore.Store = nil
+
+// Set up in initCertifierService from the rate limiting flags.
+var clientLimiter *ratelimit.Limiter = nil
+
+// OCSP requests come from relying parties rather than enclaves, so they have
+// their own buckets, with the same limits.
+var ocspLimiter *ratelimit.Limiter = nil
+var validationSlots *ratelimit.Semaphore = nil
+
+// finishRequest adds a certification decision to the domain's audit log,
+// if enabled, and to the metrics.
+func finishRequest(d *policyDomain, r *auditlog.Record, start time.Time) {
+	if d.auditLog != nil {
+		err := d.auditLog.Append(r)
+		if err != nil {
+			fmt.Printf("finishRequest: %s\n", err.Error())
+		}
+	}
+
+	// Evidence type and purpose come from the client; only known values
+	// are used as labels.
+	evType := r.EvidenceType
+	if certlib.FindEvidenceVerifier(evType) == nil {
+		evType = "unknown"
+	}
+	purpose := r.Purpose
+	if purpose != "authentication" && purpose != "attestation" {
+		purpose = "other"
+	}
+	metrics.ObserveRequest(evType, purpose, r.Outcome, time.Since(start))
+	if r.Outcome == "succeeded" {
+		metrics.CertIssued(evType, purpose)
+	}
+}
 
-func initLog() bool {
-	name := *logDir + "/" + *logFile
+func initLog(dir string, file string) *log.Logger {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		fmt.Printf("Can't make log directory %s\n", dir)
+		return nil
+	}
+	name := dir + "/" + file
 	logFiled, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
 		fmt.Printf("Can't open log file\n")
-		return false
+		return nil
 	}
-	logger = log.New(logFiled, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
+	logger := log.New(logFiled, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
 	logger.Println("Starting simpleserver")
-	return true
+	return logger
 }
 
 var policyInitialized bool = false
-var signedPolicy *certprotos.SignedClaimSequence = &certprotos.SignedClaimSequence{}
-var originalPolicy *certprotos.ProvedStatements = &certprotos.ProvedStatements{}
 
-// At init, we retrieve the policy key and the rules to evaluate
-func initCertifierService() bool {
+// A verified policy and the sha256 digest of the policy file it came from.
+type loadedPolicy struct {
+	proved *certprotos.ProvedStatements
+	digest string
+}
+
+// A policyDomain is a policy key and cert, the signed policy, and the
+// issuance settings and logs that go with them.  The flags describe the
+// default domain; the config file can add named domains, which requests
+// select with trust_request_message.domain or the TLS server name.
+type policyDomain struct {
+	name       string // "" for the default domain
+	policyFile string
+
+	privatePolicyKey *certprotos.KeyMessage
+	publicPolicyKey  *certprotos.KeyMessage
+	policyCert       *x509.Certificate
+
+	// Validity of admission certs in seconds, and the URLs put in them.
+	duration float64
+	crlUrl   string
+	ocspUrl  string
+
+	// The key and cert that sign OCSP responses, the policy key and cert
+	// unless a delegated responder is configured.
+	ocspKey  *certprotos.KeyMessage
+	ocspCert *x509.Certificate
+
+	auditLog   *auditlog.Log
+	issuanceDB *issuancedb.DB
+	logDir     string
+	logger     *log.Logger
+
+	// Admission cert profiles and which a request can get, nil for none.
+	profiles *serverconfig.Issuance
+
+	// The current policy is swapped as a whole on reload, so a request
+	// sees either the old or the new *loadedPolicy, never a mix.  Requests
+	// must not modify it.  The Filter functions return a new
+	// ProvedStatements but most share the policy's clauses, so the clauses
+	// in it must not be modified either.
+	policy     atomic.Value
+	reloadLock sync.Mutex
+
+	// The last CRL produced.  It is reused until half its validity has
+	// passed or the revocations change.
+	crlLock        sync.Mutex
+	crlDer         []byte
+	crlProduced    time.Time
+	crlRevocations int
+
+	// Signed OCSP responses by hash algorithm and serial number, for
+	// serials in the issuance database.  Like the CRL, they are reused
+	// until half their validity has passed or the revocations change.
+	ocspLock        sync.Mutex
+	ocspResponses   map[string]ocspResponse
+	ocspRevocations int
+}
+
+type ocspResponse struct {
+	der      []byte
+	produced time.Time
+}
+
+var defaultDomain *policyDomain = nil
+var namedDomains = map[string]*policyDomain{}
+var serverNameDomains = map[string]*policyDomain{}
+
+// Named domains from the config file, in order.
+var configDomains []serverconfig.Domain
+
+// Issuance settings of the default domain that have no flag.
+var configIssuance *serverconfig.Issuance
+
+// OID of the attestation extension, from the config file.
+var attestationOid asn1.ObjectIdentifier
+
+// findDomain returns the domain a request names, or else the domain for
+// the TLS server name it connected with, or else the default domain.  It
+// returns nil if the request names an unknown domain.
+func findDomain(name string, serverName string) *policyDomain {
+	if name != "" {
+		return namedDomains[name]
+	}
+	if d := serverNameDomains[serverName]; d != nil {
+		return d
+	}
+	return defaultDomain
+}
+
+// allDomains returns the default domain, then the named domains.
+func allDomains() []*policyDomain {
+	domains := []*policyDomain{defaultDomain}
+	for _, cd := range configDomains {
+		domains = append(domains, namedDomains[cd.Name])
+	}
+	return domains
+}
+
+// anyIssuanceDB returns true if some domain has an issuance database.
+func anyIssuanceDB() bool {
+	for _, d := range allDomains() {
+		if d.issuanceDB != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *policyDomain) label() string {
+	if d.name == "" {
+		return "default"
+	}
+	return d.name
+}
+
+func (d *policyDomain) currentPolicy() *loadedPolicy {
+	return d.policy.Load().(*loadedPolicy)
+}
+
+func (d *policyDomain) setPolicy(policy *loadedPolicy) {
+	d.policy.Store(policy)
+	metrics.SetDomainPolicy(d.name, policy.digest, time.Now())
+}
+
+// loadPolicy reads and verifies the signed policy in fileName.
+func (d *policyDomain) loadPolicy(fileName string) *loadedPolicy {
+	serializedPolicy, err := os.ReadFile(fileName)
+	if err != nil {
+		fmt.Printf("loadPolicy: Can't read policy\n")
+		return nil
+	}
+	signedPolicy := &certprotos.SignedClaimSequence{}
+	err = proto.Unmarshal(serializedPolicy, signedPolicy)
+	if err != nil {
+		fmt.Printf("loadPolicy: Can't unmarshal signed policy\n")
+		return nil
+	}
+
+	policy := &certprotos.ProvedStatements{}
+	if !certlib.InitAxiom(*d.publicPolicyKey, policy) {
+		fmt.Printf("loadPolicy: Can't InitAxiom\n")
+		return nil
+	}
+	if !certlib.InitPolicy(d.publicPolicyKey, signedPolicy, policy) {
+		fmt.Printf("loadPolicy: Couldn't initialize policy\n")
+		return nil
+	}
+	digest := sha256.Sum256(serializedPolicy)
+	return &loadedPolicy{proved: policy, digest: hex.EncodeToString(digest[:])}
+}
+
+// reloadPolicy swaps in the policy in the domain's policy file if it
+// verifies.  If it doesn't, the current policy is kept.
+func (d *policyDomain) reloadPolicy(reason string) bool {
+	d.reloadLock.Lock()
+	defer d.reloadLock.Unlock()
+
+	old := d.currentPolicy()
+	policy := d.loadPolicy(d.policyFile)
+	if policy == nil {
+		fmt.Printf("reloadPolicy (%s, %s): new policy rejected, keeping policy %s\n", d.label(), reason, old.digest)
+		logEvent(d, "Policy reload rejected, keeping policy "+old.digest, nil, nil)
+		return false
+	}
+	if policy.digest == old.digest {
+		return true
+	}
+	d.setPolicy(policy)
+	fmt.Printf("reloadPolicy (%s, %s): policy %s, %d statements\n", d.label(), reason, policy.digest,
+		len(policy.proved.Proved))
+	logEvent(d, "Policy reloaded, digest "+policy.digest, nil, nil)
+	return true
+}
+
+// watchPolicy reloads the policies on SIGHUP, and when a policy file
+// changes if policyPollInterval is not zero.
+func watchPolicy() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if *policyPollInterval > 0 {
+		ticker := time.NewTicker(*policyPollInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	type fileState struct {
+		mod  time.Time
+		size int64
+	}
+	domains := allDomains()
+	last := make([]fileState, len(domains))
+	for i, d := range domains {
+		if info, err := os.Stat(d.policyFile); err == nil {
+			last[i] = fileState{info.ModTime(), info.Size()}
+		}
+	}
+
+	for {
+		select {
+		case <-hup:
+			for _, d := range domains {
+				d.reloadPolicy("SIGHUP")
+			}
+		case <-tick:
+			for i, d := range domains {
+				info, err := os.Stat(d.policyFile)
+				if err != nil {
+					continue
+				}
+				if info.ModTime().Equal(last[i].mod) && info.Size() == last[i].size {
+					continue
+				}
+				last[i] = fileState{info.ModTime(), info.Size()}
+				d.reloadPolicy("file changed")
+			}
+		}
+	}
+}
+
+// domainSettings are the files and issuance settings of a domain.
+type domainSettings struct {
+	name           string
+	policyKeyFile  string
+	policyCertFile string
+	policyFile     string
+	duration       float64
+	issuanceDbFile string
+	auditLogFile   string
+	crlUrl         string
+	ocspUrl        string
+	ocspKeyFile    string
+	ocspCertFile   string
+	logDir         string
+	logFile        string
+	profiles       *serverconfig.Issuance
+}
+
+// domainSettingsFromConfig fills in the settings of a named domain.  The
+// cert duration defaults to the server's; the logs go in a directory named
+// for the domain under logDir unless another is given.
+func domainSettingsFromConfig(cd *serverconfig.Domain) *domainSettings {
+	s := &domainSettings{
+		name:           cd.Name,
+		policyKeyFile:  *cd.Policy.KeyFile,
+		policyCertFile: *cd.Policy.CertFile,
+		policyFile:     *cd.Policy.File,
+		duration:       duration,
+		logDir:         *logDir + "/" + cd.Name,
+		logFile:        *logFile,
+	}
+	str := func(from *string, to *string) {
+		if from != nil {
+			*to = *from
+		}
+	}
+	if is := cd.Issuance; is != nil {
+		if is.CertDuration != nil {
+			s.duration = is.CertDuration.Seconds()
+		}
+		str(is.DbFile, &s.issuanceDbFile)
+		str(is.CrlUrl, &s.crlUrl)
+		str(is.OcspUrl, &s.ocspUrl)
+		str(is.OcspKeyFile, &s.ocspKeyFile)
+		str(is.OcspCertFile, &s.ocspCertFile)
+		s.profiles = is
+	}
+	if l := cd.Logging; l != nil {
+		str(l.Dir, &s.logDir)
+		str(l.File, &s.logFile)
+		str(l.AuditLogFile, &s.auditLogFile)
+	}
+	return s
+}
+
+// newPolicyDomain reads the policy key, cert and policy of a domain and
+// opens its logs and issuance database.
+func newPolicyDomain(s *domainSettings) *policyDomain {
+	d := &policyDomain{
+		name:           s.name,
+		policyFile:     s.policyFile,
+		duration:       s.duration,
+		crlUrl:         s.crlUrl,
+		ocspUrl:        s.ocspUrl,
+		logDir:         s.logDir,
+		profiles:       s.profiles,
+	}
 	// Debug
-	fmt.Printf("Initializing CertifierService, Policy key file: %s, Policy cert file: %s, Policy file: %s\n",
-		*policyKeyFile, *policyCertFile, *policyFile)
+	fmt.Printf("Initializing domain %s, Policy key file: %s, Policy cert file: %s, Policy file: %s\n",
+		d.label(), s.policyKeyFile, s.policyCertFile, s.policyFile)
+
+	if logging {
+		d.logger = initLog(s.logDir, s.logFile)
+		if d.logger == nil {
+			return nil
+		}
+	}
 
-	if *enableLog {
-		logging = initLog()
+	if s.issuanceDbFile != "" {
+		var err error
+		d.issuanceDB, err = issuancedb.Open(s.issuanceDbFile)
+		if err != nil {
+			fmt.Printf("SimpleServer: Can't open issuance database: %s\n", err.Error())
+			return nil
+		}
 	}
 
-	serializedKey, err := os.ReadFile(*policyKeyFile)
+	serializedKey, err := os.ReadFile(s.policyKeyFile)
 	if err != nil {
 		fmt.Println("Simple_server: can't read key file, ", err)
-		return false
+		return nil
 	}
 
-	serializedPolicyCert, err := os.ReadFile(*policyCertFile)
+	serializedPolicyCert, err := os.ReadFile(s.policyCertFile)
 	if err != nil {
 		fmt.Println("Simpleserver: can't read policy cert file, ", err)
-		return false
+		return nil
 	}
-	policyCert, err = x509.ParseCertificate(serializedPolicyCert)
+	d.policyCert, err = x509.ParseCertificate(serializedPolicyCert)
 	if err != nil {
 		fmt.Println("Simpleserver: Can't Parse policy cert, ", err)
-		return false
+		return nil
 	}
 
-	privatePolicyKey = &certprotos.KeyMessage{}
-	err = proto.Unmarshal(serializedKey, privatePolicyKey)
+	d.privatePolicyKey = &certprotos.KeyMessage{}
+	err = proto.Unmarshal(serializedKey, d.privatePolicyKey)
 	if err != nil {
 		fmt.Printf("SimpleServer: Can't unmarshal serialized policy key\n")
-		return false
+		return nil
 	}
 
-	publicPolicyKey = certlib.InternalPublicFromPrivateKey(privatePolicyKey)
-	if publicPolicyKey == nil {
+	d.publicPolicyKey = certlib.InternalPublicFromPrivateKey(d.privatePolicyKey)
+	if d.publicPolicyKey == nil {
 		fmt.Printf("SimpleServer: Can't get public policy key\n")
-		return false
+		return nil
 	}
-
-	// This should change to an InitPolicy call
-	if policyFile == nil {
-		fmt.Printf("SimpleServer: No policy file\n")
-		return false
+	if strength := certlib.KeyStrength(d.publicPolicyKey); strength < *minPolicyKeyStrength {
+		fmt.Printf("SimpleServer: %s policy key has %d bits of security, below the minimum of %d\n",
+			d.publicPolicyKey.GetKeyType(), strength, *minPolicyKeyStrength)
+		return nil
 	}
 
-	// Read policy
-	serializedPolicy, err := os.ReadFile(*policyFile)
-	if err != nil {
-		fmt.Printf("SimpleServer: Can't read policy\n")
-		return false
+	// The policy key signs the head of the audit log.
+	if s.auditLogFile != "" {
+		opts := &auditlog.Options{Signer: certlib.GetSignerFromInternal(d.privatePolicyKey)}
+		d.auditLog, err = auditlog.OpenWithOptions(s.auditLogFile, opts)
+		if err != nil {
+			fmt.Printf("SimpleServer: Can't open audit log: %s\n", err.Error())
+			return nil
+		}
+		if d.auditLog.Recovered() {
+			fmt.Printf("SimpleServer: removed a partial record at the end of audit log %s\n", s.auditLogFile)
+		}
+		if seq := d.auditLog.UnsignedRecord(); seq != 0 {
+			fmt.Printf("SimpleServer: record %d of audit log %s was not covered by the signed head, check it\n",
+				seq, s.auditLogFile)
+		}
 	}
 
-	err = proto.Unmarshal(serializedPolicy, signedPolicy)
-	if err != nil {
-		fmt.Printf("SimpleServer: Can't unmarshal signed policy\n")
-		return false
+	d.ocspKey = d.privatePolicyKey
+	d.ocspCert = d.policyCert
+	if s.ocspKeyFile != "" {
+		if !d.initOcspResponder(s.ocspKeyFile, s.ocspCertFile) {
+			return nil
+		}
 	}
 
-	if !certlib.InitAxiom(*publicPolicyKey, originalPolicy) {
-		fmt.Printf("SimpleServer: Can't InitAxiom\n")
-		return false
+	policy := d.loadPolicy(d.policyFile)
+	if policy == nil {
+		fmt.Printf("SimpleServer: Couldn't initialize policy\n")
+		return nil
 	}
+	d.setPolicy(policy)
+	fmt.Printf("SimpleServer: domain %s, policy %s, %d statements\n", d.label(), policy.digest,
+		len(policy.proved.Proved))
+	return d
+}
 
-	policyInitialized = certlib.InitPolicy(publicPolicyKey, signedPolicy, originalPolicy)
+// At init, we retrieve the policy key and the rules to evaluate
+func initCertifierService() bool {
+	logging = *enableLog
+	clientLimiter = ratelimit.NewLimiter(*rateLimit, *rateBurst)
+	ocspLimiter = ratelimit.NewLimiter(*rateLimit, *rateBurst)
+	validationSlots = ratelimit.NewSemaphore(*maxConcurrentValidations)
+	nonces = noncestore.New(*nonceLifetime, *maxOutstandingNonces)
 
-	if !policyInitialized {
-		fmt.Printf("SimpleServer: Couldn't initialize policy\n")
+	settings := &domainSettings{
+		policyKeyFile:  *policyKeyFile,
+		policyCertFile: *policyCertFile,
+		policyFile:     *policyFile,
+		duration:       duration,
+		issuanceDbFile: *issuanceDbFile,
+		auditLogFile:   *auditLogFile,
+		crlUrl:         *crlUrl,
+		ocspUrl:        *ocspUrl,
+		ocspKeyFile:    *ocspKeyFile,
+		ocspCertFile:   *ocspCertFile,
+		logDir:         *logDir,
+		logFile:        *logFile,
+	}
+	settings.profiles = configIssuance
+	defaultDomain = newPolicyDomain(settings)
+	if defaultDomain == nil {
 		return false
 	}
+	for i := range configDomains {
+		cd := &configDomains[i]
+		d := newPolicyDomain(domainSettingsFromConfig(cd))
+		if d == nil {
+			fmt.Printf("SimpleServer: Can't initialize domain %s\n", cd.Name)
+			return false
+		}
+		namedDomains[cd.Name] = d
+		for _, n := range cd.ServerNames {
+			serverNameDomains[n] = d
+		}
+	}
+	policyInitialized = true
 
 	if !certlib.InitSimulatedEnclave() {
 		fmt.Printf("SimpleServer: Can't init simulated enclave\n")
@@ -154,15 +612,57 @@ func initCertifierService() bool {
 	return true
 }
 
+// Client certs are checked against the policy cert, so admission certs
+// issued by ProduceAdmissionCert can be presented when renewing.  Other
+// client CAs can be added with tlsClientCAFile.
+func initTlsConfig() *tls.Config {
+	serverCert, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		fmt.Println("initTlsConfig: can't load server cert and key, ", err)
+		return nil
+	}
+	if defaultDomain == nil {
+		fmt.Printf("initTlsConfig: policy cert not initialized\n")
+		return nil
+	}
+
+	clientPool := x509.NewCertPool()
+	for _, d := range allDomains() {
+		clientPool.AddCert(d.policyCert)
+	}
+	if *tlsClientCAFile != "" {
+		caPem, err := os.ReadFile(*tlsClientCAFile)
+		if err != nil {
+			fmt.Println("initTlsConfig: can't read client CA file, ", err)
+			return nil
+		}
+		if !clientPool.AppendCertsFromPEM(caPem) {
+			fmt.Printf("initTlsConfig: no certs in client CA file\n")
+			return nil
+		}
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	if *tlsRequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientPool,
+		ClientAuth:   clientAuth,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
 //	--------------------------------------------------------------------------------------
 
-func logRequest(b []byte) *string {
+func logRequest(dir string, b []byte) *string {
 	if b == nil {
 		return nil
 	}
 	s := strconv.Itoa(dataPacketFileNum)
 	dataPacketFileNum = dataPacketFileNum + 1
-	fileName := *logDir + "/" + "SSReq" + "-" + s
+	fileName := dir + "/" + "SSReq" + "-" + s
 	if ioutil.WriteFile(fileName, b, 0666) != nil {
 		fmt.Printf("Can't write %s\n", fileName)
 		return nil
@@ -170,13 +670,13 @@ func logRequest(b []byte) *string {
 	return &fileName
 }
 
-func logResponse(b []byte) *string {
+func logResponse(dir string, b []byte) *string {
 	if b == nil {
 		return nil
 	}
 	s := strconv.Itoa(dataPacketFileNum)
 	dataPacketFileNum = dataPacketFileNum + 1
-	fileName := *logDir + "/" + "SSRsp" + "-" + s
+	fileName := dir + "/" + "SSRsp" + "-" + s
 	if ioutil.WriteFile(fileName, b, 0666) != nil {
 		fmt.Printf("Can't write %s\n", fileName)
 		return nil
@@ -184,13 +684,26 @@ func logResponse(b []byte) *string {
 	return &fileName
 }
 
+// logEvent writes to the log of domain d, or of the default domain if d is
+// nil.
 // Todo: Consider logging the proof and IP address too.
-func logEvent(msg string, req []byte, resp []byte) {
+func logEvent(d *policyDomain, msg string, req []byte, resp []byte) {
 	if !logging {
 		return
 	}
-	reqName := logRequest(req)
-	respName := logResponse(resp)
+	if d == nil {
+		d = defaultDomain
+	}
+	if d == nil || d.logger == nil {
+		return
+	}
+	logger := d.logger
+	// Requests are served concurrently; keep the file numbers and the
+	// parts of each log line together.
+	logLock.Lock()
+	defer logLock.Unlock()
+	reqName := logRequest(d.logDir, req)
+	respName := logResponse(d.logDir, resp)
 	logger.Printf("%s, ", msg)
 	if reqName != nil {
 		logger.Printf("%s ,", reqName)
@@ -204,113 +717,241 @@ func logEvent(msg string, req []byte, resp []byte) {
 	}
 }
 
-func ValidateRequestAndObtainToken(remoteIP string, pubKey *certprotos.KeyMessage, privKey *certprotos.KeyMessage,
-	evType string, purpose string, ep *certprotos.EvidencePackage) (bool, []byte) {
-
-	// evidenceType should be "vse-attestation-package", "gramine-evidence",
-	//      "oe-evidence" or "sev-platform-package"
-	var toProve *certprotos.VseClause = nil
-	var measurement []byte = nil
-	var success bool
-
-	if evType == "vse-attestation-package" {
-		success, toProve, measurement = certlib.ValidateInternalEvidence(pubKey, ep, originalPolicy, purpose)
-		if !success {
-			fmt.Printf("ValidateRequestAndObtainToken: ValidateInternalEvidence failed\n")
-			return false, nil
-		}
-	} else if evType == "sev-platform-package" {
-		success, toProve, measurement = certlib.ValidateSevEvidence(pubKey, ep, originalPolicy, purpose)
-		if !success {
-			fmt.Printf("ValidateRequestAndObtainToken: ValidateSevEvidence failed\n")
-			return false, nil
-		}
-	} else if evType == "oe-evidence" {
-		success, toProve, measurement = certlib.ValidateOeEvidence(pubKey, ep, originalPolicy, purpose)
-		if !success {
-			fmt.Printf("ValidateRequestAndObtainToken: ValidateOeEvidence failed\n")
-			return false, nil
-		}
-	} else if evType == "gramine-evidence" {
-		success, toProve, measurement = certlib.ValidateGramineEvidence(pubKey, ep, originalPolicy, purpose)
-		if !success {
-			fmt.Printf("ValidateRequestAndObtainToken: ValidateGramineEvidence failed\n")
-			return false, nil
-		}
-	} else if evType == "keystone-evidence" {
-		success, toProve, measurement = certlib.ValidateKeystoneEvidence(pubKey, ep, originalPolicy, purpose)
-		if !success {
-			fmt.Printf("ValidateRequestAndObtainToken: ValidateKeystoneEvidence failed\n")
-			return false, nil
-		}
-	} else if evType == "islet-evidence" {
-		success, toProve, measurement = certlib.ValidateIsletEvidence(pubKey, ep, originalPolicy, purpose)
-		if !success {
-			fmt.Printf("ValidateRequestAndObtainToken: ValidateIsletEvidence failed\n")
-			return false, nil
-		}
-	} else {
+// nextSerial returns the serial number for the next admission cert or
+// platform rule.
+func (d *policyDomain) nextSerial() uint64 {
+	if d.issuanceDB != nil {
+		return d.issuanceDB.NextSerial()
+	}
+	return atomic.AddUint64(&sn, 1)
+}
+
+func (d *policyDomain) recordIssuance(r *issuancedb.Record) bool {
+	if d.issuanceDB == nil {
+		return true
+	}
+	err := d.issuanceDB.Record(r)
+	if err != nil {
+		fmt.Printf("recordIssuance: %s\n", err.Error())
+		return false
+	}
+	return true
+}
+
+// ValidateRequestAndObtainToken validates the evidence in request against
+// the policy of d and returns whether it succeeded and the artifact.  The
+// last result is set if the request failed because of the certifier
+// rather than the evidence or policy.
+func ValidateRequestAndObtainToken(d *policyDomain, remoteIP string,
+	request *certprotos.TrustRequestMessage, audit *auditlog.Record) (bool, []byte, bool) {
+
+	pubKey := d.publicPolicyKey
+	privKey := d.privatePolicyKey
+	policyCert := d.policyCert
+	evType := request.GetSubmittedEvidenceType()
+	purpose := request.GetPurpose()
+	ep := request.Support
+
+	// evType selects the verifier registered in certlib, e.g.
+	//      "vse-attestation-package", "sev-platform-package" or "oe-evidence"
+	verifier := certlib.FindEvidenceVerifier(evType)
+	if verifier == nil {
 		fmt.Printf("ValidateRequestAndObtainToken: Invalid Evidence type: %s\n", evType)
-		return false, nil
+		audit.Reason = "unknown evidence type"
+		return false, nil, false
+	}
+	if enabledEvidenceTypes != nil && !enabledEvidenceTypes[evType] {
+		fmt.Printf("ValidateRequestAndObtainToken: Evidence type %s is not enabled\n", evType)
+		audit.Reason = "evidence type not enabled"
+		return false, nil, false
+	}
+	policy := d.currentPolicy()
+	audit.PolicyDigest = policy.digest
+	result, err := verifier.Validate(pubKey, ep, policy.proved, purpose)
+	if err != nil {
+		fmt.Printf("ValidateRequestAndObtainToken: Validate %s failed: ", evType)
+		certlib.PrintValidationError(err)
+		audit.Reason = "evidence does not satisfy policy: " + certlib.ReasonCode(err)
+		return false, nil, false
+	}
+	certlib.PrintValidationResult(result)
+	measurement := result.Measurement
+	audit.Measurement = hex.EncodeToString(measurement)
+
+	// The profile must be one the request may name, for this measurement.
+	var profileName string
+	var profile *serverconfig.Profile = nil
+	if d.profiles != nil {
+		profileName, profile, err = d.profiles.SelectProfile(request.GetProfile(), measurement)
+	} else if request.GetProfile() != "" {
+		err = fmt.Errorf("%w %s", serverconfig.ErrUnknownProfile, request.GetProfile())
+	}
+	if err != nil {
+		fmt.Printf("ValidateRequestAndObtainToken: %s\n", err.Error())
+		if errors.Is(err, serverconfig.ErrUnknownProfile) {
+			audit.Reason = "unknown profile"
+		} else {
+			audit.Reason = "profile not allowed"
+		}
+		return false, nil, false
+	}
+	if d.issuanceDB != nil {
+		// Pick up revocations made by certutility.
+		err = d.issuanceDB.Refresh()
+		if err != nil {
+			fmt.Printf("ValidateRequestAndObtainToken: can't read issuance database: %s\n", err.Error())
+			audit.Reason = "can't read issuance database"
+			return false, nil, true
+		}
+		if rev := d.issuanceDB.MeasurementRevoked(audit.Measurement); rev != nil {
+			fmt.Printf("ValidateRequestAndObtainToken: measurement %s was revoked: %s\n",
+				audit.Measurement, rev.Reason)
+			audit.Reason = "measurement revoked"
+			return false, nil, false
+		}
 	}
 
 	// Produce Artifact
 	var artifact []byte = nil
-	if toProve == nil || toProve.Subject == nil || toProve.Subject.Key == nil ||
-		toProve.Subject.Key.KeyName == nil {
-		fmt.Printf("ValidateRequestAndObtainToken: toProve check failed\n")
-		if toProve != nil {
-			certlib.PrintVseClause(toProve)
+	enclaveKey := result.EnclaveKey()
+	if enclaveKey == nil || enclaveKey.KeyName == nil {
+		fmt.Printf("ValidateRequestAndObtainToken: proved statement has no enclave key\n")
+		if result.Statement != nil {
+			certlib.PrintVseClause(result.Statement)
 			fmt.Printf("\n")
 		}
-		return false, nil
+		audit.Reason = "proved statement has no enclave key"
+		return false, nil, false
+	}
+	if strength := certlib.KeyStrength(enclaveKey); strength < *minEnclaveKeyStrength {
+		fmt.Printf("ValidateRequestAndObtainToken: %s enclave key is too weak\n",
+			enclaveKey.GetKeyType())
+		audit.Reason = "enclave key too weak"
+		return false, nil, false
+	}
+	attestedNonce, ok := checkNonce(result, audit)
+	if !ok {
+		return false, nil, false
+	}
+	if !checkPossession(request, enclaveKey, attestedNonce, audit) {
+		return false, nil, false
 	}
 	if policyCert == nil {
 		fmt.Printf("ValidateRequestAndObtainToken: policyCert is nil\n")
-		return false, nil
+		audit.Reason = "no policy cert"
+		return false, nil, true
 	}
 	if privKey == nil {
 		fmt.Printf("ValidateRequestAndObtainToken: privatePolicyKey is nil\n")
-		return false, nil
+		audit.Reason = "no policy key"
+		return false, nil, true
 	}
 
+	serial := d.nextSerial()
+	issued := &issuancedb.Record{
+		Serial:       serial,
+		EvidenceType: evType,
+		RemoteIP:     remoteIP,
+	}
+	issued.Platform, issued.PlatformProperties = result.PlatformType(), result.PlatformProperties()
 	if purpose == "attestation" {
 		artifact = certlib.ProducePlatformRule(privKey, policyCert,
-			toProve.Subject.Key, duration)
+			enclaveKey, d.duration)
 		if artifact == nil {
-			return false, nil
+			audit.Reason = "can't produce platform rule"
+			return false, nil, true
 		}
+		// ProducePlatformRule makes rules that are valid for a year.
+		issued.ArtifactType = issuancedb.PlatformRule
+		issued.NotBefore = time.Now().UTC()
+		issued.NotAfter = issued.NotBefore.Add(365 * 24 * time.Hour)
 	} else {
 		var appOrgName string
 		if measurement == nil {
 			fmt.Printf("ValidateRequestAndObtainToken: measurement is nil\n")
-			return false, nil
+			audit.Reason = "no measurement"
+			return false, nil, false
 		}
 		appOrgName = "Measured-" + hex.EncodeToString(measurement)
-		sn = sn + 1
 		org := "CertifierUsers"
 
 		// Debug
 		fmt.Printf("Enclave key is:\n")
-		certlib.PrintKey(toProve.Subject.Key)
+		certlib.PrintKey(enclaveKey)
 		fmt.Printf("\norg: %s, appOrgName: %s\n", org, appOrgName)
 
-		cert := certlib.ProduceAdmissionCert(remoteIP, privKey, policyCert,
-			toProve.Subject.Key, org, appOrgName, sn, duration)
+		certOptions := &certlib.AdmissionCertOptions{}
+		if d.crlUrl != "" {
+			certOptions.CrlDistributionPoints = []string{d.crlUrl}
+		}
+		if d.ocspUrl != "" {
+			certOptions.OcspServers = []string{d.ocspUrl}
+		}
+		certDuration := d.duration
+		if profile != nil {
+			platformType := issued.Platform
+			if platformType == "" {
+				platformType = evType
+			}
+			names, err := profile.ExpandNames(map[string]string{
+				"{measurement}": hex.EncodeToString(measurement),
+				"{platform}":    platformType,
+				"{key_name}":    enclaveKey.GetKeyName(),
+				"{remote_ip}":   remoteIP,
+			})
+			if err != nil {
+				fmt.Printf("ValidateRequestAndObtainToken: profile %s: %s\n", profileName, err.Error())
+				audit.Reason = "bad name for profile"
+				return false, nil, false
+			}
+			certOptions.Profile = certProfile(profile, names, org, appOrgName, remoteIP)
+			if profile.AttestationExtension != nil && *profile.AttestationExtension {
+				certOptions.Attestation = certlib.MakeAttestationInfo(measurement, platformType,
+					issued.PlatformProperties)
+				certOptions.AttestationOid = attestationOid
+			}
+			if profile.Validity != nil {
+				certDuration = profile.Validity.Seconds()
+			}
+			issued.Profile = profileName
+		}
+		cert := certlib.ProduceAdmissionCertWithOptions(remoteIP, privKey, policyCert,
+			enclaveKey, org, appOrgName, serial, certDuration, certOptions)
 		if cert == nil {
 			fmt.Printf("ValidateRequestAndObtainToken: x509 certificate is nil\n")
-			return false, nil
+			audit.Reason = "can't produce admission cert"
+			return false, nil, true
 		}
+		issued.ArtifactType = issuancedb.AdmissionCert
+		issued.NotBefore = cert.NotBefore
+		issued.NotAfter = cert.NotAfter
 
 		// Debug
 		certlib.PrintX509Cert(cert)
 		artifact = cert.Raw
 		if artifact == nil {
 			fmt.Printf("ValidateRequestAndObtainToken: Asn1 artifact is nil\n")
-			return false, nil
+			audit.Reason = "can't produce admission cert"
+			return false, nil, true
 		}
 	}
 
+	// Record the artifact before handing it out.
+	issued.SubjectKeyName = enclaveKey.GetKeyName()
+	issued.SubjectKey, _ = proto.Marshal(enclaveKey)
+	if measurement != nil {
+		issued.Measurement = hex.EncodeToString(measurement)
+	}
+	if serializedEvidence, err := proto.Marshal(ep); err == nil {
+		digest := sha256.Sum256(serializedEvidence)
+		issued.EvidenceDigest = hex.EncodeToString(digest[:])
+	}
+	if !d.recordIssuance(issued) {
+		audit.Reason = "can't record issuance"
+		return false, nil, true
+	}
+	audit.CertSerial = strconv.FormatUint(serial, 10)
+
 	// DEBUG
 	if artifact == nil {
 		fmt.Printf("ValidateRequestAndObtainToken: why is the artifact nil?\n")
@@ -319,54 +960,142 @@ func ValidateRequestAndObtainToken(remoteIP string, pubKey *certprotos.KeyMessag
 	certlib.PrintBytes(artifact)
 	fmt.Printf("\n")
 
-	return true, artifact
+	return true, artifact, false
 }
 
-// Procedure is:
-//      read a message
-//      evaluate the trust assertion
-//      if it succeeds,
-//            sign a cert
-//            save the proof, action and cert info in the transaction files
-//            save net infor for forensics
-//      if it fails
-//            save net infor for forensics
-//      if logging is enabled, log event, request and response
-func serviceThread(conn net.Conn, client string) {
-
-	b := certlib.SizedSocketRead(conn)
-	if b == nil {
-		logEvent("Can't read request", nil, nil)
-		return
+// certProfile returns the admission cert contents profile p describes,
+// with names its names filled in.  Settings it leaves out keep the contents
+// of the usual admission cert: subjName, subjOrg, the remote IP and the
+// usual usages.
+func certProfile(p *serverconfig.Profile, names *serverconfig.ProfileNames, subjName string, subjOrg string,
+	remoteIP string) *certlib.AdmissionCertProfile {
+	cp := &certlib.AdmissionCertProfile{
+		CommonName:   subjName,
+		Organization: subjOrg,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		MaxPathLen:   -1,
+		DNSNames:     names.DnsNames,
+		URIs:         names.Uris,
+		IPAddresses:  names.IpAddresses,
+	}
+	if names.CommonName != nil {
+		cp.CommonName = *names.CommonName
+	}
+	if names.Organization != nil {
+		cp.Organization = *names.Organization
+	}
+	if names.IpAddresses == nil {
+		if ip := net.ParseIP(remoteIP); ip != nil {
+			cp.IPAddresses = []net.IP{ip}
+		}
+	}
+	ku, kuOk, eku, ekuOk := p.Usages()
+	if kuOk {
+		cp.KeyUsage = ku
+	}
+	if ekuOk {
+		cp.ExtKeyUsage = eku
+	}
+	if p.IsCa != nil {
+		cp.IsCA = *p.IsCa
 	}
+	if p.MaxPathLen != nil {
+		cp.MaxPathLen = *p.MaxPathLen
+	}
+	return cp
+}
 
-	request := &certprotos.TrustRequestMessage{}
-	err := proto.Unmarshal(b, request)
-	if err != nil {
-		fmt.Println("serviceThread: Failed to decode request", err)
-		logEvent("Can't unmarshal request", nil, nil)
+// rateLimited fills in the response and audit record of a request over a limit.
+func rateLimited(response *certprotos.TrustResponseMessage, audit *auditlog.Record, reason string) {
+	fmt.Printf("processTrustRequest: %s, rejected request from %s\n", reason, audit.RemoteIP)
+	logEvent(nil, "Rate limited "+audit.RemoteIP+": "+reason, nil, nil)
+	limited := "rate-limited"
+	response.Status = &limited
+	audit.Outcome = limited
+	audit.Reason = reason
+}
+
+// reasonCodes turns an audit reason into the code returned with
+// --returnReasons, e.g. "evidence-does-not-satisfy-policy/signature".
+var reasonCodes = strings.NewReplacer(": ", "/", " ", "-", "'", "")
+
+// returnReason puts the reason a request failed in its response if
+// --returnReasons is set.  Audit reasons are fixed strings, so the code
+// says which check failed but nothing about the evidence or policy.
+func returnReason(response *certprotos.TrustResponseMessage, audit *auditlog.Record) {
+	if !*returnReasons || response.GetStatus() == "succeeded" || audit.Reason == "" {
 		return
 	}
+	reason := reasonCodes.Replace(audit.Reason)
+	response.Reason = &reason
+}
 
+// processTrustRequest is shared by the sized socket protocol and the gRPC
+// service so both go through ValidateRequestAndObtainToken.  serverName is
+// the TLS server name the client connected with, if any.  serverFault is
+// set if the request failed because of the certifier, not the request.
+func processTrustRequest(remoteIP string, serverName string,
+	request *certprotos.TrustRequestMessage) (response *certprotos.TrustResponseMessage, serverFault bool) {
 	// Debug
-	fmt.Printf("serviceThread: Trust request received:\n")
+	fmt.Printf("processTrustRequest: Trust request received:\n")
 	certlib.PrintTrustRequest(request)
 
 	// Prepare response
 	succeeded := "succeeded"
 	failed := "failed"
 
-	response := certprotos.TrustResponseMessage{}
+	response = &certprotos.TrustResponseMessage{}
 	response.RequestingEnclaveTag = request.RequestingEnclaveTag
 	response.ProvidingEnclaveTag = request.ProvidingEnclaveTag
 
-	var remoteIP string
-	if remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		remoteIP = remoteAddr.IP.String()
+	if request.GetRequestNonce() {
+		issueNonce(remoteIP, response)
+		// Nonces are only refused for the rate limit or if none can be made.
+		return response, response.GetStatus() == failed
+	}
+
+	// A request for an unknown domain is audited in the default domain.
+	d := findDomain(request.GetDomain(), serverName)
+	auditDomain := d
+	if auditDomain == nil {
+		auditDomain = defaultDomain
+	}
+	audit := &auditlog.Record{
+		RemoteIP:     remoteIP,
+		EvidenceType: request.GetSubmittedEvidenceType(),
+		Purpose:      request.GetPurpose(),
+	}
+	defer finishRequest(auditDomain, audit, time.Now())
+	defer returnReason(response, audit)
+
+	// Check the limits before any signature is verified.
+	if !clientLimiter.Allow(remoteIP) {
+		rateLimited(response, audit, "client rate limit")
+		return response, false
+	}
+	if !validationSlots.TryAcquire() {
+		rateLimited(response, audit, "too many concurrent validations")
+		return response, false
+	}
+	defer validationSlots.Release()
+
+	if d == nil {
+		fmt.Printf("processTrustRequest: unknown domain %s\n", request.GetDomain())
+		response.Status = &failed
+		audit.Outcome = failed
+		audit.Reason = "unknown domain"
+		return response, false
+	}
+	if request.Support == nil {
+		fmt.Printf("processTrustRequest: no evidence package\n")
+		response.Status = &failed
+		audit.Outcome = failed
+		audit.Reason = "no evidence package"
+		return response, false
 	}
-	outcome, artifact := ValidateRequestAndObtainToken(remoteIP, publicPolicyKey, privatePolicyKey,
-		request.GetSubmittedEvidenceType(), request.GetPurpose(),
-		request.Support)
+
+	outcome, artifact, fault := ValidateRequestAndObtainToken(d, remoteIP, request, audit)
 
 	if outcome {
 		response.Status = &succeeded
@@ -374,32 +1103,635 @@ func serviceThread(conn net.Conn, client string) {
 	} else {
 		response.Status = &failed
 	}
+	audit.Outcome = response.GetStatus()
+	return response, fault
+}
 
-	// Debug
-	fmt.Printf("Sending response\n")
-	certlib.PrintTrustReponse(&response)
-	fmt.Printf("\n")
-
-	// send response
-	rb, err := proto.Marshal(&response)
-	if err != nil {
-		logEvent("Couldn't marshall request", b, nil)
+// issueNonce answers the first round of the challenge: the client asks for
+// a nonce, its enclave puts it in the attestation_user_data and the evidence
+// is sent in a second request.  Nonce requests aren't certification
+// decisions, so they are not audited.
+func issueNonce(remoteIP string, response *certprotos.TrustResponseMessage) {
+	if !clientLimiter.Allow(remoteIP) {
+		status := "rate-limited"
+		response.Status = &status
 		return
 	}
-	if !certlib.SizedSocketWrite(conn, rb) {
-		fmt.Printf("SizedSocketWrite failed (2)\n")
+	nonce, err := nonces.Issue()
+	if err != nil {
+		fmt.Printf("issueNonce: %s\n", err.Error())
+		failed := "failed"
+		response.Status = &failed
 		return
 	}
-	if response.Status != nil && *response.Status == "succeeded" {
-		logEvent("Successful request", b, rb)
+	succeeded := "succeeded"
+	response.Status = &succeeded
+	response.Nonce = nonce
+}
+
+// checkNonce consumes the nonce in the verified user data for the enclave
+// key in result and returns it.  Evidence without a nonce is accepted
+// unless --requireNonce is set.
+func checkNonce(result *certlib.ValidationResult, audit *auditlog.Record) ([]byte, bool) {
+	ud := result.AttestedUserData()
+	if ud == nil || len(ud.Nonce) == 0 {
+		if *requireNonce {
+			fmt.Printf("checkNonce: evidence has no nonce\n")
+			audit.Reason = "no nonce"
+			return nil, false
+		}
+		return nil, true
+	}
+	if !nonces.Consume(ud.Nonce) {
+		fmt.Printf("checkNonce: nonce is unknown, used or expired\n")
+		audit.Reason = "stale nonce"
+		return nil, false
+	}
+	return ud.Nonce, true
+}
+
+// checkPossession verifies the request's proof that the requester holds
+// the private enclave key.  Its nonce may be the attested nonce, which
+// checkNonce has already consumed, or another fresh nonce.  Requests
+// without a proof are accepted unless --requirePossession is set.
+func checkPossession(request *certprotos.TrustRequestMessage, enclaveKey *certprotos.KeyMessage,
+	attestedNonce []byte, audit *auditlog.Record) bool {
+
+	p := request.GetPossession()
+	if p == nil {
+		if *requirePossession {
+			fmt.Printf("checkPossession: request has no proof of possession\n")
+			audit.Reason = "no proof of possession"
+			return false
+		}
+		return true
+	}
+	if !certlib.VerifyTrustRequestPossession(request, enclaveKey) {
+		audit.Reason = "bad proof of possession"
+		return false
+	}
+	if len(p.Nonce) == 0 {
+		fmt.Printf("checkPossession: proof of possession has no nonce\n")
+		audit.Reason = "bad proof of possession"
+		return false
+	}
+	if attestedNonce != nil && bytes.Equal(p.Nonce, attestedNonce) {
+		return true
+	}
+	if !nonces.Consume(p.Nonce) {
+		fmt.Printf("checkPossession: nonce is unknown, used or expired\n")
+		audit.Reason = "stale nonce"
+		return false
+	}
+	return true
+}
+
+// Procedure is:
+//      read a message
+//      evaluate the trust assertion
+//      if it succeeds,
+//            sign a cert
+//            save the proof, action and cert info in the transaction files
+//            save net infor for forensics
+//      if it fails
+//            save net infor for forensics
+//      if logging is enabled, log event, request and response
+func serviceThread(conn net.Conn, client string) {
+	defer conn.Close()
+
+	// A client that stalls holds a connection slot, so bound the handshake
+	// and read.
+	conn.SetDeadline(time.Now().Add(*connTimeout))
+
+	// Finish the handshake here so a failing client cert is reported
+	// for this connection rather than as a read error.
+	var serverName string
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		err := tlsConn.Handshake()
+		if err != nil {
+			fmt.Printf("serviceThread: TLS handshake failed: %s\n", err.Error())
+			logEvent(nil, "TLS handshake failed", nil, nil)
+			return
+		}
+		serverName = tlsConn.ConnectionState().ServerName
+		peerCerts := tlsConn.ConnectionState().PeerCertificates
+		if len(peerCerts) > 0 {
+			client = peerCerts[0].Subject.CommonName
+			fmt.Printf("serviceThread: client cert for %s\n", client)
+		}
+	}
+
+	b := certlib.SizedSocketReadMax(conn, *maxRequestSize)
+	if b == nil {
+		logEvent(nil, "Can't read request", nil, nil)
+		return
+	}
+
+	request := &certprotos.TrustRequestMessage{}
+	err := proto.Unmarshal(b, request)
+	if err != nil {
+		fmt.Println("serviceThread: Failed to decode request", err)
+		logEvent(nil, "Can't unmarshal request", nil, nil)
+		return
+	}
+
+	var remoteIP string
+	if remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		remoteIP = remoteAddr.IP.String()
+	}
+	response, _ := processTrustRequest(remoteIP, serverName, request)
+	d := findDomain(request.GetDomain(), serverName)
+
+	// Debug
+	fmt.Printf("Sending response\n")
+	certlib.PrintTrustReponse(response)
+	fmt.Printf("\n")
+
+	// send response, validation may have used up the deadline
+	conn.SetDeadline(time.Now().Add(*connTimeout))
+	rb, err := proto.Marshal(response)
+	if err != nil {
+		logEvent(d, "Couldn't marshall request", b, nil)
+		return
+	}
+	if !certlib.SizedSocketWrite(conn, rb) {
+		fmt.Printf("SizedSocketWrite failed (2)\n")
+		return
+	}
+	if response.Status != nil && *response.Status == "succeeded" {
+		logEvent(d, "Successful request", b, rb)
 	} else {
-		logEvent("Failed request", b, rb)
+		logEvent(d, "Failed request", b, rb)
 	}
 	return
 }
 
 //	------------------------------------------------------------------------------------
 
+// certifierGrpcServer implements CertifierService from certifier.proto
+type certifierGrpcServer struct {
+	certprotos.UnimplementedCertifierServiceServer
+}
+
+func (s *certifierGrpcServer) Certify(ctx context.Context,
+	request *certprotos.TrustRequestMessage) (*certprotos.TrustResponseMessage, error) {
+
+	if !request.GetRequestNonce() && (request.Support == nil || request.SubmittedEvidenceType == nil) {
+		return nil, status.Error(codes.InvalidArgument, "evidence type and evidence package required")
+	}
+	if ctx.Err() != nil {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	var remoteIP string
+	var serverName string
+	if p, ok := peer.FromContext(ctx); ok {
+		if remoteAddr, ok := p.Addr.(*net.TCPAddr); ok {
+			remoteIP = remoteAddr.IP.String()
+		}
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			serverName = tlsInfo.State.ServerName
+		}
+	}
+	response, serverFault := processTrustRequest(remoteIP, serverName, request)
+
+	if logging {
+		d := findDomain(request.GetDomain(), serverName)
+		b, _ := proto.Marshal(request)
+		rb, _ := proto.Marshal(response)
+		if response.GetStatus() == "succeeded" {
+			logEvent(d, "Successful gRPC request", b, rb)
+		} else {
+			logEvent(d, "Failed gRPC request", b, rb)
+		}
+	}
+	if response.GetStatus() == "succeeded" {
+		return response, nil
+	}
+	return nil, grpcStatus(response, serverFault)
+}
+
+// grpcStatus returns the error for a request that didn't succeed, classified
+// as for HTTP: rate limited, a server fault or a denial.  The response is
+// in the details.
+func grpcStatus(response *certprotos.TrustResponseMessage, serverFault bool) error {
+	var st *status.Status
+	if response.GetStatus() == "rate-limited" {
+		st = status.New(codes.ResourceExhausted, "rate limited")
+	} else if serverFault {
+		st = status.New(codes.Internal, "certifier failed to process the request")
+	} else {
+		msg := "evidence does not satisfy policy"
+		if response.Reason != nil {
+			msg = response.GetReason()
+		}
+		st = status.New(codes.PermissionDenied, msg)
+	}
+	if withDetails, err := st.WithDetails(response); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// grpcServer runs next to the sized socket listener and uses the same
+// TLS settings.
+func grpcServer(grpcAddr string) {
+	opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(*maxRequestSize)}
+	if *useTls {
+		tlsConfig := initTlsConfig()
+		if tlsConfig == nil {
+			fmt.Printf("grpcServer: failed to initialize TLS\n")
+			return
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	sock, err := net.Listen("tcp", grpcAddr)
+	if err != nil {
+		fmt.Printf("grpcServer, listen error: %s\n", err.Error())
+		return
+	}
+	s := grpc.NewServer(opts...)
+	certprotos.RegisterCertifierServiceServer(s, &certifierGrpcServer{})
+
+	fmt.Printf("grpcServer: listening on %s\n", grpcAddr)
+	err = s.Serve(sock)
+	if err != nil {
+		fmt.Printf("grpcServer: serve failed: %s\n", err.Error())
+	}
+}
+
+//	------------------------------------------------------------------------------------
+
+// httpError is the body returned with every non-200 HTTP response.
+type httpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeHttpError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&httpError{Code: code, Message: msg})
+}
+
+// certifyHandler serves POST /v1/certify.  The request and response are
+// trust_request_message and trust_response_message in protojson, so bytes
+// fields are base64.  A rejected evidence package is returned as 403 with
+// the response message, so the enclave tags are still available.
+func certifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeHttpError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if !policyInitialized {
+		writeHttpError(w, http.StatusServiceUnavailable, "certifier service not initialized")
+		return
+	}
+
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(*maxRequestSize)))
+	if err != nil {
+		writeHttpError(w, http.StatusRequestEntityTooLarge, "can't read request: "+err.Error())
+		return
+	}
+	request := &certprotos.TrustRequestMessage{}
+	err = protojson.Unmarshal(b, request)
+	if err != nil {
+		writeHttpError(w, http.StatusBadRequest, "can't decode request: "+err.Error())
+		return
+	}
+	if !request.GetRequestNonce() && (request.Support == nil || request.SubmittedEvidenceType == nil) {
+		writeHttpError(w, http.StatusBadRequest, "evidence type and evidence package required")
+		return
+	}
+
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	var serverName string
+	if r.TLS != nil {
+		serverName = r.TLS.ServerName
+	}
+	response, serverFault := processTrustRequest(remoteIP, serverName, request)
+	d := findDomain(request.GetDomain(), serverName)
+
+	rb, err := protojson.Marshal(response)
+	if err != nil {
+		writeHttpError(w, http.StatusInternalServerError, "can't encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if response.GetStatus() == "succeeded" {
+		w.WriteHeader(http.StatusOK)
+		logEvent(d, "Successful HTTP request", b, rb)
+	} else if response.GetStatus() == "rate-limited" {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	} else if serverFault {
+		// The client can't fix these, so they aren't reported as denials.
+		w.WriteHeader(http.StatusInternalServerError)
+		logEvent(d, "Failed HTTP request", b, rb)
+	} else {
+		w.WriteHeader(http.StatusForbidden)
+		logEvent(d, "Failed HTTP request", b, rb)
+	}
+	w.Write(rb)
+}
+
+// httpServer serves the HTTP/JSON API described in certifier_api.yaml.
+// It uses the same TLS settings as the sized socket listener.
+func httpServer(httpAddr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/certify", certifyHandler)
+	s := &http.Server{
+		Addr:              httpAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	fmt.Printf("httpServer: listening on %s\n", httpAddr)
+	var err error
+	if *useTls {
+		tlsConfig := initTlsConfig()
+		if tlsConfig == nil {
+			fmt.Printf("httpServer: failed to initialize TLS\n")
+			return
+		}
+		s.TLSConfig = tlsConfig
+		err = s.ListenAndServeTLS("", "")
+	} else {
+		err = s.ListenAndServe()
+	}
+	if err != nil {
+		fmt.Printf("httpServer: serve failed: %s\n", err.Error())
+	}
+}
+
+// currentCrl returns a CRL, signed by the domain's policy key, of the
+// certs revoked in its issuance database.
+func (d *policyDomain) currentCrl() []byte {
+	d.crlLock.Lock()
+	defer d.crlLock.Unlock()
+
+	err := d.issuanceDB.Refresh()
+	if err != nil {
+		fmt.Printf("currentCrl: can't refresh issuance database: %s\n", err.Error())
+	}
+	revocations := d.issuanceDB.Revocations()
+	if d.crlDer != nil && len(revocations) == d.crlRevocations &&
+		time.Since(d.crlProduced) < *crlValidity/2 {
+		return d.crlDer
+	}
+
+	var revoked []pkix.RevokedCertificate
+	for _, r := range revocations {
+		// Platform rules are not X.509 certs.
+		if rec := d.issuanceDB.Lookup(r.Serial); rec == nil || rec.ArtifactType != issuancedb.AdmissionCert {
+			continue
+		}
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   new(big.Int).SetUint64(r.Serial),
+			RevocationTime: r.RevokedAt,
+		})
+	}
+	// CRL numbers must increase, including across restarts.
+	now := time.Now()
+	number := big.NewInt(now.UnixNano())
+	crl := certlib.ProduceCrl(d.privatePolicyKey, d.policyCert, revoked, number, crlValidity.Seconds())
+	if crl == nil {
+		return d.crlDer
+	}
+	d.crlDer = crl
+	d.crlProduced = now
+	d.crlRevocations = len(revocations)
+	return d.crlDer
+}
+
+// crlHandler serves the default domain's CRL at /crl and a named domain's
+// at /crl/<domain>.
+func crlHandler(w http.ResponseWriter, r *http.Request) {
+	d := defaultDomain
+	if name := strings.TrimPrefix(r.URL.Path, "/crl/"); name != r.URL.Path {
+		d = namedDomains[name]
+	}
+	if d == nil || d.issuanceDB == nil {
+		writeHttpError(w, http.StatusNotFound, "no CRL for this domain")
+		return
+	}
+	crl := d.currentCrl()
+	if crl == nil {
+		writeHttpError(w, http.StatusServiceUnavailable, "no CRL")
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
+
+// crlServer serves the CRL at /crl over plain HTTP, as relying parties
+// expect for a CRL distribution point.
+func crlServer(crlAddr string) {
+	if !anyIssuanceDB() {
+		fmt.Printf("crlServer: revocation needs an issuance database\n")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/crl", crlHandler)
+	mux.HandleFunc("/crl/", crlHandler)
+	s := &http.Server{
+		Addr:              crlAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	fmt.Printf("crlServer: listening on %s\n", crlAddr)
+	err := s.ListenAndServe()
+	if err != nil {
+		fmt.Printf("crlServer: serve failed: %s\n", err.Error())
+	}
+}
+
+// initOcspResponder reads the delegated OCSP key and cert.  The cert must be
+// issued by the domain's policy key and have the OCSP signing usage.
+func (d *policyDomain) initOcspResponder(keyFile string, certFile string) bool {
+	serializedKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		fmt.Println("SimpleServer: can't read OCSP key file, ", err)
+		return false
+	}
+	d.ocspKey = &certprotos.KeyMessage{}
+	err = proto.Unmarshal(serializedKey, d.ocspKey)
+	if err != nil {
+		fmt.Printf("SimpleServer: Can't unmarshal serialized OCSP key\n")
+		return false
+	}
+	derCert, err := os.ReadFile(certFile)
+	if err != nil {
+		fmt.Println("SimpleServer: can't read OCSP cert file, ", err)
+		return false
+	}
+	d.ocspCert, err = x509.ParseCertificate(derCert)
+	if err != nil {
+		fmt.Println("SimpleServer: Can't Parse OCSP cert, ", err)
+		return false
+	}
+	if d.ocspCert.CheckSignatureFrom(d.policyCert) != nil {
+		fmt.Printf("SimpleServer: OCSP cert is not signed by the policy key\n")
+		return false
+	}
+	for _, u := range d.ocspCert.ExtKeyUsage {
+		if u == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	fmt.Printf("SimpleServer: OCSP cert can't sign OCSP responses\n")
+	return false
+}
+
+// ocspLookup returns the status of serial in the domain's issuance
+// database.  Only admission certs the certifier issued are good.
+func (d *policyDomain) ocspLookup(serial *big.Int) certlib.OcspStatus {
+	if !serial.IsUint64() {
+		return certlib.OcspStatus{Status: ocsp.Unknown}
+	}
+	r := d.issuanceDB.Lookup(serial.Uint64())
+	if r == nil || r.ArtifactType != issuancedb.AdmissionCert {
+		return certlib.OcspStatus{Status: ocsp.Unknown}
+	}
+	if r.Revoked != nil {
+		return certlib.OcspStatus{Status: ocsp.Revoked, RevokedAt: r.Revoked.RevokedAt}
+	}
+	return certlib.OcspStatus{Status: ocsp.Good}
+}
+
+// ocspHandler answers OCSP requests sent by POST, or by GET with the
+// base64 request in the path (RFC 6960, appendix A).  The domain is the
+// one whose policy cert issued the cert asked about.
+func ocspHandler(w http.ResponseWriter, r *http.Request) {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	if !ocspLimiter.Allow(remoteIP) {
+		fmt.Printf("ocspHandler: rate limit, rejected request from %s\n", remoteIP)
+		logEvent(nil, "Rate limited OCSP request from "+remoteIP, nil, nil)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ocsp.TryLaterErrorResponse)
+		return
+	}
+
+	var req []byte
+	switch r.Method {
+	case http.MethodPost:
+		req, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+	case http.MethodGet:
+		var encoded string
+		encoded, err = url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/ocsp/"))
+		if err == nil {
+			req, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeHttpError(w, http.StatusMethodNotAllowed, "OCSP requests must be GET or POST")
+		return
+	}
+	if err != nil {
+		writeHttpError(w, http.StatusBadRequest, "can't read OCSP request")
+		return
+	}
+
+	d := defaultDomain
+	for _, dd := range allDomains() {
+		if certlib.OcspRequestIssuedBy(req, dd.policyCert) {
+			d = dd
+			break
+		}
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if d.issuanceDB == nil {
+		w.Write(ocsp.UnauthorizedErrorResponse)
+		return
+	}
+	w.Write(d.currentOcspResponse(req))
+}
+
+// currentOcspResponse answers the DER OCSP request req, reusing the last
+// response for the serial if it is still current.
+func (d *policyDomain) currentOcspResponse(req []byte) []byte {
+	d.ocspLock.Lock()
+	defer d.ocspLock.Unlock()
+
+	err := d.issuanceDB.Refresh()
+	if err != nil {
+		fmt.Printf("ocspHandler: can't refresh issuance database: %s\n", err.Error())
+	}
+	if n := len(d.issuanceDB.Revocations()); d.ocspResponses == nil || n != d.ocspRevocations {
+		d.ocspResponses = map[string]ocspResponse{}
+		d.ocspRevocations = n
+	}
+
+	// Unknown serials aren't cached, so made up ones can't fill the cache.
+	var key string
+	parsed, err := ocsp.ParseRequest(req)
+	if err == nil && certlib.OcspRequestIssuedBy(req, d.policyCert) &&
+		d.ocspLookup(parsed.SerialNumber).Status != ocsp.Unknown {
+		key = fmt.Sprintf("%d/%s", parsed.HashAlgorithm, parsed.SerialNumber.String())
+		if c, ok := d.ocspResponses[key]; ok && time.Since(c.produced) < *ocspValidity/2 {
+			return c.der
+		}
+	}
+
+	now := time.Now()
+	resp := certlib.ProduceOcspResponse(req, d.ocspLookup, d.ocspKey, d.ocspCert, d.policyCert,
+		ocspValidity.Seconds())
+	if key != "" && !bytes.Equal(resp, ocsp.InternalErrorErrorResponse) {
+		d.ocspResponses[key] = ocspResponse{der: resp, produced: now}
+	}
+	return resp
+}
+
+// ocspServer runs the OCSP responder at /ocsp over plain HTTP, as
+// relying parties expect for an AIA OCSP URL.
+func ocspServer(ocspAddr string) {
+	if !anyIssuanceDB() {
+		fmt.Printf("ocspServer: OCSP needs an issuance database\n")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ocsp", ocspHandler)
+	mux.HandleFunc("/ocsp/", ocspHandler)
+	s := &http.Server{
+		Addr:              ocspAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	fmt.Printf("ocspServer: listening on %s\n", ocspAddr)
+	err := s.ListenAndServe()
+	if err != nil {
+		fmt.Printf("ocspServer: serve failed: %s\n", err.Error())
+	}
+}
+
+// metricsServer serves /metrics in the Prometheus text format.  It is a
+// separate listener so it can be left off the TLS transport and firewalled
+// to the monitoring network.
+func metricsServer(metricsAddr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	s := &http.Server{
+		Addr:              metricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	fmt.Printf("metricsServer: listening on %s\n", metricsAddr)
+	err := s.ListenAndServe()
+	if err != nil {
+		fmt.Printf("metricsServer: serve failed: %s\n", err.Error())
+	}
+}
+
+//	------------------------------------------------------------------------------------
+
 func server(serverAddr string, arg string) {
 
 	if !initCertifierService() {
@@ -407,19 +1739,47 @@ func server(serverAddr string, arg string) {
 		os.Exit(1)
 	}
 
+	go watchPolicy()
+
+	if *grpcPort != "" {
+		go grpcServer(*serverHost + ":" + *grpcPort)
+	}
+	if *httpPort != "" {
+		go httpServer(*serverHost + ":" + *httpPort)
+	}
+	if *metricsPort != "" {
+		go metricsServer(*serverHost + ":" + *metricsPort)
+	}
+	if *crlPort != "" {
+		go crlServer(*serverHost + ":" + *crlPort)
+	}
+	if *ocspPort != "" {
+		go ocspServer(*serverHost + ":" + *ocspPort)
+	}
+
 	var sock net.Listener
 	var err error
 	var conn net.Conn
 
 	// Listen for clients.
 	fmt.Printf("server: listening\n")
-	sock, err = net.Listen("tcp", serverAddr)
+	if *useTls {
+		tlsConfig := initTlsConfig()
+		if tlsConfig == nil {
+			fmt.Printf("server: failed to initialize TLS\n")
+			return
+		}
+		sock, err = tls.Listen("tcp", serverAddr, tlsConfig)
+	} else {
+		sock, err = net.Listen("tcp", serverAddr)
+	}
 	if err != nil {
 		fmt.Printf("server, listen error: ", err, "\n")
 		return
 	}
 
 	// Service client connections.
+	connSlots := ratelimit.NewSemaphore(*maxConnections)
 	for {
 		fmt.Printf("server: at accept\n")
 		conn, err = sock.Accept()
@@ -427,15 +1787,140 @@ func server(serverAddr string, arg string) {
 			fmt.Printf("server: can't accept connection: %s\n", err.Error())
 			continue
 		}
+		// Refuse a rate limited client before the handshake and read.
+		if remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && clientLimiter.Limited(remoteAddr.IP.String()) {
+			fmt.Printf("server: client rate limit, closing connection from %s\n", conn.RemoteAddr().String())
+			logEvent(nil, "Rate limited, closed "+conn.RemoteAddr().String(), nil, nil)
+			conn.Close()
+			continue
+		}
+		if !connSlots.TryAcquire() {
+			fmt.Printf("server: too many connections, closing connection from %s\n", conn.RemoteAddr().String())
+			logEvent(nil, "Too many connections, closed "+conn.RemoteAddr().String(), nil, nil)
+			conn.Close()
+			continue
+		}
 		// Todo: maybe get client name and client IP for logging.
 		var clientName string = "blah"
-		go serviceThread(conn, clientName)
+		go func(conn net.Conn) {
+			defer connSlots.Release()
+			serviceThread(conn, clientName)
+		}(conn)
+	}
+}
+
+// applyConfig sets the flags not given on the command line from the config
+// file.
+func applyConfig() bool {
+	if *configFile == "" {
+		return true
+	}
+	cfg, err := serverconfig.Load(*configFile)
+	if err != nil {
+		fmt.Printf("simpleserver: bad config file %s\n", err.Error())
+		return false
+	}
+	configDomains = cfg.Domains
+	configIssuance = cfg.Issuance
+	if cfg.Issuance != nil && cfg.Issuance.AttestationOid != nil {
+		// Validated when the config was read.
+		attestationOid, _ = serverconfig.ParseOid(*cfg.Issuance.AttestationOid)
+	}
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, v := range cfg.FlagValues() {
+		if given[name] {
+			continue
+		}
+		err := flag.Set(name, v)
+		if err != nil {
+			fmt.Printf("simpleserver: config setting for --%s: %s\n", name, err.Error())
+			return false
+		}
 	}
+	return true
+}
+
+// Submitted evidence types accepted, nil for all of them.
+var enabledEvidenceTypes map[string]bool = nil
+
+// checkSettings reports settings that can't work together, after the
+// config file and flags are combined.
+func checkSettings() bool {
+	var problems []string
+	// Any domain's issuance database will do for the CRL and OCSP listeners.
+	haveIssuanceDb := *issuanceDbFile != ""
+	for _, cd := range configDomains {
+		if cd.Issuance != nil && cd.Issuance.DbFile != nil && *cd.Issuance.DbFile != "" {
+			haveIssuanceDb = true
+		}
+	}
+	if !haveIssuanceDb {
+		if *crlPort != "" {
+			problems = append(problems, "--crlPort needs --issuanceDbFile")
+		}
+		if *ocspPort != "" {
+			problems = append(problems, "--ocspPort needs --issuanceDbFile")
+		}
+	}
+	// The config file was checked, but flags can change the default
+	// domain's files.
+	for _, cd := range configDomains {
+		var files []string
+		if cd.Issuance != nil && cd.Issuance.DbFile != nil {
+			files = append(files, *cd.Issuance.DbFile)
+		}
+		if cd.Logging != nil && cd.Logging.AuditLogFile != nil {
+			files = append(files, *cd.Logging.AuditLogFile)
+		}
+		for _, f := range files {
+			for _, own := range []string{*issuanceDbFile, *auditLogFile} {
+				if f != "" && own != "" && filepath.Clean(f) == filepath.Clean(own) {
+					problems = append(problems, fmt.Sprintf("domain %s also uses %s", cd.Name, own))
+				}
+			}
+		}
+	}
+	if (*ocspKeyFile == "") != (*ocspCertFile == "") {
+		problems = append(problems, "--ocspKeyFile and --ocspCertFile must be given together")
+	}
+	if *useTls && (*tlsCertFile == "" || *tlsKeyFile == "") {
+		problems = append(problems, "--useTls needs --tlsCertFile and --tlsKeyFile")
+	}
+	if *certDuration <= 0 {
+		problems = append(problems, "--certDuration must be more than 0")
+	}
+	if *loggingSequenceNumber < 0 {
+		problems = append(problems, "--loggingSequenceNumber must not be negative")
+	}
+	if *evidenceTypes != "" {
+		enabledEvidenceTypes = map[string]bool{}
+		for _, t := range strings.Split(*evidenceTypes, ",") {
+			t = strings.TrimSpace(t)
+			if certlib.FindEvidenceVerifier(t) == nil {
+				problems = append(problems, fmt.Sprintf("unknown evidence type %q, known types are %s",
+					t, strings.Join(certlib.RegisteredEvidenceVerifiers(), ", ")))
+				continue
+			}
+			enabledEvidenceTypes[t] = true
+		}
+	}
+	for _, p := range problems {
+		fmt.Printf("simpleserver: %s\n", p)
+	}
+	return len(problems) == 0
 }
 
 func main() {
 
 	flag.Parse()
+	if !applyConfig() || !checkSettings() {
+		os.Exit(1)
+	}
+	dataPacketFileNum = *loggingSequenceNumber
+	duration = certDuration.Seconds()
 
 	var serverAddr string
 	serverAddr = *serverHost + ":" + *serverPort
@@ -460,7 +1945,7 @@ func main() {
 	           fmt.Printf("Measurement length: %d\n", len(outMeasurement));
 	*/
 
-	// later this may turn into a TLS connection, we'll see
+	// With -useTls, the sized messages are carried over TLS
 	server(serverAddr, arg)
 	fmt.Printf("server: done\n")
 }
@@ -1606,10 +1606,13 @@ function build_simple_server() {
 
     # Compiler the protobuf
     run_cmd cd certifier_service/certprotos
-    run_cmd protoc                              \
-                --go_opt=paths=source_relative  \
-                --go_out=.                      \
-                --go_opt=M=certifier.proto ./certifier.proto
+    run_cmd protoc                                  \
+                --go_opt=paths=source_relative      \
+                --go_out=.                          \
+                --go_opt=M=certifier.proto          \
+                --go-grpc_opt=paths=source_relative \
+                --go-grpc_out=.                     \
+                --go-grpc_opt=M=certifier.proto ./certifier.proto
 
     # --------------------------------------------------------------------------
     # Certifier Service has C-Go wrappers that only come into play on specific